@@ -0,0 +1,270 @@
+package mcproto
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Admin is an http.Handler for operators, served on its own port:
+//
+//	GET  /stats     counters as JSON
+//	GET  /conns     open connections as JSON
+//	GET  /config    effective connection settings of Params as JSON
+//	POST /debug?connerr=1|0  log connection errors, raising the log level
+//	                         to at least 1, or stop logging: verbosity 0
+//	POST /drain     calls Drain
+//	POST /shutdown  calls Shutdown
+//
+// With Profiling set it also serves:
+//
+//	GET  /runtime                  Go runtime metrics as JSON
+//	GET  /debug/pprof/             profiles of runtime/pprof
+//	GET  /debug/pprof/<profile>    a profile, like heap or goroutine
+//	GET  /debug/pprof/profile?seconds=30  a CPU profile
+//
+// Every request must carry "Authorization: Bearer <Token>",
+// with an empty Token all requests are refused.
+type Admin struct {
+	Token  string
+	Params string // params of the served connections
+
+	Profiling bool // serve runtime metrics and profiles
+
+	Drain    func() error // nil if draining is not supported
+	Shutdown func() error // nil if shutdown is not supported
+
+	started time.Time
+	mux     *http.ServeMux
+}
+
+// AdminStats are the counters served by /stats
+type AdminStats struct {
+	Uptime      int64       `json:"uptime"` // seconds
+	Conns       int         `json:"conns"`
+	WriteErrors uint64      `json:"write_errors"`
+	Shed        ShedStats   `json:"shed"`
+	Memory      MemoryStats `json:"memory"`
+	Totals      Totals      `json:"totals"`   // since boot
+	Lifetime    Totals      `json:"lifetime"` // across restarts, see PersistTotals
+
+	Violations []ClientViolations `json:"violations"`
+}
+
+// NewAdmin returns an admin handler authorized by token
+func NewAdmin(token, params string) *Admin {
+	a := &Admin{Token: token, Params: params, started: time.Now(), mux: http.NewServeMux()}
+	a.mux.HandleFunc("/stats", a.get(a.stats))
+	a.mux.HandleFunc("/conns", a.get(a.conns))
+	a.mux.HandleFunc("/config", a.get(a.config))
+	a.mux.HandleFunc("/debug", a.post(a.debug))
+	a.mux.HandleFunc("/drain", a.post(func(w http.ResponseWriter, r *http.Request) { a.control(w, a.Drain) }))
+	a.mux.HandleFunc("/shutdown", a.post(func(w http.ResponseWriter, r *http.Request) { a.control(w, a.Shutdown) }))
+	a.mux.HandleFunc("/runtime", a.profiling(a.get(a.runtime)))
+	a.mux.HandleFunc("/debug/pprof/", a.profiling(a.get(a.pprof)))
+	return a
+}
+
+func (a *Admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !a.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	a.mux.ServeHTTP(w, r)
+}
+
+// authorized reports whether r carries "Authorization: Bearer <Token>",
+// a bare token is refused
+func (a *Admin) authorized(r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+	if a.Token == "" || !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	token := auth[len("Bearer "):]
+	return subtle.ConstantTimeCompare([]byte(token), []byte(a.Token)) == 1
+}
+
+func (a *Admin) get(fn http.HandlerFunc) http.HandlerFunc {
+	return a.method(http.MethodGet, fn)
+}
+
+func (a *Admin) post(fn http.HandlerFunc) http.HandlerFunc {
+	return a.method(http.MethodPost, fn)
+}
+
+func (a *Admin) method(method string, fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		fn(w, r)
+	}
+}
+
+// profiling hides fn unless Profiling is set
+func (a *Admin) profiling(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !a.Profiling {
+			http.NotFound(w, r)
+			return
+		}
+		fn(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (a *Admin) stats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, AdminStats{
+		Uptime:      int64(time.Since(a.started) / time.Second),
+		Conns:       len(Conns()),
+		WriteErrors: WriteErrors(),
+		Shed:        Shed(),
+		Memory:      Memory(),
+		Totals:      BootTotals(),
+		Lifetime:    LifetimeTotals(),
+		Violations:  Violations(),
+	})
+}
+
+func (a *Admin) conns(w http.ResponseWriter, r *http.Request) {
+	type connJSON struct {
+		ID         uint64    `json:"id"`
+		RemoteAddr string    `json:"remote_addr"`
+		State      string    `json:"state"`
+		Since      time.Time `json:"since"`
+		Opened     time.Time `json:"opened"`
+	}
+	list := []connJSON{}
+	for _, c := range Conns() {
+		cj := connJSON{ID: c.ID, State: c.State.String(), Since: c.Since, Opened: c.Opened}
+		if c.RemoteAddr != nil {
+			cj.RemoteAddr = c.RemoteAddr.String()
+		}
+		list = append(list, cj)
+	}
+	writeJSON(w, list)
+}
+
+func (a *Admin) config(w http.ResponseWriter, r *http.Request) {
+	cfg, err := parseParams(a.Params)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	view := make(map[string]string)
+	for _, s := range cfg.settings() {
+		view[s.name] = s.value
+	}
+	writeJSON(w, view)
+}
+
+func (a *Admin) debug(w http.ResponseWriter, r *http.Request) {
+	on, err := strconv.ParseBool(r.FormValue("connerr"))
+	if err != nil {
+		http.Error(w, "connerr must be 1 or 0", http.StatusBadRequest)
+		return
+	}
+	switch {
+	case !on:
+		setLogLevel(0)
+	case logLevel() < 1:
+		setLogLevel(1)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *Admin) control(w http.ResponseWriter, fn func() error) {
+	if fn == nil {
+		http.Error(w, "not supported", http.StatusNotImplemented)
+		return
+	}
+	if err := fn(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RuntimeStats are the Go runtime metrics served by /runtime
+type RuntimeStats struct {
+	Goroutines   int      `json:"goroutines"`
+	HeapAlloc    uint64   `json:"heap_alloc"`
+	HeapSys      uint64   `json:"heap_sys"`
+	HeapObjects  uint64   `json:"heap_objects"`
+	NumGC        uint32   `json:"num_gc"`
+	PauseTotalNs uint64   `json:"pause_total_ns"`
+	LastPausesNs []uint64 `json:"last_pauses_ns"` // newest first
+}
+
+func (a *Admin) runtime(w http.ResponseWriter, r *http.Request) {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	rs := RuntimeStats{
+		Goroutines:   runtime.NumGoroutine(),
+		HeapAlloc:    m.HeapAlloc,
+		HeapSys:      m.HeapSys,
+		HeapObjects:  m.HeapObjects,
+		NumGC:        m.NumGC,
+		PauseTotalNs: m.PauseTotalNs,
+		LastPausesNs: []uint64{},
+	}
+	for i := uint32(0); i < m.NumGC && i < 16; i++ {
+		rs.LastPausesNs = append(rs.LastPausesNs, m.PauseNs[(m.NumGC-1-i)%256])
+	}
+	writeJSON(w, rs)
+}
+
+// pprof serves runtime/pprof profiles without net/http/pprof,
+// which would register itself on http.DefaultServeMux
+func (a *Admin) pprof(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/debug/pprof/")
+	switch name {
+	case "":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, p := range pprof.Profiles() {
+			fmt.Fprintf(w, "%s %d\n", p.Name(), p.Count())
+		}
+		fmt.Fprintln(w, "profile")
+	case "profile":
+		sec, _ := strconv.Atoi(r.FormValue("seconds"))
+		if sec <= 0 {
+			sec = 30
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		if err := pprof.StartCPUProfile(w); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		select {
+		case <-time.After(time.Duration(sec) * time.Second):
+		case <-r.Context().Done():
+		}
+		pprof.StopCPUProfile()
+	default:
+		p := pprof.Lookup(name)
+		if p == nil {
+			http.NotFound(w, r)
+			return
+		}
+		debug, _ := strconv.Atoi(r.FormValue("debug"))
+		if debug > 0 {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		} else {
+			w.Header().Set("Content-Type", "application/octet-stream")
+		}
+		p.WriteTo(w, debug)
+	}
+}
@@ -0,0 +1,43 @@
+package mcproto
+
+import (
+	"crypto/tls"
+	"sync/atomic"
+	"time"
+)
+
+// ALPN protocol IDs selecting the protocol of TLS connections
+const (
+	ALPNText   = "memcache-text"
+	ALPNMeta   = "memcache-meta"
+	ALPNBinary = "memcache-binary"
+)
+
+// ALPNProtocols are the supported ALPN IDs in order of server preference,
+// for tls.Config.NextProtos of listeners:
+//
+//	cfg.NextProtos = mcproto.ALPNProtocols
+//
+// A TLS connection negotiating one starts in its protocol, without ALPN
+// it starts in the text protocol.
+var ALPNProtocols = []string{ALPNBinary, ALPNMeta, ALPNText}
+
+var alpnProtocols = map[string]Protocol{ALPNText: ProtocolText, ALPNMeta: ProtocolMeta, ALPNBinary: ProtocolBinary}
+
+// negotiate completes the TLS handshake within deadline and selects
+// the protocol of the connection by ALPN
+func (mc *conn) negotiate() error {
+	tc, ok := mc.c.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	tc.SetDeadline(time.Now().Add(mc.cfg.deadline))
+	if err := tc.Handshake(); err != nil {
+		return err
+	}
+	tc.SetDeadline(time.Time{})
+	if p, ok := alpnProtocols[tc.ConnectionState().NegotiatedProtocol]; ok {
+		atomic.StoreInt32(&mc.meta.protocol, int32(p))
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package mcproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"strconv"
+)
+
+// ErrBadDigest is returned by SyncFrom on a malformed digest response
+var ErrBadDigest = errors.New("mcproto: malformed digest response")
+
+// maxDigestBuckets bounds the buckets of a digest command
+const maxDigestBuckets = 1 << 16
+
+// BucketDigest summarizes the items of one bucket of the keyspace.
+// Keys are spread over buckets by hash, Sum is order independent,
+// so equal buckets on two nodes have equal digests.
+type BucketDigest struct {
+	Bucket int
+	Items  int
+	Sum    uint64
+}
+
+// SyncStats describe a SyncFrom run
+type SyncStats struct {
+	Buckets   int // buckets compared
+	Differing int // buckets streamed from the remote node
+	Items     int // items stored
+}
+
+// keyBucket returns the digest bucket of key
+func keyBucket(key []byte, buckets int) int {
+	h := fnv.New32a()
+	h.Write(key)
+	return int(h.Sum32() % uint32(buckets))
+}
+
+// itemSum hashes the key, value and flags of an item, not the lifetime,
+// which differs between nodes holding the same item
+func itemSum(it Item) uint64 {
+	h := fnv.New64a()
+	var n [4]byte
+	binary.BigEndian.PutUint32(n[:], uint32(len(it.Key)))
+	h.Write(n[:])
+	h.Write(it.Key)
+	h.Write(it.Value)
+	binary.BigEndian.PutUint32(n[:], it.Flags)
+	h.Write(n[:])
+	return h.Sum64()
+}
+
+// Digests returns the digests of the non-empty buckets of db ordered by bucket
+func Digests(db McEngine, buckets int) ([]BucketDigest, error) {
+	d, ok := db.(Dumper)
+	if !ok {
+		return nil, ErrNotDumper
+	}
+	sums := make(map[int]*BucketDigest)
+	err := d.Dump(func(it Item) error {
+		b := keyBucket(it.Key, buckets)
+		bd, ok := sums[b]
+		if !ok {
+			bd = &BucketDigest{Bucket: b}
+			sums[b] = bd
+		}
+		bd.Items++
+		bd.Sum ^= itemSum(it)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	list := make([]BucketDigest, 0, len(sums))
+	for b := 0; b < buckets && len(list) < len(sums); b++ {
+		if bd, ok := sums[b]; ok {
+			list = append(list, *bd)
+		}
+	}
+	return list, nil
+}
+
+// digest answers "digest <buckets>" with the digests of non-empty buckets:
+// DIGEST <bucket> <items> <sum>\r\n ... END\r\n
+func digest(line []byte, db McEngine, rw *bufio.ReadWriter) (err error) {
+	if _, ok := db.(Dumper); !ok {
+		return protocolError(rw)
+	}
+	args := bytes.Fields(line)
+	if len(args) != 2 || !bytes.HasSuffix(line, crlf) {
+		return clientError(rw, "bad command line format")
+	}
+	buckets, err := strconv.Atoi(string(args[1]))
+	if err != nil || buckets <= 0 || buckets > maxDigestBuckets {
+		return clientError(rw, "bad command line format")
+	}
+	list, err := Digests(db, buckets)
+	if err != nil {
+		return serverError(rw, err.Error())
+	}
+	for _, bd := range list {
+		if _, err = fmt.Fprintf(rw, "DIGEST %d %d %x\r\n", bd.Bucket, bd.Items, bd.Sum); err != nil {
+			return
+		}
+	}
+	if _, err = rw.Write(resultEnd); err != nil {
+		return
+	}
+	return rw.Flush()
+}
+
+// SyncFrom reconciles db with the node at the other end of remote, a connection
+// to its mcproto server. Digests of buckets are compared and only differing
+// buckets are streamed and stored, so replicated caches converge without full
+// dumps. Items missing on the remote node are kept, run it both ways for two-way sync.
+func SyncFrom(remote io.ReadWriter, db McEngine, buckets int) (stats SyncStats, err error) {
+	if buckets <= 0 || buckets > maxDigestBuckets {
+		return stats, fmt.Errorf("mcproto: buckets out of range: %d", buckets)
+	}
+	local, err := Digests(db, buckets)
+	if err != nil {
+		return
+	}
+	if _, err = fmt.Fprintf(remote, "digest %d\r\n", buckets); err != nil {
+		return
+	}
+	br := bufio.NewReader(remote)
+	theirs := make(map[int]BucketDigest)
+	for {
+		line, err := br.ReadSlice('\n')
+		if err != nil {
+			return stats, err
+		}
+		if bytes.Equal(line, resultEnd) {
+			break
+		}
+		var bd BucketDigest
+		if _, err = fmt.Sscanf(string(line), "DIGEST %d %d %x\r\n", &bd.Bucket, &bd.Items, &bd.Sum); err != nil {
+			return stats, ErrBadDigest
+		}
+		theirs[bd.Bucket] = bd
+	}
+	ours := make(map[int]BucketDigest, len(local))
+	for _, bd := range local {
+		ours[bd.Bucket] = bd
+	}
+	stats.Buckets = buckets
+	for b := 0; b < buckets; b++ {
+		bd, ok := theirs[b]
+		if !ok || bd == ours[b] {
+			// nothing to pull from an empty remote bucket
+			continue
+		}
+		stats.Differing++
+		if _, err = fmt.Fprintf(remote, "backup %d %d\r\n", b, buckets); err != nil {
+			return
+		}
+		n, err := restore(br, db, restoreOptions{})
+		stats.Items += n
+		if err != nil {
+			return stats, err
+		}
+	}
+	return
+}
@@ -0,0 +1,147 @@
+package mcproto
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Item is a stored item with its metadata.
+// Exp is the remaining lifetime in seconds, 0 means the item never expires.
+// CAS is the version of the item for engines implementing CASGetter.
+type Item struct {
+	Key   []byte
+	Value []byte
+	Flags uint32
+	Exp   int32
+	CAS   uint64
+}
+
+// Dumper is an optional interface for engines that can iterate all items.
+// Dump calls fn for every item until fn returns an error.
+// Dump must see a point-in-time view of the engine: writes that run
+// concurrently with a long dump must not produce torn or duplicated items
+// (copy-on-write or generation fencing in the engine).
+type Dumper interface {
+	Dump(fn func(item Item) error) error
+}
+
+// ErrBadBackup is returned by RestoreFrom on a malformed backup stream
+var ErrBadBackup = errors.New("mcproto: malformed backup stream")
+
+// backup streams all items as:
+// ITEM <key> <flags> <ttl> <bytes>\r\n<data>\r\n ... END\r\n
+// With "backup <bucket> <buckets>" it streams the items of one digest bucket.
+func backup(line []byte, db McEngine, rw *bufio.ReadWriter) (err error) {
+	d, ok := db.(Dumper)
+	if !ok {
+		return protocolError(rw)
+	}
+	args := bytes.Fields(line)
+	if (len(args) != 1 && len(args) != 3) || !bytes.HasSuffix(line, crlf) {
+		return clientError(rw, "bad command line format")
+	}
+	var filter func(key []byte) bool
+	if len(args) == 3 {
+		bucket, err1 := strconv.Atoi(string(args[1]))
+		buckets, err2 := strconv.Atoi(string(args[2]))
+		if err1 != nil || err2 != nil || buckets <= 0 || bucket < 0 || bucket >= buckets {
+			return clientError(rw, "bad command line format")
+		}
+		filter = func(key []byte) bool { return keyBucket(key, buckets) == bucket }
+	}
+	if _, err = dumpItems(rw, d, filter); err != nil {
+		// the stream is broken in the middle, the client sees no END
+		return
+	}
+	return rw.Flush()
+}
+
+// dumpItems writes the items of d accepted by filter in the backup format,
+// a nil filter accepts all
+func dumpItems(w io.Writer, d Dumper, filter func(key []byte) bool) (n int, err error) {
+	err = d.Dump(func(it Item) error {
+		if filter != nil && !filter(it.Key) {
+			return nil
+		}
+		if _, err := fmt.Fprintf(w, "ITEM %s %d %d %d\r\n", it.Key, it.Flags, it.Exp, len(it.Value)); err != nil {
+			return err
+		}
+		if _, err := w.Write(it.Value); err != nil {
+			return err
+		}
+		n++
+		_, err := w.Write(crlf)
+		return err
+	})
+	if err != nil {
+		return
+	}
+	_, err = w.Write(resultEnd)
+	return
+}
+
+// RestoreFrom reads a stream produced by the backup command
+// and stores every item in db. It returns the number of restored items.
+func RestoreFrom(r io.Reader, db McEngine) (n int, err error) {
+	return restore(r, db, restoreOptions{})
+}
+
+type restoreOptions struct {
+	age        int32                  // seconds since the dump, subtracted from lifetimes
+	skipErrors bool                   // skip items the engine fails to store
+	progress   func(n int, err error) // called for every item read
+}
+
+// restore stores the items of a backup stream in db. Items that
+// expired during age are skipped and not counted.
+func restore(r io.Reader, db McEngine, o restoreOptions) (n int, err error) {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	for {
+		line, err := br.ReadSlice('\n')
+		if err != nil {
+			if err == io.EOF {
+				err = ErrBadBackup
+			}
+			return n, err
+		}
+		if bytes.Equal(line, resultEnd) {
+			return n, nil
+		}
+		var it Item
+		var key string
+		var size int
+		if _, err = fmt.Sscanf(string(line), "ITEM %s %d %d %d\r\n", &key, &it.Flags, &it.Exp, &size); err != nil || size < 0 {
+			return n, ErrBadBackup
+		}
+		b := make([]byte, size+2)
+		if _, err = io.ReadFull(br, b); err != nil {
+			return n, err
+		}
+		if !bytes.HasSuffix(b, crlf) {
+			return n, ErrBadBackup
+		}
+		if it.Exp > 0 && o.age > 0 {
+			if it.Exp <= o.age {
+				continue
+			}
+			it.Exp -= o.age
+		}
+		_, err = db.Set([]byte(key), b[:size], it.Flags, it.Exp, size, true, nil)
+		if err == nil {
+			n++
+		}
+		if o.progress != nil {
+			o.progress(n, err)
+		}
+		if err != nil && !o.skipErrors {
+			return n, err
+		}
+	}
+}
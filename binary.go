@@ -0,0 +1,338 @@
+package mcproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// protoVerb switches the protocol of a connection: proto <text|meta|binary>
+var protoVerb = []byte("proto ")
+
+// switchProtocol serves the proto command. The OK is the last text response,
+// after it the client speaks the new protocol. Meta commands share the
+// framing of text ones, the switch only tells handlers, see ConnProtocol.
+func (mc *conn) switchProtocol(line []byte) error {
+	args := bytes.Fields(line)
+	if len(args) != 2 || !bytes.HasSuffix(line, crlf) {
+		return clientError(mc.rw, "usage: proto <text|meta|binary>")
+	}
+	p := ProtocolText
+	for ; int(p) < len(protocolNames); p++ {
+		if protocolNames[p] == string(args[1]) {
+			break
+		}
+	}
+	if int(p) == len(protocolNames) {
+		return clientError(mc.rw, "unsupported protocol")
+	}
+	if _, err := mc.rw.Write(resultOK); err != nil {
+		return err
+	}
+	mc.rw.Flush()
+	atomic.StoreInt32(&mc.meta.protocol, int32(p))
+	return nil
+}
+
+// The binary protocol of memcached. Requests are translated to text command
+// lines and served by the connection handler, so every Handler speaks it.
+// Supported: get, getk, set, add, replace, append, prepend, delete, incr,
+// decr, quit, noop, version and their quiet variants.
+const binHeaderLen = 24
+
+const (
+	binRequest  = 0x80
+	binResponse = 0x81
+)
+
+const (
+	opGet      = 0x00
+	opSet      = 0x01
+	opAdd      = 0x02
+	opReplace  = 0x03
+	opDelete   = 0x04
+	opIncr     = 0x05
+	opDecr     = 0x06
+	opQuit     = 0x07
+	opGetQ     = 0x09
+	opNoop     = 0x0a
+	opVersion  = 0x0b
+	opGetK     = 0x0c
+	opGetKQ    = 0x0d
+	opAppend   = 0x0e
+	opPrepend  = 0x0f
+	opSetQ     = 0x11
+	opAddQ     = 0x12
+	opReplaceQ = 0x13
+	opDeleteQ  = 0x14
+	opIncrQ    = 0x15
+	opDecrQ    = 0x16
+	opQuitQ    = 0x17
+	opAppendQ  = 0x19
+	opPrependQ = 0x1a
+)
+
+const (
+	statusOK        = 0x00
+	statusNotFound  = 0x01
+	statusExists    = 0x02
+	statusTooLarge  = 0x03
+	statusInvalid   = 0x04
+	statusNotStored = 0x05
+	statusUnknown   = 0x81
+	statusInternal  = 0x84
+	statusBusy      = 0x85
+)
+
+// binQuiet maps quiet opcodes to their loud ones
+var binQuiet = map[byte]byte{opGetQ: opGet, opGetKQ: opGetK, opSetQ: opSet, opAddQ: opAdd, opReplaceQ: opReplace,
+	opDeleteQ: opDelete, opIncrQ: opIncr, opDecrQ: opDecr, opQuitQ: opQuit, opAppendQ: opAppend, opPrependQ: opPrepend}
+
+// binStorage are the text verbs of binary storage opcodes
+var binStorage = map[byte]string{opSet: "set ", opAdd: "add ", opReplace: "replace ", opAppend: "append ", opPrepend: "prepend "}
+
+// errBadMagic closes connections sending garbage in binary mode
+var errBadMagic = errors.New("mcproto: bad binary request magic")
+
+// errTooLarge closes connections sending a value over the maxitem param,
+// the value isn't read
+var errTooLarge = errors.New("mcproto: request value too large")
+
+type binPacket struct {
+	opcode byte
+	status uint16
+	opaque uint32
+	cas    uint64
+	extras []byte
+	key    []byte
+	value  []byte
+}
+
+// readBinary reads a binary request, with the deadlines of readLine
+func (mc *conn) readBinary() (p binPacket, err error) {
+	if err = mc.awaitCommand(); err != nil {
+		return
+	}
+	mc.c.SetReadDeadline(time.Now().Add(mc.cfg.lineDeadline))
+	var h [binHeaderLen]byte
+	if _, err = io.ReadFull(mc.rw, h[:]); err != nil {
+		return
+	}
+	if h[0] != binRequest {
+		return p, errBadMagic
+	}
+	keyLen, extLen := int(binary.BigEndian.Uint16(h[2:])), int(h[4])
+	bodyLen := int(binary.BigEndian.Uint32(h[8:]))
+	if bodyLen < 0 || keyLen+extLen > bodyLen {
+		return p, errBadMagic
+	}
+	p.opcode = h[1]
+	p.opaque = binary.BigEndian.Uint32(h[12:])
+	p.cas = binary.BigEndian.Uint64(h[16:])
+	if bodyLen-keyLen-extLen > mc.cfg.maxItem {
+		mc.writeBinary(binPacket{opcode: p.opcode, opaque: p.opaque, status: statusTooLarge})
+		mc.rw.Flush()
+		return p, errTooLarge
+	}
+	mc.setState(StateReadPayload)
+	mc.c.SetReadDeadline(time.Now().Add(mc.cfg.bodyTimeout(bodyLen)))
+	body := make([]byte, bodyLen)
+	if _, err = io.ReadFull(mc.rw, body); err != nil {
+		return
+	}
+	mc.reqBytes = uint64(binHeaderLen + bodyLen)
+	p.extras, p.key, p.value = body[:extLen], body[extLen:extLen+keyLen], body[extLen+keyLen:]
+	return
+}
+
+// serveBinary reads and runs a binary protocol request
+func (mc *conn) serveBinary() error {
+	req, err := mc.readBinary()
+	if err != nil {
+		return err
+	}
+	return mc.served(func() error { return mc.handleBinary(req) })
+}
+
+func (mc *conn) handleBinary(req binPacket) error {
+	mc.setState(StateExecute)
+	op, quiet := req.opcode, false
+	if loud, ok := binQuiet[op]; ok {
+		op, quiet = loud, true
+	}
+	res := binPacket{opcode: req.opcode, opaque: req.opaque}
+	var line, data []byte
+	switch op {
+	case opNoop:
+		return mc.writeBinary(res)
+	case opVersion:
+		res.value = []byte(mc.cfg.version)
+		return mc.writeBinary(res)
+	case opQuit:
+		if !quiet {
+			mc.writeBinary(res)
+		}
+		return errClose
+	case opGet, opGetK:
+		line = []byte("get " + string(req.key) + "\r\n")
+	case opSet, opAdd, opReplace:
+		if len(req.extras) != 8 || (req.cas != 0 && op != opSet) {
+			return mc.binaryError(res, statusInvalid, strings.TrimSpace(binStorage[op])+" needs flags and exptime, CAS only with set")
+		}
+		flags, exp := binary.BigEndian.Uint32(req.extras), int32(binary.BigEndian.Uint32(req.extras[4:]))
+		verb, casArg := binStorage[op], ""
+		if req.cas != 0 {
+			// a set with a CAS is a cas command
+			verb, casArg = "cas ", " "+strconv.FormatUint(req.cas, 10)
+		}
+		line = []byte(verb + string(req.key) + " " + strconv.FormatUint(uint64(flags), 10) + " " +
+			strconv.FormatInt(int64(exp), 10) + " " + strconv.Itoa(len(req.value)) + casArg + "\r\n")
+		data = req.value
+	case opAppend, opPrepend:
+		if len(req.extras) != 0 || req.cas != 0 {
+			return mc.binaryError(res, statusInvalid, strings.TrimSpace(binStorage[op])+" takes no extras, CAS is not supported")
+		}
+		line = []byte(binStorage[op] + string(req.key) + " 0 0 " + strconv.Itoa(len(req.value)) + "\r\n")
+		data = req.value
+	case opDelete:
+		line = []byte("delete " + string(req.key) + "\r\n")
+	case opIncr, opDecr:
+		if len(req.extras) != 20 {
+			return mc.binaryError(res, statusInvalid, "incr and decr need delta, initial and exptime")
+		}
+		verb := "incr "
+		if op == opDecr {
+			verb = "decr "
+		}
+		delta := binary.BigEndian.Uint64(req.extras)
+		line = []byte(verb + string(req.key) + " " + strconv.FormatUint(delta, 10) + "\r\n")
+	default:
+		return mc.binaryError(res, statusUnknown, "unknown command")
+	}
+	if len(req.key) == 0 || strictKey(req.key) != "" {
+		return mc.binaryError(res, statusInvalid, "bad key")
+	}
+
+	resp, err := mc.capture(func() error { return mc.dispatch(line, data) })
+	res.status, res.extras, res.value = textToBinary(op, resp)
+	// like memcached, a failed add finds the key and a failed replace misses it
+	if res.status == statusNotStored && op == opAdd {
+		res.status, res.value = statusExists, []byte("Data exists for key")
+	} else if res.status == statusNotStored && op == opReplace {
+		res.status, res.value = statusNotFound, []byte("Not found")
+	}
+	if op == opGetK && res.status == statusOK {
+		res.key = req.key
+	}
+	// quiet requests are answered only on failures, quiet gets only on hits
+	silent := false
+	if quiet && (op == opGet || op == opGetK) {
+		silent = res.status == statusNotFound
+	} else if quiet {
+		silent = res.status == statusOK
+	}
+	if !silent {
+		if werr := mc.writeBinary(res); err == nil {
+			err = werr
+		}
+	}
+	return err
+}
+
+// textToBinary translates the text response of a command to a binary status,
+// extras and value
+func textToBinary(op byte, resp []byte) (status uint16, extras, value []byte) {
+	line := resp
+	if i := bytes.IndexByte(resp, '\n'); i >= 0 {
+		line = resp[:i+1]
+	}
+	word := string(bytes.TrimRight(line, "\r\n"))
+	switch {
+	case bytes.HasPrefix(line, []byte("VALUE ")):
+		f := bytes.Fields(line)
+		if len(f) < 4 {
+			return statusInternal, nil, []byte("bad response")
+		}
+		flags, _ := strconv.ParseUint(string(f[2]), 10, 32)
+		size, _ := strconv.Atoi(string(f[3]))
+		body := resp[len(line):]
+		if size > len(body) {
+			return statusInternal, nil, []byte("bad response")
+		}
+		extras = make([]byte, 4)
+		binary.BigEndian.PutUint32(extras, uint32(flags))
+		return statusOK, extras, body[:size]
+	case bytes.Equal(line, resultEnd), bytes.Equal(line, resultNotFound):
+		return statusNotFound, nil, []byte("Not found")
+	case bytes.Equal(line, resultStored), bytes.Equal(line, resultDeleted):
+		return statusOK, nil, nil
+	case bytes.Equal(line, resultNotStored):
+		return statusNotStored, nil, []byte("Not stored")
+	case word == "EXISTS":
+		return statusExists, nil, []byte("Data exists for key")
+	case word == "ERROR":
+		return statusInvalid, nil, []byte("Invalid arguments")
+	case bytes.HasPrefix(line, resultClientErrorPrefix):
+		return statusInvalid, nil, []byte(word[len(resultClientErrorPrefix):])
+	case word == "SERVER_ERROR busy":
+		return statusBusy, nil, []byte("busy")
+	case bytes.HasPrefix(line, resultServerErrorPrefix):
+		return statusInternal, nil, []byte(word[len(resultServerErrorPrefix):])
+	}
+	if n, err := strconv.ParseUint(word, 10, 64); err == nil && (op == opIncr || op == opDecr) {
+		value = make([]byte, 8)
+		binary.BigEndian.PutUint64(value, n)
+		return statusOK, nil, value
+	}
+	if len(resp) == 0 {
+		// noreply responses of handlers
+		return statusOK, nil, nil
+	}
+	return statusInternal, nil, []byte("unexpected response")
+}
+
+func (mc *conn) binaryError(res binPacket, status uint16, msg string) error {
+	res.status, res.value = status, []byte(msg)
+	return mc.writeBinary(res)
+}
+
+// writeBinary writes a response packet, flushed like text responses
+func (mc *conn) writeBinary(p binPacket) error {
+	var h [binHeaderLen]byte
+	h[0] = binResponse
+	h[1] = p.opcode
+	binary.BigEndian.PutUint16(h[2:], uint16(len(p.key)))
+	h[4] = byte(len(p.extras))
+	binary.BigEndian.PutUint16(h[6:], p.status)
+	binary.BigEndian.PutUint32(h[8:], uint32(len(p.extras)+len(p.key)+len(p.value)))
+	binary.BigEndian.PutUint32(h[12:], p.opaque)
+	binary.BigEndian.PutUint64(h[16:], p.cas)
+	mc.rw.Write(h[:])
+	mc.rw.Write(p.extras)
+	mc.rw.Write(p.key)
+	if _, err := mc.rw.Write(p.value); err != nil {
+		return err
+	}
+	return mc.flush()
+}
+
+// capture runs fn with the responses it writes diverted to the returned bytes
+func (mc *conn) capture(fn func() error) ([]byte, error) {
+	var resp bytes.Buffer
+	out := mc.rw.Writer
+	mc.rw.Writer = bufio.NewWriter(&resp)
+	mc.capturing++
+	defer func() {
+		mc.rw.Writer = out
+		mc.capturing--
+	}()
+	err := fn()
+	mc.rw.Writer.Flush()
+	return resp.Bytes(), err
+}
@@ -0,0 +1,146 @@
+package mcproto
+
+import (
+	"bufio"
+	"hash/fnv"
+	"sync/atomic"
+)
+
+// CanaryEngine routes a percentage of keys to New engine and the rest to Old.
+// The route of a key is chosen by its hash, so a key always hits the same
+// engine until the percentage changes.
+// Optional interfaces of the wrapped engines are not exposed.
+type CanaryEngine struct {
+	percent int32
+
+	Old McEngine
+	New McEngine
+
+	oldStats routeCounters
+	newStats routeCounters
+}
+
+// RouteStats are per-route counters of CanaryEngine
+type RouteStats struct {
+	Hits   uint64
+	Misses uint64
+	Errors uint64
+}
+
+type routeCounters struct {
+	hits   counter
+	misses counter
+	errors counter
+}
+
+// NewCanaryEngine returns engine sending percent of keys to new
+func NewCanaryEngine(old, new McEngine, percent int) *CanaryEngine {
+	c := &CanaryEngine{Old: old, New: new}
+	c.SetPercent(percent)
+	return c
+}
+
+// SetPercent changes the share of keys routed to New, clamped to 0..100
+func (c *CanaryEngine) SetPercent(percent int) {
+	if percent < 0 {
+		percent = 0
+	}
+	if percent > 100 {
+		percent = 100
+	}
+	atomic.StoreInt32(&c.percent, int32(percent))
+}
+
+// Stats returns counters of Old and New routes
+func (c *CanaryEngine) Stats() (old, new RouteStats) {
+	return c.oldStats.load(), c.newStats.load()
+}
+
+func (rc *routeCounters) load() RouteStats {
+	return RouteStats{
+		Hits:   rc.hits.load(),
+		Misses: rc.misses.load(),
+		Errors: rc.errors.load(),
+	}
+}
+
+// count accounts a key, ErrCacheMiss is a miss like not found
+func (rc *routeCounters) count(found bool, err error) {
+	switch {
+	case err == ErrCacheMiss:
+		rc.misses.inc()
+	case err != nil:
+		rc.errors.inc()
+	case found:
+		rc.hits.inc()
+	default:
+		rc.misses.inc()
+	}
+}
+
+func (c *CanaryEngine) route(key []byte) (McEngine, *routeCounters) {
+	h := fnv.New32a()
+	h.Write(key)
+	if int32(h.Sum32()%100) < atomic.LoadInt32(&c.percent) {
+		return c.New, &c.newStats
+	}
+	return c.Old, &c.oldStats
+}
+
+// Get reads key from its route.
+// Values of a ValueReleaser engine are copied and released.
+func (c *CanaryEngine) Get(key []byte, rw *bufio.ReadWriter) (value []byte, noreply bool, err error) {
+	e, rc := c.route(key)
+	value, noreply, err = e.Get(key, rw)
+	rc.count(value != nil, err)
+	return detach(e, value), noreply, err
+}
+
+// Gets serves every key from its route
+func (c *CanaryEngine) Gets(keys [][]byte, rw *bufio.ReadWriter) (keysvals [][]byte, err error) {
+	return getsByGet(c.Get, keys, rw)
+}
+
+// Set stores key in its route
+func (c *CanaryEngine) Set(key, value []byte, flags uint32, exp int32, size int, noreply bool, rw *bufio.ReadWriter) (noreplyresp bool, err error) {
+	e, rc := c.route(key)
+	noreplyresp, err = e.Set(key, value, flags, exp, size, noreply, rw)
+	if err != nil {
+		rc.count(false, err)
+	}
+	return
+}
+
+// Incr increments key in its route
+func (c *CanaryEngine) Incr(key []byte, value uint64, rw *bufio.ReadWriter) (result uint64, isFound bool, noreply bool, err error) {
+	e, rc := c.route(key)
+	result, isFound, noreply, err = e.Incr(key, value, rw)
+	rc.count(isFound, err)
+	return
+}
+
+// Decr decrements key in its route
+func (c *CanaryEngine) Decr(key []byte, value uint64, rw *bufio.ReadWriter) (result uint64, isFound bool, noreply bool, err error) {
+	e, rc := c.route(key)
+	result, isFound, noreply, err = e.Decr(key, value, rw)
+	rc.count(isFound, err)
+	return
+}
+
+// Delete removes key from its route
+func (c *CanaryEngine) Delete(key []byte, rw *bufio.ReadWriter) (isFound bool, noreply bool, err error) {
+	e, rc := c.route(key)
+	isFound, noreply, err = e.Delete(key, rw)
+	rc.count(isFound, err)
+	return
+}
+
+// Close closes both engines
+func (c *CanaryEngine) Close() error {
+	errNew := c.New.Close()
+	errOld := c.Old.Close()
+	if errNew != nil {
+		return errNew
+	}
+	return errOld
+}
@@ -0,0 +1,80 @@
+package mcproto
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// Chaos is a fault injection profile, probabilities are from 0 to 1
+type Chaos struct {
+	DelayProb float64       // chance of sleeping before the command
+	MaxDelay  time.Duration // the sleep is uniform in 0..MaxDelay
+	ErrorProb float64       // chance of SERVER_ERROR instead of running the command
+	DropProb  float64       // chance of closing the connection without a response
+}
+
+// ChaosHandler injects delays, errors and dropped connections into
+// the commands served by Next, so applications can test their cache
+// failure handling against a staging server. Faults are drawn
+// independently for every command: drop first, then error, then delay.
+type ChaosHandler struct {
+	Next Handler
+
+	chaos atomic.Value // Chaos
+
+	delays uint64
+	errors uint64
+	drops  uint64
+}
+
+// ChaosStats counts injected faults
+type ChaosStats struct {
+	Delays uint64
+	Errors uint64
+	Drops  uint64
+}
+
+// NewChaosHandler returns a handler injecting faults of c into next
+func NewChaosHandler(next Handler, c Chaos) *ChaosHandler {
+	h := &ChaosHandler{Next: next}
+	h.SetChaos(c)
+	return h
+}
+
+// SetChaos replaces the fault profile, Chaos{} turns injection off
+func (h *ChaosHandler) SetChaos(c Chaos) {
+	h.chaos.Store(c)
+}
+
+// Stats returns counters of injected faults
+func (h *ChaosHandler) Stats() ChaosStats {
+	return ChaosStats{
+		Delays: atomic.LoadUint64(&h.delays),
+		Errors: atomic.LoadUint64(&h.errors),
+		Drops:  atomic.LoadUint64(&h.drops),
+	}
+}
+
+func (h *ChaosHandler) ServeMC(w ResponseWriter, r *Request) {
+	c := h.chaos.Load().(Chaos)
+	switch {
+	case chance(c.DropProb):
+		atomic.AddUint64(&h.drops, 1)
+		w.Close()
+		return
+	case chance(c.ErrorProb):
+		atomic.AddUint64(&h.errors, 1)
+		serverError(w.ReadWriter(), "injected fault")
+		return
+	}
+	if c.MaxDelay > 0 && chance(c.DelayProb) {
+		atomic.AddUint64(&h.delays, 1)
+		time.Sleep(time.Duration(rand.Int63n(int64(c.MaxDelay) + 1)))
+	}
+	h.Next.ServeMC(w, r)
+}
+
+func chance(p float64) bool {
+	return p > 0 && rand.Float64() < p
+}
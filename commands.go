@@ -0,0 +1,190 @@
+package mcproto
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Command is a canonical protocol command
+type Command int
+
+// Commands
+const (
+	CmdUnknown Command = iota
+	CmdGet
+	CmdGets
+	CmdSet
+	CmdDelete
+	CmdIncr
+	CmdDecr
+	CmdClose
+	CmdScan
+	CmdTTL
+	CmdBackup
+	CmdDigest
+	CmdMetaGet
+	CmdSetRange
+	CmdSetBit
+	CmdLPush
+	CmdRPush
+	CmdLPop
+	CmdRPop
+	CmdAdd
+	CmdReplace
+	CmdAppend
+	CmdPrepend
+	CmdCAS
+	CmdMetaDebug
+	CmdTouch
+	CmdGat
+	CmdGats
+	CmdFlushAll
+	CmdStats
+	CmdVersion
+	CmdVerbosity
+	CmdCustom // registered with RegisterCommand
+)
+
+var commandNames = [...]string{
+	"unknown", "get", "gets", "set", "delete", "incr", "decr", "close", "scan", "ttl", "backup",
+	"digest", "mg", "setrange", "setbit", "lpush", "rpush", "lpop", "rpop", "add",
+	"replace", "append", "prepend", "cas", "me", "touch", "gat", "gats", "flush_all", "stats", "version", "verbosity", "custom",
+}
+
+func (cmd Command) String() string {
+	if cmd < 0 || int(cmd) >= len(commandNames) {
+		return fmt.Sprintf("command(%d)", int(cmd))
+	}
+	return commandNames[cmd]
+}
+
+// CommandFunc handles the command line of a registered command,
+// including reading its data block if any, and writes the response to rw.
+// A returned error closes the connection.
+type CommandFunc func(line []byte, db McEngine, rw *bufio.ReadWriter) error
+
+type commandEntry struct {
+	cmd  Command
+	fn   func(h *engineHandler, w ResponseWriter, r *Request) error
+	data int // position of the <bytes> argument of commands with a data block, 0 if none
+}
+
+var (
+	commandsMu sync.RWMutex
+	commands   = make(map[string]commandEntry) // verb -> entry
+)
+
+func init() {
+	builtin := map[Command]func(h *engineHandler, w ResponseWriter, r *Request) error{
+		CmdGet:       (*engineHandler).get,
+		CmdGets:      (*engineHandler).get,
+		CmdSet:       (*engineHandler).set,
+		CmdDelete:    (*engineHandler).delete,
+		CmdIncr:      func(h *engineHandler, w ResponseWriter, r *Request) error { return h.incrDecr(w, r, true) },
+		CmdDecr:      func(h *engineHandler, w ResponseWriter, r *Request) error { return h.incrDecr(w, r, false) },
+		CmdClose:     func(h *engineHandler, w ResponseWriter, r *Request) error { return errClose },
+		CmdScan:      engineCommand(scan),
+		CmdTTL:       engineCommand(ttl),
+		CmdBackup:    engineCommand(backup),
+		CmdDigest:    engineCommand(digest),
+		CmdMetaGet:   (*engineHandler).metaGet,
+		CmdSetRange:  (*engineHandler).setRange,
+		CmdSetBit:    (*engineHandler).setBit,
+		CmdLPush:     func(h *engineHandler, w ResponseWriter, r *Request) error { return h.push(w, r, true) },
+		CmdRPush:     func(h *engineHandler, w ResponseWriter, r *Request) error { return h.push(w, r, false) },
+		CmdLPop:      func(h *engineHandler, w ResponseWriter, r *Request) error { return h.pop(w, r, true) },
+		CmdRPop:      func(h *engineHandler, w ResponseWriter, r *Request) error { return h.pop(w, r, false) },
+		CmdAdd:       func(h *engineHandler, w ResponseWriter, r *Request) error { return h.addReplace(w, r, true) },
+		CmdReplace:   func(h *engineHandler, w ResponseWriter, r *Request) error { return h.addReplace(w, r, false) },
+		CmdAppend:    func(h *engineHandler, w ResponseWriter, r *Request) error { return h.appendPrepend(w, r, true) },
+		CmdPrepend:   func(h *engineHandler, w ResponseWriter, r *Request) error { return h.appendPrepend(w, r, false) },
+		CmdCAS:       (*engineHandler).compareAndSwap,
+		CmdMetaDebug: (*engineHandler).metaDebug,
+		CmdTouch:     (*engineHandler).touch,
+		CmdGat:       (*engineHandler).getAndTouch,
+		CmdGats:      (*engineHandler).getAndTouch,
+		CmdFlushAll:  (*engineHandler).flushAll,
+		CmdStats:     (*engineHandler).stats,
+		CmdVersion:   (*engineHandler).version,
+		CmdVerbosity: (*engineHandler).setVerbosity,
+	}
+	// the conn reads these data blocks into Request.Data
+	data := map[Command]int{CmdSet: 4, CmdAdd: 4, CmdReplace: 4, CmdAppend: 4, CmdPrepend: 4, CmdCAS: 4, CmdSetRange: 3, CmdLPush: 2, CmdRPush: 2}
+	for cmd, fn := range builtin {
+		addCommand(cmd.String(), commandEntry{cmd: cmd, fn: fn, data: data[cmd]})
+	}
+}
+
+func engineCommand(fn CommandFunc) func(h *engineHandler, w ResponseWriter, r *Request) error {
+	return func(h *engineHandler, w ResponseWriter, r *Request) error {
+		return fn(r.Line, h.db, w.ReadWriter())
+	}
+}
+
+// addCommand registers the lower and upper case forms of verb
+func addCommand(verb string, e commandEntry) {
+	commandsMu.Lock()
+	defer commandsMu.Unlock()
+	commands[strings.ToLower(verb)] = e
+	commands[strings.ToUpper(verb)] = e
+}
+
+// RegisterCommand adds a command handled by fn, so embedders can extend
+// the protocol. It panics if verb is empty, contains whitespace
+// or is already registered.
+func RegisterCommand(verb string, fn CommandFunc) {
+	if verb == "" || strings.ContainsAny(verb, " \t\r\n") {
+		panic("mcproto: invalid command verb " + verb)
+	}
+	commandsMu.RLock()
+	_, dup := commands[strings.ToLower(verb)]
+	commandsMu.RUnlock()
+	if dup {
+		panic("mcproto: command registered twice " + verb)
+	}
+	addCommand(verb, commandEntry{cmd: CmdCustom, fn: engineCommand(fn)})
+}
+
+// unknownHandler serves unregistered verbs, see HandleUnknown
+var unknownHandler atomic.Value // handlerBox
+
+type handlerBox struct{ h Handler }
+
+// HandleUnknown sets the handler of commands with unregistered verbs,
+// to log, count or serve them. Without it they get ERROR, and with the
+// unknown=close param the connection is closed after it. nil restores the default.
+func HandleUnknown(h Handler) {
+	unknownHandler.Store(handlerBox{h})
+}
+
+// lookupCommand tokenizes the verb of line and finds its handler.
+// Verbs are matched as whole words in lower or upper case.
+func lookupCommand(line []byte) (e commandEntry, ok bool) {
+	commandsMu.RLock()
+	e, ok = commands[string(commandVerb(line))]
+	commandsMu.RUnlock()
+	return
+}
+
+// ParseCommand returns the canonical command of a verb
+func ParseCommand(verb []byte) Command {
+	e, _ := lookupCommand(verb)
+	return e.cmd
+}
+
+// isUpper reports whether line starts with an upper case verb
+func isUpper(line []byte) bool {
+	return len(line) > 0 && 'A' <= line[0] && line[0] <= 'Z'
+}
+
+// commandVerb returns the first word of a command line
+func commandVerb(line []byte) []byte {
+	if i := bytes.IndexAny(line, " \r\n"); i >= 0 {
+		return line[:i]
+	}
+	return line
+}
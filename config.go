@@ -0,0 +1,391 @@
+package mcproto
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// config holds connection settings parsed from ParseMc params, like:
+// deadline=1000&buf=4096&slide=1800:sess:
+type config struct {
+	deadline      time.Duration // idle timeout per command
+	writeDeadline time.Duration // timeout of every write to the client
+	lineDeadline  time.Duration // time to receive a command line after its first byte
+	maxLine       int           // max length of a command line
+	bodyDeadline  time.Duration // base timeout of reading a data block
+	bodyRate      int           // minimal client upload rate, bytes/sec
+	buf           int           // read/write buffer size
+	flushDelay    time.Duration // how long small responses may wait to share a write
+	maxKeys       int           // max keys of a multi-get, 0 is unlimited
+	maxItem       int           // max size of a data block or binary value
+	intern        int           // size of the key interning table, 0 is off
+
+	slides []slide // touch-on-read rules
+
+	minExp  int32 // shorter lifetimes are raised to minExp
+	maxExp  int32 // longer lifetimes, including never expiring, are clamped to maxExp
+	normExp bool  // absolute unix exptimes are passed to the engine as relative
+
+	nilEmpty bool // a nil value from Get is an empty value, misses are ErrCacheMiss
+
+	unknownClose bool // close the connection after an unknown command
+
+	strict bool // reject command lines breaking protocol.txt, see strictCheck
+
+	allowed map[string]bool // verbs served, nil serves all
+
+	version string // answered to version
+}
+
+// defaultMaxItem is the max item size unless the maxitem param is set, like memcached
+const defaultMaxItem = 1 << 20
+
+// defaultVersion is answered to version unless the version param is set
+const defaultVersion = "mcproto"
+
+// slide is a sliding expiration rule: a successful get of a key
+// with prefix touches the item with exp, so it lives exp seconds after the last read.
+// Params: slide=<exp> for all keys or slide=<exp>:<prefix>, may be repeated.
+type slide struct {
+	prefix []byte
+	exp    int32
+}
+
+func parseParams(params string) (cfg *config, err error) {
+	p, err := url.ParseQuery(params)
+	if err != nil {
+		return
+	}
+	if err = validate(p); err != nil {
+		return nil, err
+	}
+	cfg = &config{}
+	//params
+	deadline := "1000"
+	if len(p["deadline"]) > 0 {
+		deadline = p["deadline"][0]
+	}
+	deadlineMs, err := strconv.Atoi(deadline)
+	if err != nil {
+		deadlineMs = 1000
+	}
+	cfg.deadline = time.Duration(deadlineMs) * time.Millisecond
+	cfg.writeDeadline = cfg.deadline
+	if wdl := atoiParam(p, "wdeadline"); wdl > 0 {
+		cfg.writeDeadline = time.Duration(wdl) * time.Millisecond
+	}
+
+	cfg.lineDeadline = cfg.deadline
+	if ldl := atoiParam(p, "linedeadline"); ldl > 0 {
+		cfg.lineDeadline = time.Duration(ldl) * time.Millisecond
+	}
+
+	cfg.bodyDeadline = 200 * time.Millisecond
+	if bdl := atoiParam(p, "bodydeadline"); bdl > 0 {
+		cfg.bodyDeadline = time.Duration(bdl) * time.Millisecond
+	}
+	cfg.bodyRate = 256 * 1024
+	if rate := atoiParam(p, "bodyrate"); rate > 0 {
+		cfg.bodyRate = rate
+	}
+
+	buf := "4096"
+	if len(p["buf"]) > 0 {
+		buf = p["buf"][0]
+	}
+	cfg.buf, err = strconv.Atoi(buf)
+	if err != nil {
+		cfg.buf = 4096
+	}
+	err = nil
+	cfg.maxLine = cfg.buf
+	if ml := atoiParam(p, "maxline"); ml > 0 {
+		cfg.maxLine = ml
+	}
+
+	cfg.flushDelay = time.Duration(atoiParam(p, "flushdelay")) * time.Microsecond
+	cfg.maxKeys = atoiParam(p, "maxkeys")
+	cfg.maxItem = defaultMaxItem
+	if mi := atoiParam(p, "maxitem"); mi > 0 {
+		cfg.maxItem = mi
+	}
+	cfg.intern = atoiParam(p, "intern")
+
+	cfg.minExp = int32(atoiParam(p, "minexp"))
+	cfg.maxExp = int32(atoiParam(p, "maxexp"))
+	cfg.normExp, _ = strconv.ParseBool(p.Get("normexp"))
+	cfg.nilEmpty = p.Get("nilvalue") == "empty"
+	cfg.unknownClose = p.Get("unknown") == "close"
+	cfg.strict, _ = strconv.ParseBool(p.Get("strict"))
+	cfg.version = defaultVersion
+	if v := p.Get("version"); v != "" {
+		cfg.version = v
+	}
+
+	if allow := p.Get("allow"); allow != "" {
+		cfg.allowed = make(map[string]bool)
+		for _, verb := range strings.Split(allow, ",") {
+			cfg.allowed[verb] = true
+		}
+	}
+
+	for _, v := range p["slide"] {
+		exp, prefix := v, ""
+		if i := strings.IndexByte(v, ':'); i >= 0 {
+			exp, prefix = v[:i], v[i+1:]
+		}
+		sec, e := strconv.Atoi(exp)
+		if e != nil || sec <= 0 {
+			continue
+		}
+		cfg.slides = append(cfg.slides, slide{prefix: []byte(prefix), exp: int32(sec)})
+	}
+	return
+}
+
+// parsedParams caches the config of params strings by string, so ServeConn
+// and ParseMc parse and validate the params of their connections once
+var parsedParams sync.Map // string -> parsedConfig
+
+type parsedConfig struct {
+	cfg *config
+	err error
+}
+
+// cachedParams returns the config of params, parsed on first use
+func cachedParams(params string) (*config, error) {
+	if v, ok := parsedParams.Load(params); ok {
+		p := v.(parsedConfig)
+		return p.cfg, p.err
+	}
+	cfg, err := parseParams(params)
+	parsedParams.Store(params, parsedConfig{cfg, err})
+	return cfg, err
+}
+
+// ParamsError lists every invalid or conflicting param of a params string
+type ParamsError struct {
+	Problems []string
+}
+
+func (e *ParamsError) Error() string {
+	return "mcproto: bad params: " + strings.Join(e.Problems, "; ")
+}
+
+// ValidateParams checks params before connections are served, the error
+// is a *ParamsError reporting all problems at once. ServeConn, ParseMc
+// and EngineHandler refuse invalid params instead of using defaults.
+func ValidateParams(params string) error {
+	p, err := url.ParseQuery(params)
+	if err != nil {
+		return &ParamsError{Problems: []string{err.Error()}}
+	}
+	return validate(p)
+}
+
+// paramKinds are the values params take, by name
+var paramKinds = map[string]string{
+	"deadline":     "positive",
+	"wdeadline":    "positive",
+	"linedeadline": "positive",
+	"bodydeadline": "positive",
+	"bodyrate":     "positive",
+	"buf":          "positive",
+	"maxline":      "positive",
+	"flushdelay":   "count",
+	"maxkeys":      "count",
+	"maxitem":      "positive",
+	"intern":       "count",
+	"minexp":       "count",
+	"maxexp":       "count",
+	"normexp":      "bool",
+	"strict":       "bool",
+	"nilvalue":     "miss|empty",
+	"unknown":      "error|close",
+	"slide":        "slide",
+	"allow":        "verbs",
+	"version":      "word",
+}
+
+func validate(p url.Values) error {
+	var problems []string
+	bad := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	names := make([]string, 0, len(p))
+	for name := range p {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		kind, ok := paramKinds[name]
+		if !ok {
+			bad("unknown param %q", name)
+			continue
+		}
+		if len(p[name]) > 1 && kind != "slide" {
+			bad("%s is given %d times", name, len(p[name]))
+		}
+		for _, v := range p[name] {
+			switch kind {
+			case "positive", "count":
+				n, err := strconv.Atoi(v)
+				if err != nil {
+					bad("%s=%q is not an integer", name, v)
+				} else if n <= 0 && kind == "positive" {
+					bad("%s=%d must be positive", name, n)
+				} else if n < 0 {
+					bad("%s=%d must not be negative", name, n)
+				}
+			case "bool":
+				if _, err := strconv.ParseBool(v); err != nil {
+					bad("%s=%q is not true or false", name, v)
+				}
+			case "verbs":
+				for _, verb := range strings.Split(v, ",") {
+					if verb == "" || strings.ToLower(verb) != verb {
+						bad("%s=%q needs lower case verbs separated by commas, like allow=get,gets,set,delete", name, v)
+						break
+					}
+				}
+			case "word":
+				if v == "" || strings.IndexFunc(v, func(r rune) bool { return r <= ' ' || r == 0x7f }) >= 0 {
+					bad("%s=%q must be a word without spaces or control characters", name, v)
+				}
+			case "slide":
+				exp := v
+				if i := strings.IndexByte(v, ':'); i >= 0 {
+					exp = v[:i]
+				}
+				if sec, err := strconv.Atoi(exp); err != nil || sec <= 0 {
+					bad("slide=%q needs a positive number of seconds, like slide=60:sess:", v)
+				}
+			default:
+				if choices := strings.Split(kind, "|"); v != choices[0] && v != choices[1] {
+					bad("%s=%q must be %s", name, v, strings.Replace(kind, "|", " or ", 1))
+				}
+			}
+		}
+	}
+	if ml, err := strconv.Atoi(p.Get("maxline")); err == nil && ml > 0 && ml < minMaxLine {
+		bad("maxline=%d is below the minimal buffer of %d bytes", ml, minMaxLine)
+	}
+	minExp, err1 := strconv.Atoi(p.Get("minexp"))
+	maxExp, err2 := strconv.Atoi(p.Get("maxexp"))
+	if err1 == nil && err2 == nil && maxExp > 0 && minExp > maxExp {
+		bad("minexp=%d is longer than maxexp=%d", minExp, maxExp)
+	}
+	if len(problems) > 0 {
+		return &ParamsError{Problems: problems}
+	}
+	return nil
+}
+
+// minMaxLine is the smallest read buffer of bufio, shorter maxline would
+// silently allow longer lines
+const minMaxLine = 16
+
+// setting is a named config value as shown to operators
+type setting struct {
+	name, value string
+}
+
+// settings lists the effective config, with defaults applied
+func (cfg *config) settings() []setting {
+	ms := func(d time.Duration) string { return strconv.FormatInt(int64(d/time.Millisecond), 10) }
+	list := []setting{
+		{"deadline", ms(cfg.deadline)},
+		{"wdeadline", ms(cfg.writeDeadline)},
+		{"linedeadline", ms(cfg.lineDeadline)},
+		{"bodydeadline", ms(cfg.bodyDeadline)},
+		{"bodyrate", strconv.Itoa(cfg.bodyRate)},
+		{"buf", strconv.Itoa(cfg.buf)},
+		{"flushdelay", strconv.FormatInt(int64(cfg.flushDelay/time.Microsecond), 10)},
+		{"maxline", strconv.Itoa(cfg.maxLine)},
+		{"maxkeys", strconv.Itoa(cfg.maxKeys)},
+		{"maxitem", strconv.Itoa(cfg.maxItem)},
+		{"intern", strconv.Itoa(cfg.intern)},
+		{"minexp", strconv.Itoa(int(cfg.minExp))},
+		{"maxexp", strconv.Itoa(int(cfg.maxExp))},
+		{"normexp", strconv.FormatBool(cfg.normExp)},
+		{"nilvalue", "miss"},
+	}
+	if cfg.nilEmpty {
+		list[len(list)-1].value = "empty"
+	}
+	unknown := "error"
+	if cfg.unknownClose {
+		unknown = "close"
+	}
+	list = append(list, setting{"unknown", unknown}, setting{"strict", strconv.FormatBool(cfg.strict)}, setting{"version", cfg.version})
+	slides := make([]string, len(cfg.slides))
+	for i, s := range cfg.slides {
+		slides[i] = strconv.Itoa(int(s.exp)) + ":" + string(s.prefix)
+	}
+	list = append(list, setting{"slide", strings.Join(slides, ",")})
+	allowed := make([]string, 0, len(cfg.allowed))
+	for verb := range cfg.allowed {
+		allowed = append(allowed, verb)
+	}
+	sort.Strings(allowed)
+	return append(list, setting{"allow", strings.Join(allowed, ",")})
+}
+
+// allows reports whether the verb of line may be served, in any case,
+// commands outside the allow list get ERROR without reaching the handler
+func (cfg *config) allows(line []byte) bool {
+	if cfg.allowed == nil {
+		return true
+	}
+	verb := commandVerb(line)
+	if isUpper(line) {
+		verb = bytes.ToLower(verb)
+	}
+	return cfg.allowed[string(verb)]
+}
+
+// atoiParam returns a non-negative int param or 0
+func atoiParam(p url.Values, name string) int {
+	n, err := strconv.Atoi(p.Get(name))
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// bodyTimeout is the time allowed to read a data block of size bytes,
+// so a client stalling after the command line is dropped early
+func (cfg *config) bodyTimeout(size int) time.Duration {
+	return cfg.bodyDeadline + time.Duration(size)*time.Second/time.Duration(cfg.bodyRate)
+}
+
+// exp applies exptime normalization and clamping to a client exptime
+func (cfg *config) exp(exp int32) int32 {
+	if cfg.minExp == 0 && cfg.maxExp == 0 && !cfg.normExp {
+		return exp
+	}
+	return clampExp(exp, cfg.minExp, cfg.maxExp)
+}
+
+// hit reports whether a Get result is a stored value
+func (cfg *config) hit(value []byte, err error) bool {
+	return err == nil && (value != nil || cfg.nilEmpty)
+}
+
+// slideExp returns the sliding expiration for key, or 0 if key has none.
+// The longest matching prefix wins.
+func (cfg *config) slideExp(key []byte) (exp int32) {
+	best := -1
+	for _, s := range cfg.slides {
+		if len(s.prefix) > best && bytes.HasPrefix(key, s.prefix) {
+			best, exp = len(s.prefix), s.exp
+		}
+	}
+	return
+}
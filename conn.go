@@ -0,0 +1,501 @@
+package mcproto
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConnState is the state of a client connection
+type ConnState int32
+
+// Connection states
+const (
+	StateIdle          ConnState = iota // waiting for the next command
+	StateReadCommand                    // receiving a command line
+	StateReadPayload                    // receiving the data block of a storage command
+	StateExecute                        // running the command
+	StateWriteResponse                  // sending the response
+	StateClosed                         // the connection is closed
+)
+
+var connStateNames = [...]string{"idle", "read_command", "read_payload", "execute", "write_response", "closed"}
+
+func (s ConnState) String() string {
+	if s < 0 || int(s) >= len(connStateNames) {
+		return fmt.Sprintf("state(%d)", int(s))
+	}
+	return connStateNames[s]
+}
+
+// ConnInfo describes an open client connection
+type ConnInfo struct {
+	ID         uint64
+	RemoteAddr net.Addr
+	State      ConnState
+	Since      time.Time // when the connection entered State
+	Opened     time.Time
+}
+
+// errClose is returned by the close command to end the connection cleanly
+var errClose = errors.New("close")
+
+var (
+	lastConnID uint64
+	openConns  sync.Map // id -> *conn
+)
+
+// Conns returns open client connections ordered by ID
+func Conns() (list []ConnInfo) {
+	openConns.Range(func(_, v interface{}) bool {
+		list = append(list, v.(*conn).info())
+		return true
+	})
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return
+}
+
+// conn serves the memcache protocol on one client connection:
+// it reads a command line, reads the data block of storage commands,
+// executes the command and writes the response, then waits for the next one.
+type conn struct {
+	id        uint64
+	c         net.Conn
+	handler   Handler
+	cfg       *config
+	cw        *connWriter
+	rw        *bufio.ReadWriter
+	opened    time.Time
+	ctx       context.Context // carries meta
+	meta      *connMeta
+	pending   time.Time // when unflushed responses started waiting for flushdelay
+	capturing int       // nesting of capture, responses don't reach the connection
+
+	usage    connUsage
+	reqBytes uint64 // bytes of the current command line and data block
+
+	state    int32 // ConnState
+	since    int64 // unix nano of the last state change
+	draining int32 // 1 when the connection stops before its next command
+}
+
+func newConn(c net.Conn, h Handler, cfg *config) *conn {
+	cw := &connWriter{c: c, timeout: cfg.writeDeadline}
+	mc := &conn{
+		id:      atomic.AddUint64(&lastConnID, 1),
+		c:       c,
+		handler: h,
+		cfg:     cfg,
+		cw:      cw,
+		rw:      bufio.NewReadWriter(bufio.NewReaderSize(c, cfg.maxLine), bufio.NewWriterSize(cw, cfg.buf)),
+		opened:  time.Now(),
+	}
+	mc.meta = &connMeta{id: mc.id, addr: c.RemoteAddr(), c: c}
+	mc.ctx = withConnMeta(context.Background(), mc.meta)
+	mc.setState(StateIdle)
+	return mc
+}
+
+func (mc *conn) setState(s ConnState) {
+	atomic.StoreInt32(&mc.state, int32(s))
+	atomic.StoreInt64(&mc.since, time.Now().UnixNano())
+}
+
+func (mc *conn) info() ConnInfo {
+	return ConnInfo{
+		ID:         mc.id,
+		RemoteAddr: mc.c.RemoteAddr(),
+		State:      ConnState(atomic.LoadInt32(&mc.state)),
+		Since:      time.Unix(0, atomic.LoadInt64(&mc.since)),
+		Opened:     mc.opened,
+	}
+}
+
+// serve runs commands until the client disconnects or an error breaks the connection
+func (mc *conn) serve() {
+	openConns.Store(mc.id, mc)
+	if hasSubscribers() {
+		Publish(Event{Type: EventConnOpened, RemoteAddr: mc.c.RemoteAddr()})
+	}
+	var closeErr error
+	defer func() {
+		mc.rw.Flush()
+		mc.setState(StateClosed)
+		mc.c.Close()
+		openConns.Delete(mc.id)
+		mc.closeUsage()
+		releaseSessions(mc.meta)
+		if hasSubscribers() {
+			Publish(Event{Type: EventConnClosed, RemoteAddr: mc.c.RemoteAddr(), Err: closeErr})
+		}
+	}()
+	if banned(mc.ctx) {
+		closeErr = errBanned
+		return
+	}
+	if err := mc.negotiate(); err != nil {
+		connError(mc.c.RemoteAddr(), err)
+		closeErr = err
+		return
+	}
+	for {
+		var err error
+		if Protocol(atomic.LoadInt32(&mc.meta.protocol)) == ProtocolBinary {
+			err = mc.serveBinary()
+		} else {
+			err = mc.serveText()
+		}
+		if err != nil {
+			if err != io.EOF && err != errClose && err != errDrained {
+				connError(mc.c.RemoteAddr(), err)
+				closeErr = err
+			}
+			return
+		}
+	}
+}
+
+// serveText reads and runs a text protocol command
+func (mc *conn) serveText() error {
+	line, err := mc.readLine()
+	if err != nil || len(line) == 0 {
+		return err
+	}
+	mc.reqBytes = uint64(len(line))
+	return mc.served(func() error { return mc.handle(line) })
+}
+
+// served runs a command, meters it and closes the connection of banned clients
+func (mc *conn) served(run func() error) error {
+	out := mc.written()
+	err := run()
+	out = mc.written() - out
+	bytesRead.add(mc.reqBytes)
+	bytesWritten.add(out)
+	mc.meter(mc.reqBytes, out)
+	if err == nil && banned(mc.ctx) {
+		err = errBanned
+	}
+	return err
+}
+
+// written returns the response bytes written, including buffered ones
+func (mc *conn) written() uint64 {
+	return mc.cw.written + uint64(mc.rw.Writer.Buffered())
+}
+
+// readLine waits for the next command, then the whole line must arrive
+// within lineDeadline, so clients can't trickle bytes forever
+func (mc *conn) readLine() (line []byte, err error) {
+	if err = mc.awaitCommand(); err != nil {
+		return
+	}
+	mc.c.SetReadDeadline(time.Now().Add(mc.cfg.lineDeadline))
+	line, err = mc.rw.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		recordViolation(mc.ctx, ViolationLineLength)
+		clientError(mc.rw, "line too long")
+	}
+	return
+}
+
+// awaitCommand waits up to deadline for the first byte of the next command.
+// A draining connection returns errDrained instead, a command already
+// received is answered SERVER_ERROR shutting down. drain sees the idle
+// state set before the deadline, so it can't be missed.
+func (mc *conn) awaitCommand() (err error) {
+	if err = mc.flushPending(); err != nil {
+		return
+	}
+	mc.setState(StateIdle)
+	mc.c.SetReadDeadline(time.Now().Add(mc.cfg.deadline))
+	if mc.drained() {
+		if mc.rw.Reader.Buffered() > 0 {
+			serverError(mc.rw, "shutting down")
+		}
+		return errDrained
+	}
+	if _, err = mc.rw.Peek(1); err != nil {
+		if mc.drained() {
+			err = errDrained
+		}
+		return
+	}
+	mc.setState(StateReadCommand)
+	return
+}
+
+// handle runs one command, a returned error closes the connection
+func (mc *conn) handle(line []byte) (err error) {
+	if bytes.HasPrefix(line, protoVerb) {
+		if !mc.cfg.allows(line) {
+			return protocolError(mc.rw)
+		}
+		return mc.switchProtocol(line)
+	}
+	return mc.dispatch(line, nil)
+}
+
+// dispatch runs a command line, the data block of storage commands
+// is read from the connection unless data is given
+func (mc *conn) dispatch(line, data []byte) (err error) {
+	mc.setState(StateExecute)
+	idem := idempotency.Load().(*idemStore)
+	var token []byte
+	if idem != nil && bytes.HasPrefix(line, idemVerb) {
+		var msg string
+		if token, line, msg = splitIdem(line); msg != "" {
+			return clientError(mc.rw, msg)
+		}
+	}
+	inflight := defaultLanes.Load().(*lanes)
+	shedding := defaultShedder.Load().(*shedder)
+	e, _ := lookupCommand(line)
+	if shedding.reject(e, inflight) {
+		return serverError(mc.rw, "busy")
+	}
+	r := &Request{Line: line, RemoteAddr: mc.c.RemoteAddr(), ctx: mc.ctx}
+	r.Command = e.cmd
+	commandCounts[e.cmd].inc()
+	if logLevel() >= 2 {
+		log.Printf("mcproto: conn %d %s: %s", mc.id, r.RemoteAddr, commandVerb(line))
+	}
+	args := argsPool.Get().(*[][]byte)
+	r.Args = splitArgs((*args)[:0], line)
+	defer putArgs(args, r.Args)
+	if verb := string(commandVerb(line)); metaVerbs[verb] {
+		flags := r.Args
+		if verb != "mn" && len(flags) > 0 {
+			flags = flags[1:] // the key
+		}
+		if budget, ok := opaqueBudget(flags); ok {
+			ctx, cancel := context.WithTimeout(mc.ctx, budget)
+			defer cancel()
+			r.ctx = ctx
+		}
+	}
+	if (r.Command == CmdGet || r.Command == CmdGets) && mc.cfg.maxKeys > 0 && len(r.Args) > mc.cfg.maxKeys {
+		return clientError(mc.rw, "too many keys")
+	}
+	denied := !mc.cfg.allows(line)
+	if denied && e.data == 0 {
+		return protocolError(mc.rw)
+	}
+	var kind Violation
+	var violation string
+	if mc.cfg.strict {
+		kind, violation = strictCheck(line, r.Command, r.Args)
+	}
+	if violation != "" && e.data == 0 {
+		recordViolation(mc.ctx, kind)
+		return clientError(mc.rw, violation)
+	}
+	if e.data > 0 {
+		if data != nil {
+			r.Data = data
+		} else {
+			var ok bool
+			if ok, err = mc.readData(r, e.data); !ok {
+				return
+			}
+		}
+		// answered after the data block, so it isn't read as commands
+		if denied {
+			return protocolError(mc.rw)
+		}
+		if violation != "" {
+			recordViolation(mc.ctx, kind)
+			return clientError(mc.rw, violation)
+		}
+		if shedding.rejectStorage() {
+			return serverError(mc.rw, "busy")
+		}
+	}
+	release := inflight.acquire(e.cmd)
+	atomic.AddInt64(&engineCalls, 1)
+	out := mc.written()
+	var allocs allocMeter
+	if hasSubscribers() {
+		allocs = startAllocs()
+	}
+	started := time.Now()
+	w := &response{mc: mc}
+	serve := func() { mc.handler.ServeMC(w, r) }
+	if token != nil {
+		handle := serve
+		serve = func() { mc.serveIdem(idem, token, handle) }
+	}
+	if s := sampling.Load().(*sampler); s != nil && s.take() {
+		handle := serve
+		serve = func() { mc.serveSampled(s, r, handle) }
+	}
+	serve()
+	atomic.AddInt64(&engineCalls, -1)
+	release()
+	elapsed := time.Since(started)
+	if !isAdminCommand(e.cmd) {
+		shedding.observe(elapsed)
+	}
+	if hasSubscribers() {
+		e := Event{Type: EventCommand, RemoteAddr: r.RemoteAddr, Command: string(commandVerb(line)), Duration: elapsed,
+			BytesIn: mc.reqBytes, BytesOut: mc.written() - out}
+		e.Allocs, e.AllocBytes = allocs.stop()
+		Publish(e)
+	}
+	err = mc.cw.err
+	if err != nil && resumableError(err) {
+		err = nil
+	}
+	if err == nil && w.close {
+		err = errClose
+	}
+	return
+}
+
+// maxPooledArgs bounds the capacity of pooled argument slices,
+// so one huge multi-get doesn't pin memory
+const maxPooledArgs = 256
+
+var argsPool = sync.Pool{New: func() interface{} { return new([][]byte) }}
+
+// splitArgs appends the words of line after the verb to args,
+// the words share the memory of line
+func splitArgs(args [][]byte, line []byte) [][]byte {
+	verb := true
+	for i := 0; i < len(line); {
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+		start := i
+		for i < len(line) && !isSpace(line[i]) {
+			i++
+		}
+		if start == i {
+			break
+		}
+		if verb {
+			verb = false
+			continue
+		}
+		args = append(args, line[start:i])
+	}
+	return args
+}
+
+func isSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\r' || b == '\n'
+}
+
+// putArgs returns the arguments of a served request to argsPool
+func putArgs(p *[][]byte, args [][]byte) {
+	if cap(args) > maxPooledArgs {
+		return
+	}
+	for i := range args {
+		args[i] = nil
+	}
+	*p = args[:0]
+	argsPool.Put(p)
+}
+
+// readData reads the data block of a storage command into r.Data,
+// its size is the arg at position pos. A malformed command line or
+// data block is answered here and ok is false.
+func (mc *conn) readData(r *Request, pos int) (ok bool, err error) {
+	if len(r.Args) < pos {
+		recordViolation(mc.ctx, ViolationSyntax)
+		return false, protocolError(mc.rw)
+	}
+	size, err := strconv.Atoi(string(r.Args[pos-1]))
+	if err != nil || size < 0 {
+		recordViolation(mc.ctx, ViolationNumber)
+		return false, protocolError(mc.rw)
+	}
+	if size > mc.cfg.maxItem {
+		if err = clientError(mc.rw, ErrTooLarge.Error()); err == nil {
+			err = errTooLarge
+		}
+		return false, err
+	}
+	mc.setState(StateReadPayload)
+	b := make([]byte, size+2)
+	mc.c.SetReadDeadline(time.Now().Add(mc.cfg.bodyTimeout(size)))
+	n, err := io.ReadFull(mc.rw, b)
+	mc.reqBytes += uint64(n)
+	if err != nil {
+		// short read, the stream is out of sync
+		return
+	}
+	mc.setState(StateExecute)
+	if !bytes.HasSuffix(b, crlf) {
+		recordViolation(mc.ctx, ViolationCRLF)
+		return false, clientError(mc.rw, "bad data chunk")
+	}
+	r.Data = b[:size]
+	return true, nil
+}
+
+// flush sends the buffered response, unless the next pipelined command
+// is already received or flushdelay is set, so responses to a burst of
+// commands, like session touches, go out in few writes.
+// readLine flushes before waiting for input.
+func (mc *conn) flush() error {
+	mc.setState(StateWriteResponse)
+	if mc.pipelined() || mc.cfg.flushDelay > 0 {
+		return nil
+	}
+	return mc.rw.Flush()
+}
+
+// flushPending sends buffered responses before waiting for the next command.
+// With flushdelay the responses wait up to that long for more commands,
+// so rapid-fire small responses share a write.
+func (mc *conn) flushPending() error {
+	if mc.rw.Writer.Buffered() == 0 {
+		mc.pending = time.Time{}
+		return nil
+	}
+	if mc.pipelined() {
+		return nil
+	}
+	if mc.cfg.flushDelay > 0 && !mc.drained() {
+		if mc.pending.IsZero() {
+			mc.pending = time.Now()
+		}
+		if mc.awaitInput(mc.pending.Add(mc.cfg.flushDelay)) {
+			return nil
+		}
+	}
+	mc.pending = time.Time{}
+	return mc.rw.Flush()
+}
+
+// awaitInput reports whether input arrives before deadline
+func (mc *conn) awaitInput(deadline time.Time) bool {
+	if !time.Now().Before(deadline) {
+		return false
+	}
+	mc.c.SetReadDeadline(deadline)
+	_, err := mc.rw.Peek(1)
+	return err == nil
+}
+
+// pipelined reports whether a whole command line is buffered
+func (mc *conn) pipelined() bool {
+	n := mc.rw.Reader.Buffered()
+	if n == 0 {
+		return false
+	}
+	b, _ := mc.rw.Reader.Peek(n)
+	return bytes.IndexByte(b, '\n') >= 0
+}
@@ -0,0 +1,138 @@
+package mcproto
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Protocol is the wire protocol variant of a connection
+type Protocol int
+
+// Protocols, connections speak the text protocol unless switched
+const (
+	ProtocolText Protocol = iota
+	ProtocolMeta
+	ProtocolBinary
+)
+
+var protocolNames = [...]string{"text", "meta", "binary"}
+
+func (p Protocol) String() string {
+	if p < 0 || int(p) >= len(protocolNames) {
+		return fmt.Sprintf("protocol(%d)", int(p))
+	}
+	return protocolNames[p]
+}
+
+// connMeta is the connection metadata carried by request contexts
+type connMeta struct {
+	id       uint64
+	addr     net.Addr
+	c        net.Conn
+	identity atomic.Value // string
+	protocol int32        // Protocol
+
+	sessions []sessionKey // claimed sessions, guarded by sessionsMu
+}
+
+type connMetaKey struct{}
+
+func withConnMeta(ctx context.Context, m *connMeta) context.Context {
+	return context.WithValue(ctx, connMetaKey{}, m)
+}
+
+func metaFrom(ctx context.Context) *connMeta {
+	m, _ := ctx.Value(connMetaKey{}).(*connMeta)
+	return m
+}
+
+// ConnID returns the ID of the connection serving ctx, as in ConnInfo, or 0
+func ConnID(ctx context.Context) uint64 {
+	if m := metaFrom(ctx); m != nil {
+		return m.id
+	}
+	return 0
+}
+
+// RemoteAddr returns the client address of the connection serving ctx
+func RemoteAddr(ctx context.Context) net.Addr {
+	if m := metaFrom(ctx); m != nil {
+		return m.addr
+	}
+	return nil
+}
+
+// TLSState returns the TLS state of the connection serving ctx,
+// nil for plain connections
+func TLSState(ctx context.Context) *tls.ConnectionState {
+	m := metaFrom(ctx)
+	if m == nil {
+		return nil
+	}
+	tc, ok := m.c.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	state := tc.ConnectionState()
+	return &state
+}
+
+// Identity returns the authenticated identity of the connection serving ctx,
+// empty until SetIdentity
+func Identity(ctx context.Context) string {
+	if m := metaFrom(ctx); m != nil {
+		id, _ := m.identity.Load().(string)
+		return id
+	}
+	return ""
+}
+
+// SetIdentity records the authenticated identity of the connection serving ctx,
+// so later requests on the connection see it. Auth handlers call it.
+func SetIdentity(ctx context.Context, identity string) {
+	if m := metaFrom(ctx); m != nil {
+		m.identity.Store(identity)
+	}
+}
+
+// ConnProtocol returns the protocol variant of the connection serving ctx
+func ConnProtocol(ctx context.Context) Protocol {
+	if m := metaFrom(ctx); m != nil {
+		return Protocol(atomic.LoadInt32(&m.protocol))
+	}
+	return ProtocolText
+}
+
+// metaVerbs are the meta protocol commands, mg is built in, the others are served by custom handlers
+var metaVerbs = map[string]bool{"mg": true, "ms": true, "md": true, "ma": true, "mn": true, "me": true}
+
+// budgetOpaque prefixes the opaque token carrying a timeout budget
+var budgetOpaque = []byte("Od")
+
+// BudgetOpaque returns the meta opaque flag passing a timeout budget to the
+// server, like "Od250" for 250ms. The server sets the request context deadline
+// from it. The budget is relative, so clocks of clients and servers don't matter.
+func BudgetOpaque(budget time.Duration) string {
+	return string(budgetOpaque) + strconv.FormatInt(int64(budget/time.Millisecond), 10)
+}
+
+// opaqueBudget returns the timeout budget of meta command args, if any
+func opaqueBudget(args [][]byte) (time.Duration, bool) {
+	for _, a := range args {
+		if !bytes.HasPrefix(a, budgetOpaque) {
+			continue
+		}
+		ms, err := strconv.ParseInt(string(a[len(budgetOpaque):]), 10, 64)
+		if err != nil || ms < 0 {
+			return 0, false
+		}
+		return time.Duration(ms) * time.Millisecond, true
+	}
+	return 0, false
+}
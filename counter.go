@@ -0,0 +1,56 @@
+package mcproto
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// counterShards must be a power of two
+const counterShards = 32
+
+// counter is a statistics counter sharded over cache lines and summed on read,
+// so hot counters don't bounce one cache line between CPUs. The zero value
+// is ready to use.
+type counter struct {
+	shards [counterShards]struct {
+		n uint64
+		_ [56]byte // pad to a cache line
+	}
+}
+
+// shardHints hands out shard indexes round-robin. sync.Pool keeps a private
+// item per P, so each P settles on its own shard and concurrent adds from
+// different CPUs land on different cache lines.
+var (
+	nextShard  uint32
+	shardHints = sync.Pool{New: func() interface{} {
+		i := atomic.AddUint32(&nextShard, 1) & (counterShards - 1)
+		return &i
+	}}
+)
+
+// add adds n to the shard of the current P
+func (c *counter) add(n uint64) {
+	hint := shardHints.Get().(*uint32)
+	atomic.AddUint64(&c.shards[*hint].n, n)
+	shardHints.Put(hint)
+}
+
+func (c *counter) inc() {
+	c.add(1)
+}
+
+// reset zeroes the counter, adds running concurrently may be lost
+func (c *counter) reset() {
+	for i := range c.shards {
+		atomic.StoreUint64(&c.shards[i].n, 0)
+	}
+}
+
+// load returns the sum of the shards, it is not a snapshot of concurrent adds
+func (c *counter) load() (n uint64) {
+	for i := range c.shards {
+		n += atomic.LoadUint64(&c.shards[i].n)
+	}
+	return
+}
@@ -0,0 +1,128 @@
+package mcproto_test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test_Differential replays generated command sequences against a real
+// memcached and an mcproto server with mapStore and compares wire responses.
+// Set MCPROTO_MEMCACHED=host:port to use a running memcached, otherwise
+// a memcached binary from PATH is started. Without both the test is skipped.
+func Test_Differential(t *testing.T) {
+	addr := os.Getenv("MCPROTO_MEMCACHED")
+	if addr == "" {
+		bin, err := exec.LookPath("memcached")
+		if err != nil {
+			t.Skip("memcached not available, set MCPROTO_MEMCACHED=host:port")
+		}
+		port := freePort(t)
+		cmd := exec.Command(bin, "-p", strconv.Itoa(port), "-U", "0", "-l", "127.0.0.1")
+		if err = cmd.Start(); err != nil {
+			t.Skip("can't start memcached:", err)
+		}
+		defer cmd.Process.Kill()
+		addr = "127.0.0.1:" + strconv.Itoa(port)
+		waitListening(t, addr)
+	}
+	ref, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Skip("memcached not reachable:", err)
+	}
+	defer ref.Close()
+
+	listener := serve(t, newStore(), "deadline=5000")
+	defer listener.Close()
+	conn, r := dial(t, listener)
+	defer conn.Close()
+	refR := bufio.NewReader(ref)
+
+	seed := time.Now().UnixNano()
+	rnd := rand.New(rand.NewSource(seed))
+	// keys are unique per run, so a shared memcached has no stale state
+	prefix := fmt.Sprintf("diff%d:", seed)
+	for i := 0; i < 1000; i++ {
+		cmd, verb := genCommand(rnd, prefix)
+		want := exchange(t, ref, refR, cmd, verb)
+		got := exchange(t, conn, r, cmd, verb)
+		if got != want {
+			t.Fatalf("seed %d, command %d %q:\nmemcached: %q\nmcproto:   %q", seed, i, cmd, want, got)
+		}
+	}
+}
+
+func genCommand(rnd *rand.Rand, prefix string) (cmd, verb string) {
+	key := func() string { return prefix + strconv.Itoa(rnd.Intn(8)) }
+	switch rnd.Intn(6) {
+	case 0:
+		v := strconv.Itoa(rnd.Intn(1000))
+		return fmt.Sprintf("set %s 0 0 %d\r\n%s\r\n", key(), len(v), v), "set"
+	case 1:
+		return "get " + key() + "\r\n", "get"
+	case 2:
+		return "get " + key() + " " + key() + " " + key() + "\r\n", "get"
+	case 3:
+		return "delete " + key() + "\r\n", "delete"
+	case 4:
+		return fmt.Sprintf("incr %s %d\r\n", key(), rnd.Intn(100)), "incr"
+	default:
+		return fmt.Sprintf("decr %s %d\r\n", key(), rnd.Intn(100)), "decr"
+	}
+}
+
+// exchange sends cmd and reads one complete response
+func exchange(t *testing.T, conn net.Conn, r *bufio.Reader, cmd, verb string) string {
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Write([]byte(cmd)); err != nil {
+		t.Fatal(err)
+	}
+	var resp strings.Builder
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("%q: %v (got %q)", cmd, err, resp.String())
+		}
+		resp.WriteString(line)
+		if verb != "get" || line == "END\r\n" || strings.HasSuffix(line, "ERROR\r\n") {
+			return resp.String()
+		}
+		if strings.HasPrefix(line, "VALUE ") {
+			fields := strings.Fields(line)
+			size, _ := strconv.Atoi(fields[3])
+			data := make([]byte, size+2)
+			if _, err = io.ReadFull(r, data); err != nil {
+				t.Fatal(err)
+			}
+			resp.Write(data)
+		}
+	}
+}
+
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func waitListening(t *testing.T, addr string) {
+	for i := 0; i < 50; i++ {
+		if c, err := net.Dial("tcp", addr); err == nil {
+			c.Close()
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Skip("memcached did not start on", addr)
+}
@@ -0,0 +1,188 @@
+package mcproto
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EventType is a kind of internal server event
+type EventType int
+
+// Event types
+const (
+	EventConnOpened     EventType = iota // a client connected
+	EventConnClosed                      // a client connection is closed, Err is the reason if any
+	EventCommand                         // a command is executed
+	EventError                           // a connection or engine error
+	EventEviction                        // an engine evicted Key
+	EventBackendEjected                  // an engine ejected Backend
+	EventMemoryPressure                  // the memory pressure level changed to Pressure
+)
+
+var eventNames = [...]string{"conn_opened", "conn_closed", "command", "error", "eviction", "backend_ejected", "memory_pressure"}
+
+func (t EventType) String() string {
+	if t < 0 || int(t) >= len(eventNames) {
+		return fmt.Sprintf("event(%d)", int(t))
+	}
+	return eventNames[t]
+}
+
+// Event is an internal server event delivered to subscribers
+type Event struct {
+	Type       EventType
+	Time       time.Time
+	RemoteAddr net.Addr      // client address, nil for engine events
+	Command    string        // EventCommand: command verb
+	Duration   time.Duration // EventCommand: execution time
+	BytesIn    uint64        // EventCommand: command line and data block
+	BytesOut   uint64        // EventCommand: response
+	Allocs     uint64        // EventCommand: heap allocations, see SetAllocStats
+	AllocBytes uint64        // EventCommand: heap bytes allocated, see SetAllocStats
+	Key        []byte        // EventEviction: evicted key, valid only during the call
+	Backend    string        // EventBackendEjected: backend address
+	Pressure   Pressure      // EventMemoryPressure: new level
+	Err        error
+}
+
+type subscriber struct {
+	id uint64
+	fn func(Event)
+}
+
+var (
+	subsMu  sync.Mutex
+	subs    atomic.Value // []subscriber
+	lastSub uint64
+)
+
+func init() {
+	subs.Store([]subscriber(nil))
+}
+
+// Subscribe registers fn for all events and returns the function removing it.
+// fn is called synchronously from connection goroutines, so it must be fast
+// and must not block; hand events to a channel for slow processing.
+func Subscribe(fn func(Event)) (unsubscribe func()) {
+	subsMu.Lock()
+	defer subsMu.Unlock()
+	lastSub++
+	id := lastSub
+	old := subs.Load().([]subscriber)
+	next := make([]subscriber, len(old), len(old)+1)
+	copy(next, old)
+	subs.Store(append(next, subscriber{id: id, fn: fn}))
+	return func() {
+		subsMu.Lock()
+		defer subsMu.Unlock()
+		old := subs.Load().([]subscriber)
+		next := make([]subscriber, 0, len(old))
+		for _, s := range old {
+			if s.id != id {
+				next = append(next, s)
+			}
+		}
+		subs.Store(next)
+	}
+}
+
+// Publish delivers e to all subscribers. Engines use it to report
+// evictions, ejected backends and their own errors.
+func Publish(e Event) {
+	list := subs.Load().([]subscriber)
+	if len(list) == 0 {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	for _, s := range list {
+		s.fn(e)
+	}
+}
+
+// hasSubscribers lets hot paths skip building events
+func hasSubscribers() bool {
+	return len(subs.Load().([]subscriber)) > 0
+}
+
+// verbosity is the log level, -1 until logLevel reads DebugConnErr
+var verbosity int32 = -1
+
+// logLevel returns the log level set at runtime by the verbosity command
+// and the admin endpoint: 0 logs nothing, 1 connection errors, 2 and more
+// also every command. It starts at 1 if DebugConnErr is set, else 0.
+func logLevel() int32 {
+	if v := atomic.LoadInt32(&verbosity); v >= 0 {
+		return v
+	}
+	var v int32
+	if DebugConnErr {
+		v = 1
+	}
+	atomic.CompareAndSwapInt32(&verbosity, -1, v)
+	return atomic.LoadInt32(&verbosity)
+}
+
+func setLogLevel(v int32) {
+	atomic.StoreInt32(&verbosity, v)
+}
+
+// connError publishes a connection error and logs it at level 1
+func connError(addr net.Addr, err error) {
+	if err == nil {
+		return
+	}
+	if logLevel() >= 1 {
+		log.Print(err.Error())
+	}
+	if hasSubscribers() {
+		Publish(Event{Type: EventError, RemoteAddr: addr, Err: err})
+	}
+}
+
+// allocStats is 1 when commands measure their heap allocations
+var allocStats int32
+
+// SetAllocStats makes command events and samples report the heap allocations
+// of commands, to find commands that blow up memory. The counts are deltas of
+// runtime.MemStats, process-wide, so they include the allocations of concurrent
+// commands, and reading them stops the world: enable it only while debugging.
+func SetAllocStats(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&allocStats, v)
+}
+
+// allocMeter measures the heap allocations of a command
+type allocMeter struct {
+	on            bool
+	mallocs, size uint64
+}
+
+// startAllocs starts measuring if SetAllocStats is on
+func startAllocs() (m allocMeter) {
+	if atomic.LoadInt32(&allocStats) == 0 {
+		return
+	}
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return allocMeter{on: true, mallocs: ms.Mallocs, size: ms.TotalAlloc}
+}
+
+// stop returns the allocations since startAllocs, zero if not measuring
+func (m allocMeter) stop() (allocs, size uint64) {
+	if !m.on {
+		return
+	}
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return ms.Mallocs - m.mallocs, ms.TotalAlloc - m.size
+}
@@ -0,0 +1,33 @@
+package mcproto
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// CounterShardsUsed makes n overlapping adds, each holding its shard hint
+// until all n have one, as adds running at once on different Ps do, and
+// returns how many shards took them.
+func CounterShardsUsed(n int) (used int) {
+	var c counter
+	var held, done sync.WaitGroup
+	held.Add(n)
+	done.Add(n)
+	for g := 0; g < n; g++ {
+		go func() {
+			defer done.Done()
+			hint := shardHints.Get().(*uint32)
+			held.Done()
+			held.Wait()
+			atomic.AddUint64(&c.shards[*hint].n, 1)
+			shardHints.Put(hint)
+		}()
+	}
+	done.Wait()
+	for i := range c.shards {
+		if c.shards[i].n != 0 {
+			used++
+		}
+	}
+	return used
+}
@@ -0,0 +1,63 @@
+package mcproto
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// GetToucher is an optional interface for engines that fetch an item and
+// update its lifetime in one step. GetAndTouch returns the item of key with
+// its flags and CAS after setting its exptime to exp, ErrCacheMiss if there
+// is none. It serves gat and gats.
+type GetToucher interface {
+	GetAndTouch(key []byte, exp int32) (Item, error)
+}
+
+// getAndTouch serves "gat|gats <exptime> <key>+", answered like get,
+// gats with the CAS unique of the items like gets. Items are answered in
+// the order of the keys, a repeated key is fetched once.
+func (h *engineHandler) getAndTouch(w ResponseWriter, r *Request) (err error) {
+	gt, ok := h.db.(GetToucher)
+	if !ok {
+		return protocolError(w.ReadWriter())
+	}
+	if len(r.Args) < 2 {
+		return h.badLine(w, r)
+	}
+	exp, err := strconv.ParseInt(string(r.Args[0]), 10, 32)
+	if err != nil {
+		return h.badLine(w, r)
+	}
+	getKeys.add(uint64(len(r.Args) - 1))
+	found := make(map[string]*Item, len(r.Args)-1) // nil for misses
+	for _, key := range r.Args[1:] {
+		it, seen := found[string(key)]
+		if !seen {
+			item, gerr := gt.GetAndTouch(key, h.cfg.exp(int32(exp)))
+			if gerr != nil && gerr != ErrCacheMiss {
+				connError(r.RemoteAddr, gerr)
+				return engineError(w.ReadWriter(), gerr)
+			}
+			if h.cfg.hit(item.Value, gerr) {
+				it = &item
+			}
+			found[string(key)] = it
+		}
+		if it == nil {
+			continue
+		}
+		getHits.inc()
+		if r.Command == CmdGats {
+			_, err = fmt.Fprintf(w, "VALUE %s %d %d %d\r\n%s\r\n", key, it.Flags, len(it.Value), it.CAS, it.Value)
+		} else {
+			_, err = fmt.Fprintf(w, "VALUE %s %d %d\r\n%s\r\n", key, it.Flags, len(it.Value), it.Value)
+		}
+		if err != nil {
+			return
+		}
+	}
+	if _, err = w.Write(resultEnd); err != nil {
+		return
+	}
+	return w.Flush()
+}
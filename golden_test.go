@@ -0,0 +1,76 @@
+package mcproto_test
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+// Test_Golden sends every testdata/golden/*.in to a fresh server
+// and compares the response byte for byte with the .golden file.
+// Run go test -run Test_Golden -update to rewrite golden files.
+func Test_Golden(t *testing.T) {
+	files, err := filepath.Glob("testdata/golden/*.in")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no golden cases")
+	}
+	for _, in := range files {
+		name := strings.TrimSuffix(filepath.Base(in), ".in")
+		t.Run(name, func(t *testing.T) {
+			req, err := ioutil.ReadFile(in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the .in files are written with \n line ends
+			req = bytes.Replace(req, []byte("\n"), []byte("\r\n"), -1)
+			got := wire(t, req)
+			golden := strings.TrimSuffix(in, ".in") + ".golden"
+			if *update {
+				if err = ioutil.WriteFile(golden, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("response differs\nwant: %q\ngot:  %q", want, got)
+			}
+		})
+	}
+}
+
+// wire sends req to a fresh server, closes the write side
+// and returns everything the server wrote until it closed the connection
+func wire(t *testing.T, req []byte) []byte {
+	db := newStore()
+	db.Set([]byte("stored"), []byte("value"), 0, 0, 5, false, nil)
+	db.Set([]byte("counter"), []byte("10"), 0, 0, 2, false, nil)
+	listener := serve(t, db, "")
+	defer listener.Close()
+
+	conn, _ := dial(t, listener)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	conn.(*net.TCPConn).CloseWrite()
+	resp, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
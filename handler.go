@@ -0,0 +1,410 @@
+package mcproto
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// Request is a parsed command received by a server.
+// Line and Args are reused after ServeMC returns, copy them to keep.
+type Request struct {
+	Command    Command  // CmdUnknown for verbs that are not registered
+	Line       []byte   // the command line including CRLF
+	Args       [][]byte // the words of the line after the verb
+	Data       []byte   // the data block of storage commands, nil otherwise
+	RemoteAddr net.Addr
+
+	ctx context.Context
+}
+
+// Context returns the request context, it carries the connection metadata
+// read by ConnID, RemoteAddr, TLSState, Identity and ConnProtocol
+func (r *Request) Context() context.Context {
+	if r.ctx != nil {
+		return r.ctx
+	}
+	return context.Background()
+}
+
+// WithContext returns a shallow copy of r with its context changed to ctx
+func (r *Request) WithContext(ctx context.Context) *Request {
+	r2 := *r
+	r2.ctx = ctx
+	return &r2
+}
+
+// ResponseWriter writes the response to a Request.
+// Responses are buffered until Flush.
+type ResponseWriter interface {
+	Write(p []byte) (int, error)
+	WriteString(s string) (int, error)
+	Flush() error
+	// Close closes the connection after the current command
+	Close()
+	// ReadWriter returns the buffered connection, as expected by McEngine methods
+	ReadWriter() *bufio.ReadWriter
+}
+
+// Handler responds to a memcache Request, like http.Handler.
+// The connection reads the command line and the data block of storage
+// commands before ServeMC is called; malformed storage commands
+// are answered without calling it.
+type Handler interface {
+	ServeMC(w ResponseWriter, r *Request)
+}
+
+// HandlerFunc adapts a function to a Handler
+type HandlerFunc func(w ResponseWriter, r *Request)
+
+// ServeMC calls f(w, r)
+func (f HandlerFunc) ServeMC(w ResponseWriter, r *Request) {
+	f(w, r)
+}
+
+// ServeConn serves the memcache protocol on c with h.
+// params is a URL query string of connection settings, see README.
+// Invalid params close c and are reported like connection errors,
+// check them once at startup with ValidateParams.
+func ServeConn(c net.Conn, h Handler, params string) {
+	cfg, err := cachedParams(params)
+	if err != nil {
+		c.Close()
+		connError(c.RemoteAddr(), err)
+		return
+	}
+	newConn(c, h, cfg).serve()
+}
+
+// response is the ResponseWriter of a conn
+type response struct {
+	mc    *conn
+	close bool
+}
+
+func (w *response) Write(p []byte) (int, error)       { return w.mc.rw.Write(p) }
+func (w *response) WriteString(s string) (int, error) { return w.mc.rw.WriteString(s) }
+func (w *response) Flush() error                      { return w.mc.flush() }
+func (w *response) Close()                            { w.close = true }
+func (w *response) ReadWriter() *bufio.ReadWriter     { return w.mc.rw }
+
+// engineHandler serves the registered commands with an McEngine
+type engineHandler struct {
+	db       McEngine
+	cfg      *config
+	interner *interner // nil unless the intern param is set
+}
+
+// EngineHandler returns the Handler used by ParseMc, it serves the
+// registered commands with db. Expiration params are applied, see README.
+func EngineHandler(db McEngine, params string) (Handler, error) {
+	cfg, err := parseParams(params)
+	if err != nil {
+		return nil, err
+	}
+	return newEngineHandler(db, cfg), nil
+}
+
+func newEngineHandler(db McEngine, cfg *config) *engineHandler {
+	h := &engineHandler{db: db, cfg: cfg}
+	if cfg.intern > 0 {
+		h.interner = newInterner(cfg.intern)
+	}
+	return h
+}
+
+func (h *engineHandler) ServeMC(w ResponseWriter, r *Request) {
+	e, ok := lookupCommand(r.Line)
+	if !ok {
+		h.unknown(w, r)
+		return
+	}
+	if err := e.fn(h, w, r); err != nil && !resumableError(err) {
+		w.Close()
+	}
+}
+
+func (h *engineHandler) unknown(w ResponseWriter, r *Request) {
+	if box, _ := unknownHandler.Load().(handlerBox); box.h != nil {
+		box.h.ServeMC(w, r)
+		return
+	}
+	recordViolation(r.Context(), ViolationUnknown)
+	protocolError(w.ReadWriter())
+	if h.cfg.unknownClose {
+		w.Close()
+	}
+}
+
+// badLine answers a malformed command line and counts the violation
+func (h *engineHandler) badLine(w ResponseWriter, r *Request) error {
+	recordViolation(r.Context(), lineViolation(r.Line, r.Command, r.Args))
+	return protocolError(w.ReadWriter())
+}
+
+func (h *engineHandler) set(w ResponseWriter, r *Request) (err error) {
+	_, flags, exp, size, noreply, err := scanSetLine(r.Line, CmdSet, isUpper(r.Line))
+	if err != nil || size != len(r.Data) {
+		return h.badLine(w, r)
+	}
+	noreplyresp, err := h.db.Set(h.key(r.Args[0]), r.Data, flags, h.cfg.exp(exp), size, noreply, w.ReadWriter())
+	if err == nil {
+		wrote(r)
+	}
+	if noreply || noreplyresp {
+		connError(r.RemoteAddr, err)
+		return nil
+	}
+	return storeResult(w, r, err)
+}
+
+// storeResult answers a storage command with the error of the engine
+func storeResult(w ResponseWriter, r *Request, err error) error {
+	switch err {
+	case nil:
+		_, err = w.Write(resultStored)
+	case ErrNotStored:
+		_, err = w.Write(resultNotStored)
+	case ErrCASConflict:
+		_, err = w.Write(resultExists)
+	case ErrCacheMiss:
+		_, err = w.Write(resultNotFound)
+	default:
+		if !refused(err) {
+			connError(r.RemoteAddr, err)
+		}
+		return engineError(w.ReadWriter(), err)
+	}
+	if err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func (h *engineHandler) get(w ResponseWriter, r *Request) (err error) {
+	line := r.Line
+	if len(r.Args) == 0 || !bytes.HasSuffix(line, crlf) {
+		return h.badLine(w, r)
+	}
+	getKeys.add(uint64(len(r.Args)))
+	if r.Command == CmdGets {
+		_, items := h.db.(ItemsGetter)
+		_, cas := h.db.(CASGetter)
+		if items || cas {
+			return h.getsItems(w, r)
+		}
+	}
+	if len(r.Args) > 1 {
+		if gs, ok := h.db.(GetsStreamer); ok {
+			return streamGets(gs, r.Args, w.ReadWriter(), h.hit)
+		}
+		return h.getsOrdered(w, r)
+	}
+	key := r.Args[0]
+	if fg, ok := h.db.(FileGetter); ok {
+		return h.getFile(fg, w, r, key)
+	}
+	value, noreply, err := h.db.Get(key, w.ReadWriter())
+	if refused(err) {
+		return engineError(w.ReadWriter(), err)
+	}
+	if err != nil && err != ErrCacheMiss {
+		connError(r.RemoteAddr, err)
+	}
+	if h.cfg.hit(value, err) {
+		if !noreply {
+			fmt.Fprintf(w, "VALUE %s 0 %d\r\n%s\r\n", key, len(value), value)
+		}
+		h.hit(key)
+	}
+	if rel, ok := h.db.(ValueReleaser); ok && value != nil {
+		// the value is copied to the response buffer or sent
+		rel.Release(value)
+	}
+	if noreply {
+		return nil
+	}
+	if _, err = w.Write(resultEnd); err != nil {
+		return
+	}
+	return w.Flush()
+}
+
+// getsOrdered serves a multi-get with Gets. The engine is asked once per
+// key and its response is rewritten from the returned keysvals in the order
+// of the keys. Responses of engines returning no keysvals, or failing,
+// are passed through as written.
+func (h *engineHandler) getsOrdered(w ResponseWriter, r *Request) (err error) {
+	var resp bytes.Buffer
+	rw, out := w.ReadWriter(), bufio.NewWriter(&resp)
+	kv, err := h.db.Gets(uniqueKeys(r.Args), bufio.NewReadWriter(rw.Reader, out))
+	out.Flush()
+	if refused(err) {
+		return engineError(rw, err)
+	}
+	if err != nil || len(kv) == 0 {
+		if err != nil {
+			connError(r.RemoteAddr, err)
+		}
+		if _, err = rw.Write(resp.Bytes()); err != nil {
+			return
+		}
+		return rw.Flush()
+	}
+	order := newKeyOrder(r.Args, func(key, value []byte) error {
+		if _, err := fmt.Fprintf(w, "VALUE %s 0 %d\r\n%s\r\n", key, len(value), value); err != nil {
+			return err
+		}
+		h.hit(key)
+		return nil
+	})
+	for i := 0; i+1 < len(kv); i += 2 {
+		if err = order.found(kv[i], kv[i+1]); err != nil {
+			return
+		}
+	}
+	if err = order.flush(true); err != nil {
+		return
+	}
+	if _, err = w.Write(resultEnd); err != nil {
+		return
+	}
+	return w.Flush()
+}
+
+func (h *engineHandler) delete(w ResponseWriter, r *Request) (err error) {
+	_, noreply, err := scanDeleteLine(r.Line, isUpper(r.Line))
+	if err != nil {
+		return h.badLine(w, r)
+	}
+	deleted, noreplyresp, err := h.db.Delete(h.key(r.Args[0]), w.ReadWriter())
+	if deleted {
+		wrote(r)
+	}
+	connError(r.RemoteAddr, err)
+	if noreply || noreplyresp {
+		return nil
+	}
+	if refused(err) {
+		return engineError(w.ReadWriter(), err)
+	}
+	if deleted {
+		_, err = w.Write(resultDeleted)
+	} else {
+		_, err = w.Write(resultNotFound)
+	}
+	if err != nil {
+		return
+	}
+	return w.Flush()
+}
+
+// touch serves "touch <key> <exptime> [noreply]" if the engine implements Toucher
+func (h *engineHandler) touch(w ResponseWriter, r *Request) (err error) {
+	t, ok := h.db.(Toucher)
+	if !ok {
+		return protocolError(w.ReadWriter())
+	}
+	noreply := len(r.Args) == 3 && isNoreply(r.Args[2])
+	if len(r.Args) != 2 && !noreply {
+		return h.badLine(w, r)
+	}
+	exp, err := strconv.ParseInt(string(r.Args[1]), 10, 32)
+	if err != nil {
+		return h.badLine(w, r)
+	}
+	isFound, err := t.Touch(h.key(r.Args[0]), h.cfg.exp(int32(exp)))
+	connError(r.RemoteAddr, err)
+	if isFound {
+		wrote(r)
+	}
+	if noreply {
+		return nil
+	}
+	if refused(err) {
+		return engineError(w.ReadWriter(), err)
+	}
+	if isFound {
+		_, err = w.Write(resultTouched)
+	} else {
+		_, err = w.Write(resultNotFound)
+	}
+	if err != nil {
+		return
+	}
+	return w.Flush()
+}
+
+// flushAll serves "flush_all [delay] [noreply]" if the engine implements Flusher
+func (h *engineHandler) flushAll(w ResponseWriter, r *Request) (err error) {
+	f, ok := h.db.(Flusher)
+	if !ok {
+		return protocolError(w.ReadWriter())
+	}
+	args := r.Args
+	noreply := len(args) > 0 && isNoreply(args[len(args)-1])
+	if noreply {
+		args = args[:len(args)-1]
+	}
+	var delay int64
+	if len(args) > 1 {
+		return h.badLine(w, r)
+	}
+	if len(args) == 1 {
+		if delay, err = strconv.ParseInt(string(args[0]), 10, 32); err != nil || delay < 0 {
+			return h.badLine(w, r)
+		}
+	}
+	err = f.FlushAll(int32(delay))
+	if err == nil {
+		mutations.inc()
+	}
+	if noreply {
+		connError(r.RemoteAddr, err)
+		return nil
+	}
+	if err != nil {
+		connError(r.RemoteAddr, err)
+		return engineError(w.ReadWriter(), err)
+	}
+	if _, err = w.Write(resultOK); err != nil {
+		return
+	}
+	return w.Flush()
+}
+
+func (h *engineHandler) incrDecr(w ResponseWriter, r *Request, incr bool) (err error) {
+	_, val, noreply, err := scanIncrDecrLine(r.Line, incr, isUpper(r.Line))
+	if err != nil {
+		return h.badLine(w, r)
+	}
+	var res uint64
+	var isFound, noreplyresp bool
+	if incr {
+		res, isFound, noreplyresp, err = h.db.Incr(h.key(r.Args[0]), val, w.ReadWriter())
+	} else {
+		res, isFound, noreplyresp, err = h.db.Decr(h.key(r.Args[0]), val, w.ReadWriter())
+	}
+	connError(r.RemoteAddr, err)
+	if isFound {
+		wrote(r)
+	}
+	if noreply || noreplyresp {
+		return nil
+	}
+	if refused(err) {
+		return engineError(w.ReadWriter(), err)
+	}
+	if isFound {
+		_, err = fmt.Fprintf(w, "%d\r\n", res)
+	} else {
+		_, err = w.Write(resultNotFound)
+	}
+	if err != nil {
+		return
+	}
+	return w.Flush()
+}
@@ -0,0 +1,145 @@
+package mcproto
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// idemVerb prefixes a mutation with an idempotency token:
+//
+//	idem <token> <command line>
+//
+// A retry with the same token within the window gets the response of the
+// first execution and the command is not run again, so a client retrying
+// after an ambiguous network failure doesn't apply an increment twice.
+var idemVerb = []byte("idem ")
+
+// maxIdemTokens bounds the remembered tokens, the oldest are forgotten first
+const maxIdemTokens = 1 << 20
+
+// idemKey scopes tokens by identity, so clients can't replay each other's responses
+type idemKey struct {
+	identity, token string
+}
+
+type idemEntry struct {
+	done    chan struct{} // closed when resp is set
+	resp    []byte
+	expires time.Time
+}
+
+// idemStore remembers the responses of tokens for window
+type idemStore struct {
+	window time.Duration
+
+	mu      sync.Mutex
+	entries map[idemKey]*idemEntry
+	order   []idemKey // by insertion, so by expiry
+}
+
+var idempotency atomic.Value // *idemStore, nil if disabled
+
+func init() {
+	idempotency.Store((*idemStore)(nil))
+}
+
+// SetIdempotencyWindow enables the idem command prefix, retries of a token
+// are deduplicated within window. Zero disables it and forgets the tokens,
+// then idem lines are unknown commands.
+func SetIdempotencyWindow(window time.Duration) {
+	if window <= 0 {
+		idempotency.Store((*idemStore)(nil))
+		return
+	}
+	idempotency.Store(&idemStore{window: window, entries: make(map[idemKey]*idemEntry)})
+}
+
+// idemMutation reports whether cmd may carry an idempotency token,
+// that is whether it modifies items
+func idemMutation(cmd Command) bool {
+	switch cmd {
+	case CmdSet, CmdAdd, CmdReplace, CmdAppend, CmdPrepend, CmdCAS, CmdDelete, CmdIncr, CmdDecr,
+		CmdSetRange, CmdSetBit, CmdLPush, CmdRPush, CmdLPop, CmdRPop, CmdTouch, CmdFlushAll:
+		return true
+	}
+	return false
+}
+
+// splitIdem returns the token and the wrapped command line of an idem line,
+// msg is the CLIENT_ERROR message of a malformed one
+func splitIdem(line []byte) (token, inner []byte, msg string) {
+	rest := line[len(idemVerb):]
+	i := bytes.IndexByte(rest, ' ')
+	if i <= 0 || i+1 == len(rest) {
+		return nil, nil, "usage: idem <token> <command>"
+	}
+	token, inner = rest[:i], rest[i+1:]
+	if strictKey(token) != "" {
+		return nil, nil, "bad idempotency token"
+	}
+	if e, _ := lookupCommand(inner); !idemMutation(e.cmd) {
+		return nil, nil, "idem needs a command modifying items"
+	}
+	return
+}
+
+// claim returns the entry of the token, owner is true if the caller must run
+// the command and finish the entry, else the command ran or is running
+func (s *idemStore) claim(identity string, token []byte) (e *idemEntry, owner bool) {
+	key := idemKey{identity, string(token)}
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.order) > 0 {
+		oldest := s.order[0]
+		if old := s.entries[oldest]; old != nil && now.Before(old.expires) && len(s.entries) < maxIdemTokens {
+			break
+		}
+		delete(s.entries, oldest)
+		s.order = s.order[1:]
+	}
+	if e = s.entries[key]; e != nil {
+		return e, false
+	}
+	e = &idemEntry{done: make(chan struct{}), expires: now.Add(s.window)}
+	s.entries[key] = e
+	s.order = append(s.order, key)
+	return e, true
+}
+
+func (e *idemEntry) finish(resp []byte) {
+	e.resp = resp
+	close(e.done)
+}
+
+// serveIdem runs serve once per token and replays its response to retries.
+// A retry waits for the first execution up to the idle deadline of the
+// connection, or the window if shorter, then it answers SERVER_ERROR.
+func (mc *conn) serveIdem(s *idemStore, token []byte, serve func()) {
+	e, owner := s.claim(Identity(mc.ctx), token)
+	if !owner {
+		wait := mc.cfg.deadline
+		if s.window < wait {
+			wait = s.window
+		}
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-e.done:
+			mc.rw.Write(e.resp)
+		case <-timer.C:
+			serverError(mc.rw, "idempotent command still running")
+		}
+		mc.flush()
+		return
+	}
+	resp, _ := mc.capture(func() error {
+		serve()
+		return nil
+	})
+	e.finish(resp)
+	mc.rw.Write(resp)
+	mc.flush()
+}
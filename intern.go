@@ -0,0 +1,47 @@
+package mcproto
+
+import "sync"
+
+// interner keeps shared copies of up to size keys, so commands on a small
+// hot keyset don't allocate a key per request. Engines may retain the keys
+// they are passed and must not modify them.
+type interner struct {
+	size int
+
+	mu   sync.RWMutex
+	keys map[string][]byte
+}
+
+func newInterner(size int) *interner {
+	return &interner{size: size, keys: make(map[string][]byte, size)}
+}
+
+// intern returns a stable copy of b. When the table is full
+// a random key is dropped, so hot keys get in eventually.
+func (in *interner) intern(b []byte) []byte {
+	in.mu.RLock()
+	key, ok := in.keys[string(b)]
+	in.mu.RUnlock()
+	if ok {
+		return key
+	}
+	key = append([]byte(nil), b...)
+	in.mu.Lock()
+	if len(in.keys) >= in.size {
+		for k := range in.keys {
+			delete(in.keys, k)
+			break
+		}
+	}
+	in.keys[string(key)] = key
+	in.mu.Unlock()
+	return key
+}
+
+// key returns a copy of a command key the engine may retain
+func (h *engineHandler) key(b []byte) []byte {
+	if h.interner != nil {
+		return h.interner.intern(b)
+	}
+	return append([]byte(nil), b...)
+}
@@ -0,0 +1,161 @@
+package mcproto
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrNotDumper is returned when an engine does not implement Dumper
+var ErrNotDumper = errors.New("mcproto: engine does not implement Dumper")
+
+// PrefixStats is an estimate of one keyspace partition.
+// Counts are extrapolated from sampled keys.
+type PrefixStats struct {
+	Prefix string           `json:"prefix"`
+	Items  int64            `json:"items"`
+	Bytes  int64            `json:"bytes"` // keys and values
+	TTL    map[string]int64 `json:"ttl"`   // items by remaining lifetime bucket
+	Churn  float64          `json:"churn"` // share of sampled keys gone since the previous pass
+}
+
+// ttl buckets of PrefixStats.TTL
+var ttlBuckets = []struct {
+	name string
+	max  int32
+}{
+	{"1m", 60},
+	{"1h", 3600},
+	{"1d", 86400},
+	{"long", 1<<31 - 1},
+}
+
+// KeyspaceSampler periodically walks an engine and estimates per-prefix
+// item counts, bytes, TTL distribution and churn for capacity planning.
+// The prefix of a key is everything before the first Delim.
+type KeyspaceSampler struct {
+	db    Dumper
+	rate  uint32
+	delim byte
+
+	mu      sync.RWMutex
+	report  []PrefixStats
+	sampled map[string]map[string]struct{} // prefix -> sampled keys of the last pass
+	taken   time.Time
+}
+
+// NewKeyspaceSampler samples 1 of rate keys (chosen by key hash,
+// so the same keys are followed between passes) of db
+func NewKeyspaceSampler(db McEngine, rate int, delim byte) (*KeyspaceSampler, error) {
+	d, ok := db.(Dumper)
+	if !ok {
+		return nil, ErrNotDumper
+	}
+	if rate < 1 {
+		rate = 1
+	}
+	return &KeyspaceSampler{db: d, rate: uint32(rate), delim: delim}, nil
+}
+
+// Sample makes one pass over the engine and replaces the report
+func (s *KeyspaceSampler) Sample() error {
+	stats := make(map[string]*PrefixStats)
+	sampled := make(map[string]map[string]struct{})
+	err := s.db.Dump(func(it Item) error {
+		h := fnv.New32a()
+		h.Write(it.Key)
+		if h.Sum32()%s.rate != 0 {
+			return nil
+		}
+		prefix := string(it.Key)
+		if i := bytes.IndexByte(it.Key, s.delim); i >= 0 {
+			prefix = string(it.Key[:i])
+		}
+		ps, ok := stats[prefix]
+		if !ok {
+			ps = &PrefixStats{Prefix: prefix, TTL: make(map[string]int64)}
+			stats[prefix] = ps
+			sampled[prefix] = make(map[string]struct{})
+		}
+		ps.Items++
+		ps.Bytes += int64(len(it.Key) + len(it.Value))
+		bucket := "never"
+		if it.Exp > 0 {
+			for _, b := range ttlBuckets {
+				if it.Exp <= b.max {
+					bucket = b.name
+					break
+				}
+			}
+		}
+		ps.TTL[bucket]++
+		sampled[prefix][string(it.Key)] = struct{}{}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	report := make([]PrefixStats, 0, len(stats))
+	for prefix, ps := range stats {
+		if prev := s.sampled[prefix]; len(prev) > 0 {
+			gone := 0
+			for k := range prev {
+				if _, ok := sampled[prefix][k]; !ok {
+					gone++
+				}
+			}
+			ps.Churn = float64(gone) / float64(len(prev))
+		}
+		rate := int64(s.rate)
+		ps.Items *= rate
+		ps.Bytes *= rate
+		for b := range ps.TTL {
+			ps.TTL[b] *= rate
+		}
+		report = append(report, *ps)
+	}
+	sort.Slice(report, func(i, j int) bool { return report[i].Prefix < report[j].Prefix })
+	s.report, s.sampled, s.taken = report, sampled, time.Now()
+	return nil
+}
+
+// Run samples every interval until stop is closed
+func (s *KeyspaceSampler) Run(interval time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		connError(nil, s.Sample())
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// Report returns the result of the last pass
+func (s *KeyspaceSampler) Report() []PrefixStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.report
+}
+
+// ServeHTTP writes the report as JSON
+func (s *KeyspaceSampler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	resp := struct {
+		Taken    time.Time     `json:"taken"`
+		Prefixes []PrefixStats `json:"prefixes"`
+	}{s.taken, s.report}
+	s.mu.RUnlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,62 @@
+package mcproto
+
+import "sync/atomic"
+
+// lanes limits commands running at once across all connections.
+// Admin and health commands have their own budget, so they are never
+// queued behind data commands waiting for a saturated engine.
+// A nil lane means no limit.
+type lanes struct {
+	waiting int64 // data commands waiting for a slot
+
+	data  chan struct{}
+	admin chan struct{}
+}
+
+var defaultLanes atomic.Value // *lanes
+
+func init() {
+	defaultLanes.Store(&lanes{})
+}
+
+// SetInflightLimit limits commands running at once across all connections:
+// data for storage and retrieval commands, admin for admin and health commands.
+// Zero means no limit. It affects commands started after the call.
+func SetInflightLimit(data, admin int) {
+	l := &lanes{}
+	if data > 0 {
+		l.data = make(chan struct{}, data)
+	}
+	if admin > 0 {
+		l.admin = make(chan struct{}, admin)
+	}
+	defaultLanes.Store(l)
+}
+
+// acquire takes a slot in the lane of cmd
+// and returns the function releasing it
+func (l *lanes) acquire(cmd Command) (release func()) {
+	lane := l.data
+	if isAdminCommand(cmd) {
+		lane = l.admin
+	}
+	if lane == nil {
+		return func() {}
+	}
+	if lane == l.data {
+		atomic.AddInt64(&l.waiting, 1)
+		defer atomic.AddInt64(&l.waiting, -1)
+	}
+	lane <- struct{}{}
+	return func() { <-lane }
+}
+
+// isAdminCommand reports whether cmd is a cheap introspection command
+// served by the admin lane
+func isAdminCommand(cmd Command) bool {
+	switch cmd {
+	case CmdTTL, CmdStats, CmdVersion, CmdVerbosity:
+		return true
+	}
+	return false
+}
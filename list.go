@@ -0,0 +1,131 @@
+package mcproto
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// Lists are values holding elements as uvarint length prefixed byte strings.
+// They are modified with Updater, so concurrent pushes and pops of a work
+// queue never lose or duplicate elements. A list is created by storing an
+// empty value with set, which also sets its flags and lifetime.
+
+var (
+	errNotList     = errors.New("value is not a list")
+	errListTooLong = errors.New("list too long")
+	errEmptyList   = errors.New("list is empty") // aborts a pop, nothing is stored
+)
+
+// listElems splits a list value into its elements, which share its memory
+func listElems(value []byte) ([][]byte, error) {
+	var elems [][]byte
+	for len(value) > 0 {
+		n, w := binary.Uvarint(value)
+		if w <= 0 || n > uint64(len(value)-w) {
+			return nil, errNotList
+		}
+		elems = append(elems, value[w:w+int(n)])
+		value = value[w+int(n):]
+	}
+	return elems, nil
+}
+
+func appendElem(list, elem []byte) []byte {
+	var n [binary.MaxVarintLen64]byte
+	list = append(list, n[:binary.PutUvarint(n[:], uint64(len(elem)))]...)
+	return append(list, elem...)
+}
+
+// push serves "lpush|rpush <key> <bytes> [noreply]" with a data block
+// and answers the length of the list
+func (h *engineHandler) push(w ResponseWriter, r *Request, left bool) (err error) {
+	u, ok := h.db.(Updater)
+	if !ok {
+		return protocolError(w.ReadWriter())
+	}
+	noreply := len(r.Args) == 3 && isNoreply(r.Args[2])
+	if len(r.Args) != 2 && !noreply {
+		return h.badLine(w, r)
+	}
+	var length int
+	err = u.Update(h.key(r.Args[0]), func(value []byte) ([]byte, error) {
+		elems, err := listElems(value)
+		if err != nil {
+			return nil, err
+		}
+		length = len(elems) + 1
+		if len(value)+tailSize([][]byte{r.Data}) > maxPatchSize {
+			return nil, errListTooLong
+		}
+		if left {
+			return append(appendElem(nil, r.Data), value...), nil
+		}
+		return appendElem(append([]byte(nil), value...), r.Data), nil
+	})
+	return h.listResult(w, r, err, noreply, []byte(strconv.Itoa(length)+"\r\n"))
+}
+
+// pop serves "lpop|rpop <key>", the element is answered like a get
+// of the key, an empty list answers END
+func (h *engineHandler) pop(w ResponseWriter, r *Request, left bool) (err error) {
+	u, ok := h.db.(Updater)
+	if !ok {
+		return protocolError(w.ReadWriter())
+	}
+	if len(r.Args) != 1 {
+		return h.badLine(w, r)
+	}
+	var elem []byte
+	var found bool // elem may be empty
+	err = u.Update(h.key(r.Args[0]), func(value []byte) ([]byte, error) {
+		elems, err := listElems(value)
+		if err != nil {
+			return nil, err
+		}
+		if len(elems) == 0 {
+			return nil, errEmptyList
+		}
+		var rest []byte
+		if left {
+			elem = elems[0]
+			rest = value[len(value)-tailSize(elems[1:]):]
+		} else {
+			elem = elems[len(elems)-1]
+			rest = value[:len(value)-tailSize(elems[len(elems)-1:])]
+		}
+		elem = append(make([]byte, 0, len(elem)), elem...)
+		found = true
+		return append([]byte(nil), rest...), nil
+	})
+	if err == errEmptyList {
+		w.ReadWriter().Write(resultEnd)
+		return w.Flush()
+	}
+	resp := string(resultEnd)
+	if found {
+		resp = fmt.Sprintf("VALUE %s 0 %d\r\n%s\r\n", r.Args[0], len(elem), elem) + resp
+	}
+	return h.listResult(w, r, err, false, []byte(resp))
+}
+
+// tailSize returns the encoded size of elems
+func tailSize(elems [][]byte) (n int) {
+	var buf [binary.MaxVarintLen64]byte
+	for _, e := range elems {
+		n += binary.PutUvarint(buf[:], uint64(len(e))) + len(e)
+	}
+	return
+}
+
+// listResult answers a list command, ok is the response on success
+func (h *engineHandler) listResult(w ResponseWriter, r *Request, err error, noreply bool, ok []byte) error {
+	if err == errNotList || err == errListTooLong {
+		if noreply {
+			return nil
+		}
+		return clientError(w.ReadWriter(), err.Error())
+	}
+	return h.patchResult(w, r, err, noreply, ok)
+}
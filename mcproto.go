@@ -7,35 +7,20 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
-	"io"
-	"log"
 	"net"
-	"net/url"
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
 	"syscall"
-	"time"
 )
 
+// DebugConnErr logs connection errors with the log package, subscribe to
+// EventError to handle them otherwise. It sets the initial log level when
+// the first error is logged, the verbosity command changes it at runtime.
 var DebugConnErr = true
 
 var (
-	cmdSet     = []byte("set")
-	cmdSetB    = []byte("SET")
-	cmdGet     = []byte("get")
-	cmdGetB    = []byte("GET")
-	cmdGets    = []byte("gets")
-	cmdGetsB   = []byte("GETS")
-	cmdClose   = []byte("close")
-	cmdCloseB  = []byte("CLOSE")
-	cmdDelete  = []byte("delete")
-	cmdDeleteB = []byte("DELETE")
-	cmdIncr    = []byte("incr")
-	cmdIncrB   = []byte("INCR")
-	cmdDecr    = []byte("decr")
-	cmdDecrB   = []byte("DECR")
-
 	crlf     = []byte("\r\n")
 	space    = []byte(" ")
 	resultOK = []byte("OK\r\n")
@@ -50,8 +35,12 @@ var (
 	resultError             = []byte("ERROR\r\n")
 	resultTouched           = []byte("TOUCHED\r\n")
 	resultClientErrorPrefix = []byte("CLIENT_ERROR ")
+	resultServerErrorPrefix = []byte("SERVER_ERROR ")
 )
 
+// defaultScanCount is the batch size of scan when count is omitted.
+const defaultScanCount = 10
+
 // Similar to:
 // https://godoc.org/google.golang.org/appengine/memcache
 
@@ -80,16 +69,41 @@ var (
 	// contain whitespace or control characters.
 	ErrMalformedKey = errors.New("malformed: key is too long or contains invalid characters")
 
+	// ErrTooLarge means that a value exceeds the size limit of the engine.
+	ErrTooLarge = errors.New("object too large for cache")
+
 	// ErrNoServers is returned when no servers are configured or available.
 	ErrNoServers = errors.New("memcache: no servers configured or available")
+
+	// ErrUnsupported is returned by engines that don't support a command,
+	// or some of its arguments. It is answered ERROR, like an unknown command.
+	ErrUnsupported = errors.New("mcproto: command not supported by the engine")
+
+	// ErrBadRequest is returned by engines rejecting the arguments of
+	// a command. It is answered CLIENT_ERROR bad request.
+	ErrBadRequest = errors.New("mcproto: bad request")
 )
 
+// EmptyValue is returned by engines for a stored zero-length value,
+// unlike a nil value it is never a miss
+var EmptyValue = []byte{}
+
 func init() {
 	// Workaround for issue #17393.
 	signal.Notify(make(chan os.Signal), syscall.SIGPIPE)
 }
 
-// McEngine implenets base memcache commands
+// McEngine implenets base memcache commands.
+// Get reports a hit with a non-nil value, use EmptyValue for a stored
+// zero-length value. A miss is a nil value or ErrCacheMiss, with the
+// nilvalue=empty param a nil value is an empty value and misses must be ErrCacheMiss.
+//
+// Memory contract: keys passed to Get and Gets point into the connection
+// buffer and are valid only during the call. Keys and values passed to
+// Set, Delete, Incr and Decr are owned by the engine. A value returned by
+// Get is written to the response before the command completes and is not
+// retained by the server, so it may point into an mmap or arena; engines
+// reusing that memory implement ValueReleaser to learn when it's free.
 type McEngine interface {
 	Get(key []byte, rw *bufio.ReadWriter) (value []byte, noreply bool, err error)
 	Gets(keys [][]byte, rw *bufio.ReadWriter) (keysvals [][]byte, err error)
@@ -100,13 +114,65 @@ type McEngine interface {
 	Close() error
 }
 
+// ValueReleaser is an optional interface for engines returning values
+// backed by memory they reuse. Release is called with every non-nil value
+// returned by Get for a single key get or mg once the server no longer
+// references it, before the command completes. Values read by other
+// commands (gets, gat, list and patch commands) are never released.
+type ValueReleaser interface {
+	Release(value []byte)
+}
+
+// detach copies a value returned by Get of e and releases the original if e
+// is a ValueReleaser, so engine wrappers hand out values they don't have to
+// track back to the engine they came from
+func detach(e McEngine, value []byte) []byte {
+	rel, ok := e.(ValueReleaser)
+	if !ok || value == nil {
+		return value
+	}
+	copied := append([]byte(nil), value...)
+	rel.Release(value)
+	return copied
+}
+
+// Scanner is an optional interface for engines that can enumerate keys.
+// Scan returns up to count keys starting with match (all keys if match is empty),
+// beginning at cursor, and the cursor for the next call.
+// A next cursor of 0 means the iteration is complete.
+// Unlike Dump, scan is not a snapshot: keys written during iteration
+// may or may not be returned, but keys present for the whole iteration are.
+type Scanner interface {
+	Scan(cursor uint64, match []byte, count int) (keys [][]byte, next uint64, err error)
+}
+
+// TTLer is an optional interface for engines that track expiration.
+// TTL returns the remaining lifetime of key in seconds,
+// -1 if the key exists but never expires and -2 if the key does not exist.
+type TTLer interface {
+	TTL(key []byte) (ttl int64, err error)
+}
+
+// Toucher is an optional interface for engines that can update
+// the expiration time of an existing item without fetching it.
+type Toucher interface {
+	Touch(key []byte, exp int32) (isFound bool, err error)
+}
+
+// Flusher is an optional interface for engines that can invalidate
+// all items. FlushAll invalidates the items stored up to delay seconds
+// from now, at once if delay is 0; engines schedule delayed flushes.
+type Flusher interface {
+	FlushAll(delay int32) error
+}
+
 // your struct must implement this memcache commands:
 /*
 
 func (en *yourEngine) Get(key []byte, rw *bufio.ReadWriter) (value []byte, noreply bool, err error) {
 	return
 }
-func (en *yourEngine) Gets(keys [][]byte, rw *bufio.ReadWriter) (err error) {
+func (en *yourEngine) Gets(keys [][]byte, rw *bufio.ReadWriter) (keysvals [][]byte, err error) {
 	return
 }
 func (en *yourEngine) Set(key, value []byte, flags uint32, exp int32, size int, noreply bool, rw *bufio.ReadWriter) (noreplyresp bool, err error) {
@@ -127,276 +193,57 @@ func (en *yourEngine) Close() (err error) {
 }
 */
 
-// ParseMc - parse memcache protocol
+// ParseMc - parse memcache protocol, serves c with the commands of db.
+// It is kept for existing users as an adapter over ServeConn and EngineHandler.
+// Invalid params close c and are reported like connection errors.
+//
+// Deprecated: use ServeConn(c, h, params) with h from EngineHandler(db, params).
 func ParseMc(c net.Conn, db McEngine, params string) {
-	defer c.Close()
-	p, err := url.ParseQuery(params)
+	cfg, err := cachedParams(params)
 	if err != nil {
-		log.Fatal(err)
-	}
-	//params
-	deadline := "1000"
-	if len(p["deadline"]) > 0 {
-		deadline = p["deadline"][0]
-	}
-	deadlineMs, err := strconv.Atoi(deadline)
-	if err != nil {
-		deadlineMs = 1000
-	}
-	//println("deadline:", deadlineMs)
-	dl := time.Duration(deadlineMs) * time.Millisecond
-
-	buf := "4096"
-	if len(p["buf"]) > 0 {
-		buf = p["buf"][0]
-	}
-	defaultBuffer, err := strconv.Atoi(buf)
-	if err != nil {
-		defaultBuffer = 4096
+		c.Close()
+		connError(c.RemoteAddr(), err)
+		return
 	}
-	//println("buf:", defaultBuffer)
-	for {
-		rw := bufio.NewReadWriter(bufio.NewReaderSize(c, defaultBuffer), bufio.NewWriterSize(c, defaultBuffer))
-		c.SetDeadline(time.Now().Add(dl))
-		line, err := rw.ReadSlice('\n')
+	newConn(c, newEngineHandler(db, cfg), cfg).serve()
+}
 
+// getsByGet serves a multi-get with get of every key and writes VALUE lines
+// and END to rw, because engines write multi-get responses themselves.
+// It is used by engine decorators that must see every value.
+func getsByGet(get func(key []byte, rw *bufio.ReadWriter) ([]byte, bool, error), keys [][]byte, rw *bufio.ReadWriter) (keysvals [][]byte, err error) {
+	for _, key := range keys {
+		value, _, err := get(key, rw)
+		if err == ErrCacheMiss {
+			continue
+		}
 		if err != nil {
-			if err != io.EOF {
-				//network error and so on
-				fmt.Println(err.Error())
-				break
-			} else {
-				println("close conn", err.Error())
-				break //close connection
-			}
+			return keysvals, err
 		}
-		if len(line) > 0 {
-			switch {
-			case bytes.HasPrefix(line, cmdSet), bytes.HasPrefix(line, cmdSetB):
-				//log.Println("set", line)
-				key, flags, exp, size, noreply, err := scanSetLine(line, bytes.HasPrefix(line, cmdSetB))
-				if err != nil || size == -1 {
-					fmt.Println(err, size)
-					_, err = rw.Write(resultError)
-					if err != nil {
-						fmt.Println("error write set error", err.Error())
-						break
-					}
-					err = rw.Flush()
-					if err != nil {
-						fmt.Println("error write set error Flush", err.Error())
-						break
-					}
-					err = nil
-					break
-				}
-				b := make([]byte, size+2)
-				_, err = io.ReadFull(rw, b)
-				if err != nil {
-					fmt.Println(err.Error())
-					break
-				}
-				noreply, err = db.Set([]byte(key), b[:size], flags, exp, size, noreply, rw)
-				if err != nil {
-					fmt.Println(err.Error())
-					break
-				}
-				if !noreply {
-					if err != nil {
-						_, err = rw.Write(resultNotStored)
-						if err != nil {
-							fmt.Println(err.Error())
-							break
-						}
-					} else {
-						_, err = rw.Write(resultStored)
-						if err != nil {
-							fmt.Println(err.Error())
-							break
-						}
-					}
-					if err != nil {
-						fmt.Println(err.Error())
-						break
-					}
-					err = rw.Flush()
-					if err != nil {
-						fmt.Println(err.Error())
-						break
-					}
-				}
-
-			case bytes.HasPrefix(line, cmdGet), bytes.HasPrefix(line, cmdGetB), bytes.HasPrefix(line, cmdGets), bytes.HasPrefix(line, cmdGetsB):
-				cntspace := bytes.Count(line, space)
-				if cntspace == 0 || !bytes.HasSuffix(line, crlf) {
-					fmt.Println("cntspace == 0")
-					err = protocolError(rw)
-					if err != nil {
-						fmt.Println(err.Error())
-						break
-					}
-				}
-
-				if cntspace == 1 {
-					key := line[(bytes.Index(line, space) + 1) : len(line)-2]
-					//log.Println("'" + string(key) + "'")
-					value, noreply, err := db.Get(key, rw)
-					if !noreply && err == nil && value != nil {
-						fmt.Fprintf(rw, "VALUE %s 0 %d\r\n%s\r\n", key, len(value), value)
-					}
-					if !noreply {
-						_, err = rw.Write(resultEnd)
-						if err != nil {
-							fmt.Println(err.Error())
-							break
-						}
-						err = rw.Flush()
-						if err != nil {
-							fmt.Println(err.Error())
-							break
-						}
-					}
-				} else {
-					args := bytes.Split(line[:len(line)-2], space)
-					//strings.Split(string(line), " ")
-					_, err := db.Gets(args[1:], rw)
-					if err != nil {
-						fmt.Println(err.Error())
-						break
-					}
-					/*
-							for i := range kv {
-								if i%2 != 0 {
-									fmt.Fprintf(rw, "VALUE %s 0 %d\r\n%s\r\n", kv[i-1], len(kv[i]), kv[i])
-								}
-							}
-						_, err = rw.Write(resultEnd)
-						if err != nil {
-							fmt.Println(err.Error())
-							break
-						}
-						err = rw.Flush()
-						if err != nil {
-							fmt.Println(err.Error())
-							break
-						}*/
-				}
-
-			case bytes.HasPrefix(line, cmdClose), bytes.HasPrefix(line, cmdCloseB):
-				err = errors.New("Close")
-				break
-
-			case bytes.HasPrefix(line, cmdDelete), bytes.HasPrefix(line, cmdDeleteB):
-				if key, noreply, err := scanDeleteLine(line, bytes.HasPrefix(line, cmdDeleteB)); err == nil {
-					if !noreply {
-						deleted, noreply, _ := db.Delete([]byte(key), rw)
-						if !noreply {
-							if deleted {
-								_, err = rw.Write(resultDeleted)
-							} else {
-								_, err = rw.Write(resultNotFound)
-							}
-							if err != nil {
-								fmt.Println(err.Error())
-								break
-							}
-							err = rw.Flush()
-							if err != nil {
-								fmt.Println(err.Error())
-								break
-							}
-						}
-					}
-				} else {
-					err = protocolError(rw)
-					if err != nil {
-						fmt.Println(err.Error())
-						break
-					}
-				}
-			case bytes.HasPrefix(line, cmdIncr), bytes.HasPrefix(line, cmdIncrB):
-				if key, val, noreply, err := scanIncrDecrLine(line, true, bytes.HasPrefix(line, cmdIncrB)); err == nil {
-					if !noreply {
-						res, isFound, noreply, err := db.Incr([]byte(key), val, rw)
-						if !noreply {
-							if isFound {
-								_, err = fmt.Fprintf(rw, "%d\r\n", res)
-							} else {
-								_, err = rw.Write(resultNotFound)
-							}
-							if err != nil {
-								fmt.Println(err.Error())
-								break
-							}
-							err = rw.Flush()
-							if err != nil {
-								fmt.Println(err.Error())
-								break
-							}
-						}
-					}
-				} else {
-					err = protocolError(rw)
-					if err != nil {
-						fmt.Println(err.Error())
-						break
-					}
-				}
-
-			case bytes.HasPrefix(line, cmdDecr), bytes.HasPrefix(line, cmdDecrB):
-				if key, val, noreply, err := scanIncrDecrLine(line, false, bytes.HasPrefix(line, cmdIncrB)); err == nil {
-					if !noreply {
-						res, isFound, noreply, err := db.Decr([]byte(key), val, rw)
-						if !noreply {
-							if isFound {
-								_, err = fmt.Fprintf(rw, "%d\r\n", res)
-							} else {
-								_, err = rw.Write(resultNotFound)
-							}
-							if err != nil {
-								fmt.Println(err.Error())
-								break
-							}
-							err = rw.Flush()
-							if err != nil {
-								fmt.Println(err.Error())
-								break
-							}
-						}
-					}
-				} else {
-					err = protocolError(rw)
-					if err != nil {
-						fmt.Println(err.Error())
-						break
-					}
-				}
-
-			} //switch
-
-			//check err
-			if err != nil {
-				fmt.Println("check err:", err.Error())
-				if resumableError(err) {
-					fmt.Println(err)
-				} else {
-					break //close connection
-				}
-			}
-
+		if value == nil {
+			continue
+		}
+		keysvals = append(keysvals, key, value)
+		if _, err = fmt.Fprintf(rw, "VALUE %s 0 %d\r\n%s\r\n", key, len(value), value); err != nil {
+			return keysvals, err
 		}
 	}
+	if _, err = rw.Write(resultEnd); err != nil {
+		return
+	}
+	err = rw.Flush()
+	return
 }
 
-// scanSetLine populates it and returns the declared params of the item.
-// It does not read the bytes of the item.
-func scanSetLine(line []byte, isCap bool) (key string, flags uint32, exp int32, size int, noreply bool, err error) {
+// scanSetLine populates it and returns the declared params of the item
+// of a storage command like set. It does not read the bytes of the item.
+func scanSetLine(line []byte, command Command, isCap bool) (key string, flags uint32, exp int32, size int, noreply bool, err error) {
 	//set := ""
 	noreplys := ""
 	noreply = false
-	cmd := "set"
+	cmd := command.String()
 	if isCap {
-		cmd = "SET"
+		cmd = strings.ToUpper(cmd)
 	}
 	pattern := cmd + " %s %d %d %d %s\r\n"
 	dest := []interface{}{&key, &flags, &exp, &size, &noreplys}
@@ -404,10 +251,10 @@ func scanSetLine(line []byte, isCap bool) (key string, flags uint32, exp int32,
 		pattern = cmd + " %s %d %d %d\r\n"
 		dest = dest[:4]
 	}
+	n, err := fmt.Sscanf(string(line), pattern, dest...)
 	if noreplys == "noreply" || noreplys == "NOREPLY" {
 		noreply = true
 	}
-	n, err := fmt.Sscanf(string(line), pattern, dest...)
 	if n != len(dest) {
 		size = -1
 	}
@@ -420,7 +267,7 @@ func scanSetLine(line []byte, isCap bool) (key string, flags uint32, exp int32,
 // connection, unless it was just a cache error.
 func resumableError(err error) bool {
 	switch err {
-	case ErrCacheMiss, ErrCASConflict, ErrNotStored, ErrMalformedKey:
+	case ErrCacheMiss, ErrCASConflict, ErrNotStored, ErrMalformedKey, ErrUnsupported, ErrBadRequest:
 		return true
 	}
 	return false
@@ -463,10 +310,10 @@ func scanDeleteLine(line []byte, isCap bool) (key string, noreply bool, err erro
 		pattern = cmd + " %s\r\n"
 		dest = dest[:1]
 	}
+	n, err := fmt.Sscanf(string(line), pattern, dest...)
 	if noreplys == "noreply" || noreplys == "NOREPLY" {
 		noreply = true
 	}
-	n, err := fmt.Sscanf(string(line), pattern, dest...)
 	if n != len(dest) {
 		err = errors.New(string(resultError))
 	}
@@ -496,12 +343,165 @@ func scanIncrDecrLine(line []byte, incr bool, isCap bool) (key string, val uint6
 		pattern = cmd + " %s %d\r\n"
 		dest = dest[:2]
 	}
+	n, err := fmt.Sscanf(string(line), pattern, dest...)
 	if noreplys == "noreply" || noreplys == "NOREPLY" {
 		noreply = true
 	}
-	n, err := fmt.Sscanf(string(line), pattern, dest...)
 	if n != len(dest) {
 		err = errors.New(string(resultError))
 	}
 	return
 }
+
+// scanScanLine parses: scan <cursor> [match <prefix>] [count <n>]
+func scanScanLine(line []byte) (cursor uint64, match []byte, count int, err error) {
+	errFormat := errors.New("bad command line format")
+	if !bytes.HasSuffix(line, crlf) {
+		err = errFormat
+		return
+	}
+	args := bytes.Fields(line)
+	if len(args) < 2 || len(args)%2 != 0 {
+		err = errFormat
+		return
+	}
+	cursor, err = strconv.ParseUint(string(args[1]), 10, 64)
+	if err != nil {
+		err = errFormat
+		return
+	}
+	count = defaultScanCount
+	for i := 2; i < len(args); i += 2 {
+		switch string(bytes.ToLower(args[i])) {
+		case "match":
+			match = args[i+1]
+		case "count":
+			count, err = strconv.Atoi(string(args[i+1]))
+			if err != nil || count <= 0 {
+				err = errFormat
+				return
+			}
+		default:
+			err = errFormat
+			return
+		}
+	}
+	return
+}
+
+// scan writes one batch of keys from a Scanner engine as:
+// KEY <key>\r\n ... CURSOR <next>\r\nEND\r\n
+func scan(line []byte, db McEngine, rw *bufio.ReadWriter) (err error) {
+	ss, streams := db.(ScanStreamer)
+	sc, ok := db.(Scanner)
+	if !ok && !streams {
+		return protocolError(rw)
+	}
+	cursor, match, count, err := scanScanLine(line)
+	if err != nil {
+		return clientError(rw, err.Error())
+	}
+	if streams {
+		return streamScan(ss, cursor, match, count, rw)
+	}
+	keys, next, err := sc.Scan(cursor, match, count)
+	if err != nil {
+		return engineError(rw, err)
+	}
+	for _, key := range keys {
+		if _, err = fmt.Fprintf(rw, "KEY %s\r\n", key); err != nil {
+			return
+		}
+	}
+	if _, err = fmt.Fprintf(rw, "CURSOR %d\r\n", next); err != nil {
+		return
+	}
+	if _, err = rw.Write(resultEnd); err != nil {
+		return
+	}
+	return rw.Flush()
+}
+
+// clientError writes CLIENT_ERROR <msg>
+func clientError(rw *bufio.ReadWriter, msg string) (err error) {
+	return writeError(rw, resultClientErrorPrefix, msg)
+}
+
+// engineError answers a failed engine call: ERROR for ErrUnsupported,
+// CLIENT_ERROR for ErrBadRequest and SERVER_ERROR <err> otherwise
+func engineError(rw *bufio.ReadWriter, err error) error {
+	switch err {
+	case ErrUnsupported:
+		return protocolError(rw)
+	case ErrBadRequest:
+		return clientError(rw, "bad request")
+	}
+	return serverError(rw, err.Error())
+}
+
+// refused reports whether an engine refused a command, see engineError
+func refused(err error) bool {
+	return err == ErrUnsupported || err == ErrBadRequest
+}
+
+// serverError writes SERVER_ERROR <msg>
+func serverError(rw *bufio.ReadWriter, msg string) (err error) {
+	return writeError(rw, resultServerErrorPrefix, msg)
+}
+
+func writeError(rw *bufio.ReadWriter, prefix []byte, msg string) (err error) {
+	if _, err = rw.Write(prefix); err != nil {
+		return
+	}
+	if _, err = rw.WriteString(msg); err != nil {
+		return
+	}
+	if _, err = rw.Write(crlf); err != nil {
+		return
+	}
+	return rw.Flush()
+}
+
+// ttl writes TTL <seconds> for: ttl <key>
+func ttl(line []byte, db McEngine, rw *bufio.ReadWriter) (err error) {
+	t, ok := db.(TTLer)
+	if !ok {
+		return protocolError(rw)
+	}
+	args := bytes.Fields(line)
+	if len(args) != 2 || !bytes.HasSuffix(line, crlf) {
+		return clientError(rw, "bad command line format")
+	}
+	sec, err := t.TTL(args[1])
+	if err != nil {
+		return engineError(rw, err)
+	}
+	if _, err = fmt.Fprintf(rw, "TTL %d\r\n", sec); err != nil {
+		return
+	}
+	return rw.Flush()
+}
+
+// hit accounts a key found by a retrieval command and touches it, see touchOnRead
+func (h *engineHandler) hit(key []byte) {
+	getHits.inc()
+	touchOnRead(h.cfg, h.db, key)
+}
+
+// touchOnRead extends the lifetime of a hit key if it matches a slide rule
+// and the engine implements Toucher.
+// The engine does not report the original exptime of an item,
+// so the lifetime comes from the rule.
+func touchOnRead(cfg *config, db McEngine, key []byte) {
+	exp := cfg.slideExp(key)
+	if exp == 0 {
+		return
+	}
+	t, ok := db.(Toucher)
+	if !ok {
+		return
+	}
+	if _, err := t.Touch(key, exp); err != nil {
+		connError(nil, err)
+	}
+}
@@ -2,17 +2,43 @@ package mcproto_test
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/recoilme/mcproto"
 )
 
 type mapStore struct {
 	sync.RWMutex
-	m map[string]string
+	m       map[string]string
+	touched map[string]int32
 }
 
 func newStore() mcproto.McEngine {
@@ -20,6 +46,7 @@ func newStore() mcproto.McEngine {
 	eng.Lock()
 	defer eng.Unlock()
 	eng.m = make(map[string]string)
+	eng.touched = make(map[string]int32)
 	return eng
 }
 
@@ -27,11 +54,23 @@ func newStore() mcproto.McEngine {
 func (en *mapStore) Get(key []byte, rw *bufio.ReadWriter) (value []byte, noreply bool, err error) {
 	en.RLock()
 	defer en.RUnlock()
-	value = []byte(en.m[string(key)])
+	if v, ok := en.m[string(key)]; ok {
+		value = []byte(v)
+	}
 	return
 }
 
-func (en *mapStore) Gets(keys [][]byte, rw *bufio.ReadWriter) (err error) {
+func (en *mapStore) Gets(keys [][]byte, rw *bufio.ReadWriter) (keysvals [][]byte, err error) {
+	en.RLock()
+	defer en.RUnlock()
+	for _, key := range keys {
+		if v, ok := en.m[string(key)]; ok {
+			keysvals = append(keysvals, key, []byte(v))
+			fmt.Fprintf(rw, "VALUE %s 0 %d\r\n%s\r\n", key, len(v), v)
+		}
+	}
+	rw.WriteString("END\r\n")
+	err = rw.Flush()
 	return
 }
 
@@ -43,14 +82,42 @@ func (en *mapStore) Set(key, value []byte, flags uint32, exp int32, size int, no
 }
 
 func (en *mapStore) Incr(key []byte, value uint64, rw *bufio.ReadWriter) (result uint64, isFound bool, noreply bool, err error) {
-	return
+	return en.add(key, value, true)
 }
 
 func (en *mapStore) Decr(key []byte, value uint64, rw *bufio.ReadWriter) (result uint64, isFound bool, noreply bool, err error) {
+	return en.add(key, value, false)
+}
+
+// add increments or decrements a numeric value, decr stops at 0 like memcached
+func (en *mapStore) add(key []byte, value uint64, incr bool) (result uint64, isFound bool, noreply bool, err error) {
+	en.Lock()
+	defer en.Unlock()
+	v, isFound := en.m[string(key)]
+	if !isFound {
+		return
+	}
+	if result, err = strconv.ParseUint(v, 10, 64); err != nil {
+		return
+	}
+	switch {
+	case incr:
+		result += value
+	case value > result:
+		result = 0
+	default:
+		result -= value
+	}
+	en.m[string(key)] = strconv.FormatUint(result, 10)
 	return
 }
 
 func (en *mapStore) Delete(key []byte, rw *bufio.ReadWriter) (isFound bool, noreply bool, err error) {
+	en.Lock()
+	defer en.Unlock()
+	if _, isFound = en.m[string(key)]; isFound {
+		delete(en.m, string(key))
+	}
 	return
 }
 
@@ -58,6 +125,112 @@ func (en *mapStore) Close() (err error) {
 	return
 }
 
+// Scan walks keys in sorted order, cursor is the offset of the next key
+func (en *mapStore) Scan(cursor uint64, match []byte, count int) (keys [][]byte, next uint64, err error) {
+	en.RLock()
+	defer en.RUnlock()
+	all := make([]string, 0, len(en.m))
+	for k := range en.m {
+		if strings.HasPrefix(k, string(match)) {
+			all = append(all, k)
+		}
+	}
+	sort.Strings(all)
+	for i := int(cursor); i < len(all) && len(keys) < count; i++ {
+		keys = append(keys, []byte(all[i]))
+		next = uint64(i + 1)
+	}
+	if next >= uint64(len(all)) {
+		next = 0
+	}
+	return
+}
+
+// TTL reports -1 for stored keys, mapStore has no expiration
+func (en *mapStore) TTL(key []byte) (ttl int64, err error) {
+	en.RLock()
+	defer en.RUnlock()
+	if _, ok := en.m[string(key)]; !ok {
+		return -2, nil
+	}
+	return -1, nil
+}
+
+// Touch records the last exptime of key
+func (en *mapStore) Touch(key []byte, exp int32) (isFound bool, err error) {
+	en.Lock()
+	defer en.Unlock()
+	if _, isFound = en.m[string(key)]; isFound {
+		en.touched[string(key)] = exp
+	}
+	return
+}
+
+func (en *mapStore) Update(key []byte, fn func(value []byte) ([]byte, error)) error {
+	en.Lock()
+	defer en.Unlock()
+	v, ok := en.m[string(key)]
+	if !ok {
+		return mcproto.ErrCacheMiss
+	}
+	value, err := fn([]byte(v))
+	if err == nil {
+		en.m[string(key)] = string(value)
+	}
+	return err
+}
+
+func (en *mapStore) Add(key, value []byte, flags uint32, exp int32) error {
+	return en.store(key, value, false)
+}
+
+func (en *mapStore) Replace(key, value []byte, flags uint32, exp int32) error {
+	return en.store(key, value, true)
+}
+
+func (en *mapStore) Append(key, value []byte) error {
+	return notStored(en.Update(key, func(v []byte) ([]byte, error) { return append(v, value...), nil }))
+}
+
+func (en *mapStore) Prepend(key, value []byte) error {
+	return notStored(en.Update(key, func(v []byte) ([]byte, error) { return append(append([]byte(nil), value...), v...), nil }))
+}
+
+func notStored(err error) error {
+	if err == mcproto.ErrCacheMiss {
+		return mcproto.ErrNotStored
+	}
+	return err
+}
+
+// store sets key if its existence is exists
+func (en *mapStore) store(key, value []byte, exists bool) error {
+	en.Lock()
+	defer en.Unlock()
+	if _, ok := en.m[string(key)]; ok != exists {
+		return mcproto.ErrNotStored
+	}
+	en.m[string(key)] = string(value)
+	return nil
+}
+
+// Dump iterates items in sorted key order
+func (en *mapStore) Dump(fn func(item mcproto.Item) error) error {
+	en.RLock()
+	defer en.RUnlock()
+	keys := make([]string, 0, len(en.m))
+	for k := range en.m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := fn(mcproto.Item{Key: []byte(k), Value: []byte(en.m[k])}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func Test_Store(t *testing.T) {
 	db := newStore()
 	db.Set([]byte("1"), []byte("2"), 0, 0, 1, false, nil)
@@ -71,6 +244,67 @@ func Test_Store(t *testing.T) {
 	}
 }
 
+// serve starts ParseMc on a random local port
+func serve(t *testing.T, db mcproto.McEngine, params string) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go mcproto.ParseMc(conn, db, params)
+		}
+	}()
+	return listener
+}
+
+// serveHandler starts ServeConn with h on a random local port
+func serveHandler(t *testing.T, h mcproto.Handler) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go mcproto.ServeConn(conn, h, "")
+		}
+	}()
+	return listener
+}
+
+// call sends cmd and reads lines response lines
+func call(t *testing.T, conn net.Conn, r *bufio.Reader, cmd string, lines int) string {
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Write([]byte(cmd)); err != nil {
+		t.Fatal(err)
+	}
+	var resp bytes.Buffer
+	for i := 0; i < lines; i++ {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("%q: %v (got %q)", cmd, err, resp.String())
+		}
+		resp.WriteString(line)
+	}
+	return resp.String()
+}
+
+func dial(t *testing.T, listener net.Listener) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, bufio.NewReader(conn)
+}
+
 /*
 telnet 127.0.0.1 11212
 Trying 127.0.0.1...
@@ -88,27 +322,3255 @@ END
 */
 func Test_Listen(t *testing.T) {
 	db := newStore()
+	listener := serve(t, db, "")
+	defer listener.Close()
+
+	conn, r := dial(t, listener)
+	defer conn.Close()
+
+	if resp := call(t, conn, r, "set hello\r\n", 1); resp != "ERROR\r\n" {
+		t.Errorf("Expected ERROR, got:%q", resp)
+	}
+	if resp := call(t, conn, r, "set key 0 0 5\r\nvalue\r\n", 1); resp != "STORED\r\n" {
+		t.Errorf("Expected STORED, got:%q", resp)
+	}
+	if resp := call(t, conn, r, "get key\r\n", 3); resp != "VALUE key 0 5\r\nvalue\r\nEND\r\n" {
+		t.Errorf("Expected value, got:%q", resp)
+	}
+}
+
+func Test_Scan(t *testing.T) {
+	db := newStore()
+	for _, k := range []string{"a:1", "a:2", "a:3", "b:1"} {
+		db.Set([]byte(k), []byte("v"), 0, 0, 1, false, nil)
+	}
+	listener := serve(t, db, "")
+	defer listener.Close()
+
+	conn, r := dial(t, listener)
+	defer conn.Close()
+
+	if resp := call(t, conn, r, "scan 0 match a: count 2\r\n", 4); resp != "KEY a:1\r\nKEY a:2\r\nCURSOR 2\r\nEND\r\n" {
+		t.Errorf("first batch, got:%q", resp)
+	}
+	if resp := call(t, conn, r, "scan 2 match a: count 2\r\n", 3); resp != "KEY a:3\r\nCURSOR 0\r\nEND\r\n" {
+		t.Errorf("last batch, got:%q", resp)
+	}
+	if resp := call(t, conn, r, "scan 0 count\r\n", 1); !strings.HasPrefix(resp, "CLIENT_ERROR") {
+		t.Errorf("Expected CLIENT_ERROR, got:%q", resp)
+	}
+}
+
+func Test_TTL(t *testing.T) {
+	db := newStore()
+	db.Set([]byte("key"), []byte("v"), 0, 0, 1, false, nil)
+	listener := serve(t, db, "")
+	defer listener.Close()
+
+	conn, r := dial(t, listener)
+	defer conn.Close()
+
+	if resp := call(t, conn, r, "ttl key\r\n", 1); resp != "TTL -1\r\n" {
+		t.Errorf("Expected TTL -1, got:%q", resp)
+	}
+	if resp := call(t, conn, r, "ttl missing\r\n", 1); resp != "TTL -2\r\n" {
+		t.Errorf("Expected TTL -2, got:%q", resp)
+	}
+}
+
+func Test_TouchOnRead(t *testing.T) {
+	db := newStore()
+	db.Set([]byte("sess:1"), []byte("v"), 0, 0, 1, false, nil)
+	db.Set([]byte("page:1"), []byte("v"), 0, 0, 1, false, nil)
+	listener := serve(t, db, "slide=60:sess:")
+	defer listener.Close()
+
+	conn, r := dial(t, listener)
+	defer conn.Close()
+
+	call(t, conn, r, "get sess:1\r\n", 3)
+	call(t, conn, r, "get page:1\r\n", 3)
+
+	ms := db.(*mapStore)
+	ms.RLock()
+	defer ms.RUnlock()
+	if exp := ms.touched["sess:1"]; exp != 60 {
+		t.Errorf("Expected sess:1 touched with 60, got:%d", exp)
+	}
+	if _, ok := ms.touched["page:1"]; ok {
+		t.Errorf("Expected page:1 untouched")
+	}
+}
+
+func Test_Tombstone(t *testing.T) {
+	db := mcproto.NewTombstoneEngine(newStore(), 50*time.Millisecond)
+	db.Set([]byte("key"), []byte("v"), 0, 0, 1, false, nil)
+	if found, _, _ := db.Delete([]byte("key"), nil); !found {
+		t.Fatal("Expected key deleted")
+	}
+	if !db.Tombstoned([]byte("key")) {
+		t.Error("Expected tombstone after delete")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if db.Tombstoned([]byte("key")) {
+		t.Error("Expected tombstone expired")
+	}
+
+	db.Set([]byte("key"), []byte("v"), 0, 0, 1, false, nil)
+	db.Delete([]byte("key"), nil)
+	db.Set([]byte("key"), []byte("v2"), 0, 0, 2, false, nil)
+	if db.Tombstoned([]byte("key")) {
+		t.Error("Expected set to clear tombstone")
+	}
+	if val, _, _ := db.Get([]byte("key"), nil); string(val) != "v2" {
+		t.Errorf("Expected v2, got:%s", val)
+	}
+}
+
+func Test_Migrate(t *testing.T) {
+	old, new := newStore(), newStore()
+	old.Set([]byte("old"), []byte("1"), 0, 0, 1, false, nil)
+	db := mcproto.NewMigrateEngine(old, new)
+
+	if val, _, _ := db.Get([]byte("old"), nil); string(val) != "1" {
+		t.Errorf("Expected fallback to old, got:%s", val)
+	}
+	db.Set([]byte("both"), []byte("2"), 0, 0, 1, false, nil)
+	for _, e := range []mcproto.McEngine{old, new} {
+		if val, _, _ := e.Get([]byte("both"), nil); string(val) != "2" {
+			t.Errorf("Expected write to both engines, got:%s", val)
+		}
+	}
+	st := db.Stats()
+	if st.Reads != 1 || st.Fallbacks != 1 || st.OldHits != 1 || st.Writes != 1 {
+		t.Errorf("Unexpected stats: %+v", st)
+	}
+
+	db.Cutover()
+	if val, _, _ := db.Get([]byte("old"), nil); val != nil {
+		t.Errorf("Expected miss after cutover, got:%s", val)
+	}
+	db.Set([]byte("new"), []byte("3"), 0, 0, 1, false, nil)
+	if val, _, _ := old.Get([]byte("new"), nil); val != nil {
+		t.Errorf("Expected no write to old after cutover, got:%s", val)
+	}
+
+	// a New engine answering misses with ErrCacheMiss falls back too
+	db = mcproto.NewMigrateEngine(old, nilStore{newStore().(*mapStore)})
+	if val, _, err := db.Get([]byte("old"), nil); string(val) != "1" || err != nil {
+		t.Errorf("Expected fallback on ErrCacheMiss, got:%s %v", val, err)
+	}
+	if val, _, _ := db.Get([]byte("none"), nil); val != nil {
+		t.Errorf("Expected miss in both, got:%s", val)
+	}
+	if st := db.Stats(); st.Fallbacks != 2 || st.OldHits != 1 {
+		t.Errorf("Unexpected stats: %+v", st)
+	}
+}
+
+func Test_Backup(t *testing.T) {
+	db := newStore()
+	db.Set([]byte("a"), []byte("1"), 0, 0, 1, false, nil)
+	db.Set([]byte("b"), []byte("22"), 0, 0, 2, false, nil)
+	listener := serve(t, db, "")
+	defer listener.Close()
+
+	conn, r := dial(t, listener)
+	defer conn.Close()
+
+	resp := call(t, conn, r, "backup\r\n", 5)
+	if resp != "ITEM a 0 0 1\r\n1\r\nITEM b 0 0 2\r\n22\r\nEND\r\n" {
+		t.Fatalf("Unexpected backup:%q", resp)
+	}
+	restored := newStore()
+	n, err := mcproto.RestoreFrom(strings.NewReader(resp), restored)
+	if err != nil || n != 2 {
+		t.Fatalf("Expected 2 items restored, got:%d %v", n, err)
+	}
+	if val, _, _ := restored.Get([]byte("b"), nil); string(val) != "22" {
+		t.Errorf("Expected 22, got:%s", val)
+	}
+	if _, err = mcproto.RestoreFrom(strings.NewReader("ITEM a 0 0 1\r\n1\r\n"), restored); err != mcproto.ErrBadBackup {
+		t.Errorf("Expected ErrBadBackup on truncated stream, got:%v", err)
+	}
+}
+
+func Test_Preload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mcproto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dump")
+	// a dump written 100 seconds ago with a truncated tail
+	dump := "ITEM a 0 0 1\r\n1\r\nITEM old 0 50 1\r\n2\r\nITEM b 0 1000 2\r\n22\r\nITEM c 0 0 5\r\n33"
+	if err = ioutil.WriteFile(path, []byte(dump), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ago := time.Now().Add(-100 * time.Second)
+	os.Chtimes(path, ago, ago)
+	quiet := func(string, ...interface{}) {}
+
+	if _, err = (mcproto.Preload{Path: path, Logf: quiet}).Load(newStore()); err != io.ErrUnexpectedEOF {
+		t.Fatalf("strict load of a truncated dump: %v", err)
+	}
+	db := newStore()
+	stats, err := mcproto.Preload{Path: path, Partial: true, Logf: quiet}.Load(db)
+	if err != nil || stats.Items != 2 || stats.Err != io.ErrUnexpectedEOF {
+		t.Fatalf("partial load: %+v %v", stats, err)
+	}
+	if val, _, _ := db.Get([]byte("b"), nil); string(val) != "22" {
+		t.Fatalf("b: %q", val)
+	}
+	if val, _, _ := db.Get([]byte("old"), nil); val != nil {
+		t.Fatalf("expired item loaded: %q", val)
+	}
+	if stats, err = (mcproto.Preload{Path: filepath.Join(dir, "none"), Logf: quiet}).Load(db); err != nil || stats.Items != 0 {
+		t.Fatalf("missing file: %+v %v", stats, err)
+	}
+}
 
-	listener, err := net.Listen("tcp", ":11212")
+func Test_Snapshots(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mcproto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db := newStore()
+	db.Set([]byte("a"), []byte("1"), 0, 0, 1, false, nil)
+	quiet := func(string, ...interface{}) {}
+	snaps, err := mcproto.StartSnapshots(db, mcproto.SnapshotPolicy{Dir: dir, Interval: 10 * time.Millisecond, Keep: 2, Logf: quiet})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	db.Set([]byte("b"), []byte("22"), 0, 0, 2, false, nil)
+	if err = snaps.Close(); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "snapshot-*"))
+	if len(files) != 2 {
+		t.Fatalf("retention: %v", files)
+	}
+	latest, err := mcproto.LatestSnapshot(dir)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
+	}
+	restored := newStore()
+	if stats, err := (mcproto.Preload{Path: latest, Logf: quiet}).Load(restored); err != nil || stats.Items != 2 {
+		t.Fatalf("final snapshot: %+v %v", stats, err)
 	}
+}
+
+func Test_AntiEntropy(t *testing.T) {
+	remote := newStore()
+	for k, v := range map[string]string{"a": "1", "b": "2", "c": "3", "d": "4"} {
+		remote.Set([]byte(k), []byte(v), 0, 0, len(v), false, nil)
+	}
+	listener := serve(t, remote, "")
 	defer listener.Close()
+	conn, r := dial(t, listener)
+	if got := call(t, conn, r, "digest 0\r\n", 1); got != "CLIENT_ERROR bad command line format\r\n" {
+		t.Fatalf("digest 0: %q", got)
+	}
+	conn.Close()
 
-	// start
-	for {
+	local := newStore()
+	local.Set([]byte("a"), []byte("1"), 0, 0, 1, false, nil)
+	local.Set([]byte("b"), []byte("stale"), 0, 0, 5, false, nil)
+	conn, _ = dial(t, listener)
+	defer conn.Close()
+	stats, err := mcproto.SyncFrom(conn, local, 64)
+	if err != nil || stats.Differing == 0 {
+		t.Fatalf("sync: %+v %v", stats, err)
+	}
+	ours, _ := mcproto.Digests(local, 64)
+	theirs, _ := mcproto.Digests(remote, 64)
+	if !reflect.DeepEqual(ours, theirs) {
+		t.Fatalf("not converged: %v != %v", ours, theirs)
+	}
+	items := stats.Items
+	if stats, err = mcproto.SyncFrom(conn, local, 64); err != nil || stats.Differing != 0 || items > 3 {
+		t.Fatalf("converged sync: %+v %v, first pass stored %d", stats, err, items)
+	}
+}
 
-		conn, err := listener.Accept()
+// slowStore blocks Get until unblock is closed
+type slowStore struct {
+	mcproto.McEngine
+	unblock chan struct{}
+}
 
-		if err != nil {
-			fmt.Println("conn", err)
-			conn.Close()
-			continue
+func (en *slowStore) Get(key []byte, rw *bufio.ReadWriter) (value []byte, noreply bool, err error) {
+	<-en.unblock
+	return en.McEngine.Get(key, rw)
+}
+
+func (en *slowStore) TTL(key []byte) (ttl int64, err error) {
+	return en.McEngine.(mcproto.TTLer).TTL(key)
+}
+
+func Test_InflightLimit(t *testing.T) {
+	mcproto.SetInflightLimit(1, 1)
+	defer mcproto.SetInflightLimit(0, 0)
+	db := &slowStore{McEngine: newStore(), unblock: make(chan struct{})}
+	listener := serve(t, db, "")
+	defer listener.Close()
+
+	busy, _ := dial(t, listener)
+	defer busy.Close()
+	busy.Write([]byte("get key\r\n"))
+
+	waiting, waitingR := dial(t, listener)
+	defer waiting.Close()
+	waiting.Write([]byte("get key\r\n"))
+
+	admin, adminR := dial(t, listener)
+	defer admin.Close()
+	if resp := call(t, admin, adminR, "ttl key\r\n", 1); resp != "TTL -2\r\n" {
+		t.Errorf("Expected admin lane to respond, got:%q", resp)
+	}
+	close(db.unblock)
+	waiting.SetDeadline(time.Now().Add(time.Second))
+	if resp, err := waitingR.ReadString('\n'); err != nil || resp != "END\r\n" {
+		t.Errorf("Expected queued get to finish, got:%q %v", resp, err)
+	}
+}
+
+func Test_Shed(t *testing.T) {
+	// any test process runs more than 2 goroutines, so all data commands are shed
+	mcproto.SetShedPolicy(mcproto.ShedPolicy{MaxGoroutines: 1})
+	defer mcproto.SetShedPolicy(mcproto.ShedPolicy{})
+	db := newStore()
+	listener := serve(t, db, "")
+	defer listener.Close()
+
+	conn, r := dial(t, listener)
+	defer conn.Close()
+
+	if resp := call(t, conn, r, "get key\r\n", 1); resp != "SERVER_ERROR busy\r\n" {
+		t.Errorf("Expected get shed, got:%q", resp)
+	}
+	if resp := call(t, conn, r, "set key 0 0 1\r\n1\r\n", 1); resp != "SERVER_ERROR busy\r\n" {
+		t.Errorf("Expected set shed, got:%q", resp)
+	}
+	for _, req := range []string{"gat 10 key\r\n", "mg key v\r\n", "GET key\r\n"} {
+		if resp := call(t, conn, r, req, 1); resp != "SERVER_ERROR busy\r\n" {
+			t.Errorf("Expected %q shed, got:%q", req, resp)
+		}
+	}
+	for _, req := range []string{"ttl key\r\n", "TTL key\r\n"} {
+		if resp := call(t, conn, r, req, 1); resp != "TTL -2\r\n" {
+			t.Errorf("Expected admin command %q served, got:%q", req, resp)
 		}
-		go mcproto.ParseMc(conn, db, "") //listen(conn, db)
+	}
+	if st := mcproto.Shed(); st.Level != 2 || st.Retrieval != 4 || st.Other != 1 {
+		t.Errorf("Unexpected shed stats: %+v", st)
+	}
+}
+
+func Test_ShedStepDown(t *testing.T) {
+	db := newStore()
+	listener := serve(t, db, "")
+	defer listener.Close()
+	conn, r := dial(t, listener)
+	defer conn.Close()
+	call(t, conn, r, "version\r\n", 1)
+
+	// the load is goroutines over MaxGoroutines: 2.5, then 0.9
+	base := runtime.NumGoroutine()
+	max := (base + 50) * 2
+	mcproto.SetShedPolicy(mcproto.ShedPolicy{MaxGoroutines: max})
+	defer mcproto.SetShedPolicy(mcproto.ShedPolicy{})
+	stay, leave := make(chan struct{}), make(chan struct{})
+	defer close(stay)
+	for i := base; i < max*9/10; i++ {
+		go func() { <-stay }()
+	}
+	for i := max * 9 / 10; i < max*5/2; i++ {
+		go func() { <-leave }()
+	}
+	if resp := call(t, conn, r, "set key 0 0 1\r\n1\r\n", 1); resp != "SERVER_ERROR busy\r\n" {
+		t.Fatalf("Expected set shed at load 2.5, got:%q", resp)
+	}
+	if st := mcproto.Shed(); st.Level != 2 {
+		t.Fatalf("Expected level 2, got:%+v", st)
+	}
+
+	close(leave)
+	for runtime.NumGoroutine() > max*9/10+5 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(150 * time.Millisecond) // the level is evaluated every 100ms
+	if resp := call(t, conn, r, "set key 0 0 1\r\n1\r\n", 1); resp != "STORED\r\n" {
+		t.Errorf("Expected set served at load 0.9, got:%q", resp)
+	}
+	if resp := call(t, conn, r, "get key\r\n", 1); resp != "SERVER_ERROR busy\r\n" {
+		t.Errorf("Expected get shed at level 1, got:%q", resp)
+	}
+	if st := mcproto.Shed(); st.Level != 1 {
+		t.Errorf("Expected level 1, got:%+v", st)
+	}
+}
+
+func Test_KeyspaceSampler(t *testing.T) {
+	db := newStore()
+	for _, k := range []string{"sess:1", "sess:2", "page:1"} {
+		db.Set([]byte(k), []byte("12345"), 0, 0, 5, false, nil)
+	}
+	ks, err := mcproto.NewKeyspaceSampler(db, 1, ':')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ks.Sample(); err != nil {
+		t.Fatal(err)
+	}
+	db.Delete([]byte("sess:1"), nil)
+	if err = ks.Sample(); err != nil {
+		t.Fatal(err)
+	}
+	report := ks.Report()
+	if len(report) != 2 || report[1].Prefix != "sess" {
+		t.Fatalf("Unexpected report: %+v", report)
+	}
+	sess := report[1]
+	if sess.Items != 1 || sess.Bytes != 11 || sess.TTL["never"] != 1 || sess.Churn != 0.5 {
+		t.Errorf("Unexpected sess stats: %+v", sess)
+	}
+}
+
+// expStore records exptimes of stored values
+type expStore struct {
+	mcproto.McEngine
+	exp map[string]int32
+}
+
+func (en *expStore) Set(key, value []byte, flags uint32, exp int32, size int, noreply bool, rw *bufio.ReadWriter) (noreplyresp bool, err error) {
+	en.exp[string(key)] = exp
+	return en.McEngine.Set(key, value, flags, exp, size, noreply, rw)
+}
+
+func Test_Policy(t *testing.T) {
+	store := &expStore{McEngine: newStore(), exp: make(map[string]int32)}
+	db := mcproto.NewPolicyEngine(store,
+		mcproto.PrefixPolicy{Prefix: "sess:", MinTTL: 60, MaxTTL: 3600, MaxValueSize: 10},
+		mcproto.PrefixPolicy{Prefix: "page:", Compress: true},
+	)
+	listener := serve(t, db, "")
+	defer listener.Close()
+
+	conn, r := dial(t, listener)
+	defer conn.Close()
+
+	call(t, conn, r, "set sess:1 0 0 1\r\n1\r\n", 1)
+	call(t, conn, r, "set sess:2 0 5 1\r\n1\r\n", 1)
+	if store.exp["sess:1"] != 3600 || store.exp["sess:2"] != 60 {
+		t.Errorf("Expected clamped exptimes, got:%v", store.exp)
+	}
+	if resp := call(t, conn, r, "set sess:3 0 0 11\r\n01234567890\r\n", 1); resp != "SERVER_ERROR object too large for cache\r\n" {
+		t.Errorf("Expected too large, got:%q", resp)
+	}
+
+	page := strings.Repeat("fragment", 100)
+	call(t, conn, r, "set page:1 0 0 800\r\n"+page+"\r\n", 1)
+	if raw, _, _ := store.Get([]byte("page:1"), nil); len(raw) >= len(page) {
+		t.Errorf("Expected compressed value, got %d bytes", len(raw))
+	}
+	if resp := call(t, conn, r, "get page:1\r\n", 3); resp != "VALUE page:1 0 800\r\n"+page+"\r\nEND\r\n" {
+		t.Errorf("Expected inflated value, got:%q", resp)
+	}
+	// values looking compressed are returned as stored without Compress
+	call(t, conn, r, "set sess:4 0 0 7\r\n\x00mcz1ab\r\n", 1)
+	if resp := call(t, conn, r, "get sess:4\r\n", 3); resp != "VALUE sess:4 0 7\r\n\x00mcz1ab\r\nEND\r\n" {
+		t.Errorf("Expected value as stored, got:%q", resp)
+	}
+}
+
+func Test_ExpClamp(t *testing.T) {
+	store := &expStore{McEngine: newStore(), exp: make(map[string]int32)}
+	listener := serve(t, store, "minexp=10&maxexp=100")
+	defer listener.Close()
+
+	conn, r := dial(t, listener)
+	defer conn.Close()
+
+	call(t, conn, r, "set forever 0 0 1\r\n1\r\n", 1)
+	call(t, conn, r, "set short 0 1 1\r\n1\r\n", 1)
+	abs := time.Now().Unix() + 50
+	call(t, conn, r, "set abs 0 "+strconv.FormatInt(abs, 10)+" 1\r\n1\r\n", 1)
+	if store.exp["forever"] != 100 || store.exp["short"] != 10 {
+		t.Errorf("Expected clamped exptimes, got:%v", store.exp)
+	}
+	if exp := store.exp["abs"]; exp < 49 || exp > 50 {
+		t.Errorf("Expected absolute exptime normalized to ~50, got:%d", exp)
 	}
 }
 
-//func listen(c net.Conn, db mcproto.McEngine) {
-//mcproto.ParseMc(c, db, "")
-//}
+func Test_Canary(t *testing.T) {
+	old, new := newStore(), newStore()
+	db := mcproto.NewCanaryEngine(old, new, 30)
+	keys := make([][]byte, 1000)
+	for i := range keys {
+		keys[i] = []byte("key" + strconv.Itoa(i))
+		db.Set(keys[i], []byte("v"), 0, 0, 1, false, nil)
+	}
+	inNew := 0
+	for _, k := range keys {
+		if v, _, _ := new.Get(k, nil); v != nil {
+			inNew++
+		}
+		if v, _, _ := db.Get(k, nil); v == nil {
+			t.Fatalf("Expected %s routed to the same engine", k)
+		}
+	}
+	if inNew < 200 || inNew > 400 {
+		t.Errorf("Expected ~30%% of keys in new engine, got:%d", inNew)
+	}
+	oldStats, newStats := db.Stats()
+	if newStats.Hits != uint64(inNew) || oldStats.Hits != uint64(1000-inNew) {
+		t.Errorf("Unexpected route stats: old %+v new %+v", oldStats, newStats)
+	}
+}
+
+func Test_CanaryCacheMiss(t *testing.T) {
+	// engines answering misses with ErrCacheMiss count misses, not errors
+	db := mcproto.NewCanaryEngine(nilStore{newStore().(*mapStore)}, nilStore{newStore().(*mapStore)}, 50)
+	for i := 0; i < 100; i++ {
+		db.Get([]byte("key"+strconv.Itoa(i)), nil)
+	}
+	oldStats, newStats := db.Stats()
+	if oldStats.Errors+newStats.Errors != 0 || oldStats.Misses+newStats.Misses != 100 {
+		t.Errorf("Unexpected route stats: old %+v new %+v", oldStats, newStats)
+	}
+}
+
+func Test_Events(t *testing.T) {
+	events := make(chan mcproto.Event, 16)
+	unsubscribe := mcproto.Subscribe(func(e mcproto.Event) {
+		select {
+		case events <- e:
+		default:
+		}
+	})
+	defer unsubscribe()
+
+	db := newStore()
+	listener := serve(t, db, "")
+	defer listener.Close()
+
+	conn, r := dial(t, listener)
+	call(t, conn, r, "get key\r\n", 1)
+	local := conn.LocalAddr().String()
+	conn.Close()
+
+	var got []string
+	timeout := time.After(time.Second)
+	for len(got) < 3 {
+		select {
+		case e := <-events:
+			if e.RemoteAddr == nil || e.RemoteAddr.String() != local {
+				continue
+			}
+			got = append(got, e.Type.String()+":"+e.Command)
+		case <-timeout:
+			t.Fatalf("Timeout waiting events, got:%v", got)
+		}
+	}
+	if strings.Join(got, " ") != "conn_opened: command:get conn_closed:" {
+		t.Errorf("Unexpected events: %v", got)
+	}
+}
+
+func Test_CommandEventSizes(t *testing.T) {
+	mcproto.SetAllocStats(true)
+	defer mcproto.SetAllocStats(false)
+	events := make(chan mcproto.Event, 16)
+	unsubscribe := mcproto.Subscribe(func(e mcproto.Event) {
+		if e.Type == mcproto.EventCommand {
+			select {
+			case events <- e:
+			default:
+			}
+		}
+	})
+	defer unsubscribe()
+
+	listener := serve(t, newStore(), "")
+	defer listener.Close()
+	conn, r := dial(t, listener)
+	defer conn.Close()
+	local := conn.LocalAddr().String()
+	call(t, conn, r, "set k 0 0 5\r\nhello\r\n", 1)
+
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case e := <-events:
+			if e.RemoteAddr == nil || e.RemoteAddr.String() != local {
+				continue
+			}
+			if e.BytesIn != 20 || e.BytesOut != 8 {
+				t.Errorf("sizes: in %d, out %d", e.BytesIn, e.BytesOut)
+			}
+			if e.Allocs == 0 || e.AllocBytes == 0 {
+				t.Errorf("allocations not measured: %+v", e)
+			}
+			return
+		case <-timeout:
+			t.Fatal("Timeout waiting the command event")
+		}
+	}
+}
+
+func Test_Pipeline(t *testing.T) {
+	db := newStore()
+	listener := serve(t, db, "")
+	defer listener.Close()
+
+	conn, r := dial(t, listener)
+	defer conn.Close()
+
+	resp := call(t, conn, r, "set a 0 0 1\r\n1\r\nset b 0 0 1\r\n2\r\nget a\r\nget b\r\n", 8)
+	if resp != "STORED\r\nSTORED\r\nVALUE a 0 1\r\n1\r\nEND\r\nVALUE b 0 1\r\n2\r\nEND\r\n" {
+		t.Errorf("Unexpected pipelined response:%q", resp)
+	}
+	if resp = call(t, conn, r, "set c 0 0 1\r\n12\r\n", 1); resp != "CLIENT_ERROR bad data chunk\r\n" {
+		t.Errorf("Expected bad data chunk, got:%q", resp)
+	}
+}
+
+// countingConn counts writes to the client
+type countingConn struct {
+	net.Conn
+	writes *int32
+}
+
+func (c countingConn) Write(b []byte) (int, error) {
+	atomic.AddInt32(c.writes, 1)
+	return c.Conn.Write(b)
+}
+
+func Test_PipelineBurst(t *testing.T) {
+	db := newStore()
+	db.Set([]byte("sess"), []byte("1"), 0, 0, 1, false, nil)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	var writes int32
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			mcproto.ParseMc(countingConn{conn, &writes}, db, "")
+		}
+	}()
+	conn, r := dial(t, listener)
+	defer conn.Close()
+
+	const burst = 200
+	if got := call(t, conn, r, strings.Repeat("incr sess 0\r\n", burst), burst); got != strings.Repeat("1\r\n", burst) {
+		t.Fatalf("burst: %q", got)
+	}
+	if n := atomic.LoadInt32(&writes); n > burst/10 {
+		t.Errorf("%d writes for %d pipelined responses", n, burst)
+	}
+	// a pipelined close still gets the preceding responses
+	if got := call(t, conn, r, "get sess\r\nclose\r\n", 3); got != "VALUE sess 0 1\r\n1\r\nEND\r\n" {
+		t.Fatalf("before close: %q", got)
+	}
+}
+
+func Test_BodyDeadline(t *testing.T) {
+	db := newStore()
+	listener := serve(t, db, "deadline=5000&bodydeadline=50")
+	defer listener.Close()
+
+	conn, r := dial(t, listener)
+	defer conn.Close()
+
+	conn.Write([]byte("set key 0 0 5\r\nva"))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := r.ReadString('\n'); err == nil || strings.Contains(err.Error(), "timeout") {
+		t.Errorf("Expected connection closed by server after stalled body, got:%v", err)
+	}
+}
+
+func Test_Slowloris(t *testing.T) {
+	db := newStore()
+	listener := serve(t, db, "deadline=5000&linedeadline=50&maxline=64")
+	defer listener.Close()
+
+	conn, r := dial(t, listener)
+	defer conn.Close()
+	conn.Write([]byte("get"))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := r.ReadString('\n'); err == nil || strings.Contains(err.Error(), "timeout") {
+		t.Errorf("Expected connection closed by server after partial line, got:%v", err)
+	}
+
+	long, longR := dial(t, listener)
+	defer long.Close()
+	if resp := call(t, long, longR, "get "+strings.Repeat("k", 100)+"\r\n", 1); resp != "CLIENT_ERROR line too long\r\n" {
+		t.Errorf("Expected line too long, got:%q", resp)
+	}
+}
+
+func Test_ConnStates(t *testing.T) {
+	db := &slowStore{McEngine: newStore(), unblock: make(chan struct{})}
+	listener := serve(t, db, "")
+	defer listener.Close()
+
+	conn, r := dial(t, listener)
+	defer conn.Close()
+	conn.Write([]byte("get key\r\n"))
+
+	state := func() mcproto.ConnState {
+		for _, ci := range mcproto.Conns() {
+			if ci.RemoteAddr.String() == conn.LocalAddr().String() {
+				return ci.State
+			}
+		}
+		return mcproto.StateClosed
+	}
+	deadline := time.Now().Add(time.Second)
+	for state() != mcproto.StateExecute && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if s := state(); s != mcproto.StateExecute {
+		t.Errorf("Expected execute while engine blocks, got:%s", s)
+	}
+	close(db.unblock)
+	r.ReadString('\n')
+	for state() != mcproto.StateIdle && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if s := state(); s != mcproto.StateIdle {
+		t.Errorf("Expected idle after response, got:%s", s)
+	}
+}
+
+func Test_RegisterCommand(t *testing.T) {
+	mcproto.RegisterCommand("ping", func(line []byte, db mcproto.McEngine, rw *bufio.ReadWriter) error {
+		rw.WriteString("PONG\r\n")
+		return rw.Flush()
+	})
+	if cmd := mcproto.ParseCommand([]byte("ping")); cmd != mcproto.CmdCustom {
+		t.Errorf("Expected custom command, got:%s", cmd)
+	}
+	db := newStore()
+	listener := serve(t, db, "")
+	defer listener.Close()
+
+	conn, r := dial(t, listener)
+	defer conn.Close()
+
+	if resp := call(t, conn, r, "ping\r\n", 1); resp != "PONG\r\n" {
+		t.Errorf("Expected PONG, got:%q", resp)
+	}
+	if resp := call(t, conn, r, "PING\r\n", 1); resp != "PONG\r\n" {
+		t.Errorf("Expected PONG, got:%q", resp)
+	}
+	if resp := call(t, conn, r, "pingpong\r\n", 1); resp != "ERROR\r\n" {
+		t.Errorf("Expected ERROR for unknown verb, got:%q", resp)
+	}
+}
+
+func Test_VerbBoundary(t *testing.T) {
+	db := newStore()
+	db.Set([]byte("key"), []byte("v"), 0, 0, 1, false, nil)
+	listener := serve(t, db, "")
+	defer listener.Close()
+
+	conn, r := dial(t, listener)
+	defer conn.Close()
+
+	// every line starts with a valid verb, but the verb is not a whole word
+	for _, line := range []string{
+		"settings\r\n",
+		"setkey 0 0 1\r\n",
+		"getsomething\r\n",
+		"getkey\r\n",
+		"getsx key\r\n",
+		"GETS\r\n",
+		"incrby key 1\r\n",
+		"decrement key 1\r\n",
+		"deletes key\r\n",
+		"closed\r\n",
+		"scanner 0\r\n",
+		"ttls key\r\n",
+		"backups\r\n",
+		"Set key 0 0 1\r\n",
+	} {
+		if resp := call(t, conn, r, line, 1); resp != "ERROR\r\n" {
+			t.Errorf("%q: expected ERROR, got:%q", line, resp)
+		}
+	}
+	// the connection is still usable
+	if resp := call(t, conn, r, "get key\r\n", 3); resp != "VALUE key 0 1\r\nv\r\nEND\r\n" {
+		t.Errorf("Expected value, got:%q", resp)
+	}
+}
+
+func Test_Handler(t *testing.T) {
+	engine, err := mcproto.EngineHandler(newStore(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := mcproto.HandlerFunc(func(w mcproto.ResponseWriter, r *mcproto.Request) {
+		switch {
+		case r.Command == mcproto.CmdUnknown && string(bytes.TrimSpace(r.Line)) == "ping":
+			w.WriteString("PONG\r\n")
+			w.Flush()
+		case r.Command == mcproto.CmdSet && string(r.Args[0]) == "readonly":
+			w.WriteString("CLIENT_ERROR read only\r\n")
+			w.Flush()
+		default:
+			engine.ServeMC(w, r)
+		}
+	})
+	listener := serveHandler(t, h)
+	defer listener.Close()
+	conn, r := dial(t, listener)
+	defer conn.Close()
+	for _, tc := range []struct {
+		cmd   string
+		lines int
+		want  string
+	}{
+		{"ping\r\n", 1, "PONG\r\n"},
+		{"set readonly 0 0 1\r\nx\r\n", 1, "CLIENT_ERROR read only\r\n"},
+		{"set key 0 0 5\r\nvalue\r\n", 1, "STORED\r\n"},
+		{"get key\r\n", 3, "VALUE key 0 5\r\nvalue\r\nEND\r\n"},
+		{"pong\r\n", 1, "ERROR\r\n"},
+	} {
+		if got := call(t, conn, r, tc.cmd, tc.lines); got != tc.want {
+			t.Errorf("%q: got %q, want %q", tc.cmd, got, tc.want)
+		}
+	}
+}
+
+func Test_RequestContext(t *testing.T) {
+	var ids []uint64
+	h := mcproto.HandlerFunc(func(w mcproto.ResponseWriter, r *mcproto.Request) {
+		ctx := r.Context()
+		ids = append(ids, mcproto.ConnID(ctx))
+		switch {
+		case len(r.Args) == 1 && bytes.HasPrefix(r.Line, []byte("auth ")):
+			mcproto.SetIdentity(ctx, string(r.Args[0]))
+			w.WriteString("OK\r\n")
+		case mcproto.TLSState(ctx) != nil || mcproto.ConnProtocol(ctx) != mcproto.ProtocolText:
+			w.WriteString("SERVER_ERROR bad metadata\r\n")
+		case mcproto.RemoteAddr(ctx) == nil || mcproto.RemoteAddr(ctx).String() != r.RemoteAddr.String():
+			w.WriteString("SERVER_ERROR bad addr\r\n")
+		default:
+			w.WriteString("ID " + mcproto.Identity(ctx) + "\r\n")
+		}
+		w.Flush()
+	})
+	listener := serveHandler(t, h)
+	defer listener.Close()
+	conn, r := dial(t, listener)
+	defer conn.Close()
+	if got := call(t, conn, r, "whoami\r\n", 1); got != "ID \r\n" {
+		t.Fatalf("anonymous: %q", got)
+	}
+	call(t, conn, r, "auth alice\r\n", 1)
+	if got := call(t, conn, r, "whoami\r\n", 1); got != "ID alice\r\n" {
+		t.Fatalf("identity: %q", got)
+	}
+	if ids[0] == 0 || ids[0] != ids[2] {
+		t.Fatalf("conn ids %v", ids)
+	}
+}
+
+// streamStore streams results, a key named "broken" fails the stream
+type streamStore struct {
+	*mapStore
+}
+
+func (s streamStore) GetsStream(keys [][]byte, emit func(key, value []byte) error) error {
+	for _, key := range keys {
+		if string(key) == "broken" {
+			return errors.New("disk gone")
+		}
+		if v, _, _ := s.Get(key, nil); v != nil {
+			if err := emit(key, v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s streamStore) ScanStream(cursor uint64, match []byte, count int, emit func(key []byte) error) (uint64, error) {
+	keys, next, err := s.Scan(cursor, match, count)
+	for _, key := range keys {
+		if err := emit(key); err != nil {
+			return 0, err
+		}
+	}
+	return next, err
+}
+
+func Test_Stream(t *testing.T) {
+	db := streamStore{newStore().(*mapStore)}
+	var multi strings.Builder
+	multi.WriteString("get")
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("k%03d", i)
+		db.Set([]byte(key), []byte("v"), 0, 0, 1, false, nil)
+		multi.WriteString(" " + key)
+	}
+	listener := serve(t, db, "")
+	defer listener.Close()
+	conn, r := dial(t, listener)
+	defer conn.Close()
+
+	resp := call(t, conn, r, multi.String()+" missing\r\n", 401)
+	if !strings.HasPrefix(resp, "VALUE k000 0 1\r\nv\r\n") || !strings.HasSuffix(resp, "VALUE k199 0 1\r\nv\r\nEND\r\n") {
+		t.Fatalf("multi-get: %q...", resp[:40])
+	}
+	if got := call(t, conn, r, "scan 0 count 2\r\n", 4); got != "KEY k000\r\nKEY k001\r\nCURSOR 2\r\nEND\r\n" {
+		t.Fatalf("scan: %q", got)
+	}
+	// nothing sent yet, the error is a normal response
+	if got := call(t, conn, r, "get broken k000\r\n", 1); got != "SERVER_ERROR disk gone\r\n" {
+		t.Fatalf("broken: %q", got)
+	}
+	// part of the response is sent, the connection is closed
+	if got := call(t, conn, r, "get k000 broken\r\n", 3); got != "VALUE k000 0 1\r\nv\r\nSERVER_ERROR disk gone\r\n" {
+		t.Fatalf("broken mid-stream: %q", got)
+	}
+	if _, err := r.ReadString('\n'); err == nil {
+		t.Fatal("connection left open after a broken stream")
+	}
+}
+
+// nilStore returns a nil value for the key "nil" and ErrCacheMiss for missing keys
+type nilStore struct {
+	*mapStore
+}
+
+func (s nilStore) Get(key []byte, rw *bufio.ReadWriter) ([]byte, bool, error) {
+	if string(key) == "nil" {
+		return nil, false, nil
+	}
+	value, noreply, _ := s.mapStore.Get(key, rw)
+	if value == nil {
+		return nil, noreply, mcproto.ErrCacheMiss
+	}
+	return value, noreply, nil
+}
+
+func Test_NilValue(t *testing.T) {
+	for _, tc := range []struct {
+		params string
+		want   string
+	}{
+		{"", "END\r\n"},
+		{"nilvalue=miss", "END\r\n"},
+		{"nilvalue=empty", "VALUE nil 0 0\r\n\r\nEND\r\n"},
+	} {
+		db := nilStore{newStore().(*mapStore)}
+		var errs int32
+		unsubscribe := mcproto.Subscribe(func(e mcproto.Event) {
+			if e.Type == mcproto.EventError {
+				atomic.AddInt32(&errs, 1)
+			}
+		})
+		listener := serve(t, db, tc.params)
+		conn, r := dial(t, listener)
+		lines := strings.Count(tc.want, "\n")
+		if got := call(t, conn, r, "get nil\r\n", lines); got != tc.want {
+			t.Errorf("%q: nil value: got %q, want %q", tc.params, got, tc.want)
+		}
+		if got := call(t, conn, r, "get missing\r\n", 1); got != "END\r\n" {
+			t.Errorf("%q: miss: got %q", tc.params, got)
+		}
+		unsubscribe()
+		conn.Close()
+		listener.Close()
+		if n := atomic.LoadInt32(&errs); n != 0 {
+			t.Errorf("%q: misses published %d errors", tc.params, n)
+		}
+	}
+}
+
+func Test_ZeroLength(t *testing.T) {
+	db := newStore()
+	for name, engine := range map[string]mcproto.McEngine{
+		"store":    db,
+		"compress": mcproto.NewPolicyEngine(newStore(), mcproto.PrefixPolicy{Compress: true}),
+	} {
+		listener := serve(t, engine, "")
+		conn, r := dial(t, listener)
+		if got := call(t, conn, r, "set empty 0 0 0\r\n\r\n", 1); got != "STORED\r\n" {
+			t.Errorf("%s: set: %q", name, got)
+		}
+		if got := call(t, conn, r, "get empty\r\n", 3); got != "VALUE empty 0 0\r\n\r\nEND\r\n" {
+			t.Errorf("%s: get: %q", name, got)
+		}
+		if got := call(t, conn, r, "get empty none\r\n", 3); got != "VALUE empty 0 0\r\n\r\nEND\r\n" {
+			t.Errorf("%s: multi-get: %q", name, got)
+		}
+		conn.Close()
+		listener.Close()
+	}
+
+	restored := newStore()
+	n, err := mcproto.RestoreFrom(strings.NewReader("ITEM empty 0 0 0\r\n\r\nEND\r\n"), restored)
+	if err != nil || n != 1 {
+		t.Fatalf("restore: %d %v", n, err)
+	}
+	if v, _, _ := restored.Get([]byte("empty"), nil); v == nil || len(v) != 0 {
+		t.Fatalf("restored %q", v)
+	}
+}
+
+func Test_MaxKeys(t *testing.T) {
+	db := newStore()
+	db.Set([]byte("a"), []byte("1"), 0, 0, 1, false, nil)
+	listener := serve(t, db, "maxkeys=3")
+	defer listener.Close()
+	conn, r := dial(t, listener)
+	defer conn.Close()
+	if got := call(t, conn, r, "get a b c\r\n", 3); got != "VALUE a 0 1\r\n1\r\nEND\r\n" {
+		t.Fatalf("within cap: %q", got)
+	}
+	if got := call(t, conn, r, "gets a b c d\r\n", 1); got != "CLIENT_ERROR too many keys\r\n" {
+		t.Fatalf("over cap: %q", got)
+	}
+	// pooled args of a huge request don't leak into the next one
+	huge := "get" + strings.Repeat(" x", 300) + "\r\n"
+	call(t, conn, r, huge, 1)
+	if got := call(t, conn, r, "get a\r\n", 3); got != "VALUE a 0 1\r\n1\r\nEND\r\n" {
+		t.Fatalf("after huge: %q", got)
+	}
+}
+
+func Test_Chaos(t *testing.T) {
+	engine, err := mcproto.EngineHandler(newStore(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := mcproto.NewChaosHandler(engine, mcproto.Chaos{ErrorProb: 1})
+	listener := serveHandler(t, h)
+	defer listener.Close()
+	conn, r := dial(t, listener)
+	defer conn.Close()
+	if got := call(t, conn, r, "get a\r\n", 1); got != "SERVER_ERROR injected fault\r\n" {
+		t.Fatalf("error: %q", got)
+	}
+
+	h.SetChaos(mcproto.Chaos{DelayProb: 1, MaxDelay: time.Millisecond})
+	if got := call(t, conn, r, "get a\r\n", 1); got != "END\r\n" {
+		t.Fatalf("delay: %q", got)
+	}
+
+	h.SetChaos(mcproto.Chaos{DropProb: 1})
+	conn.Write([]byte("get a\r\n"))
+	if line, err := r.ReadString('\n'); err == nil {
+		t.Fatalf("drop: got %q", line)
+	}
+	if s := h.Stats(); s != (mcproto.ChaosStats{Delays: 1, Errors: 1, Drops: 1}) {
+		t.Fatalf("stats %+v", s)
+	}
+}
+
+func Test_PersistTotals(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mcproto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "totals.json")
+	if err = ioutil.WriteFile(path, []byte(`{"total_items":100,"total_connections":10}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	totals, err := mcproto.PersistTotals(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := serve(t, newStore(), "")
+	defer listener.Close()
+	conn, r := dial(t, listener)
+	defer conn.Close()
+	before := mcproto.BootTotals()
+	call(t, conn, r, "set a 0 0 1\r\n1\r\nincr a 1\r\n", 2)
+	boot := mcproto.BootTotals()
+	if boot.Items != before.Items+1 || boot.Connections == 0 {
+		t.Errorf("boot totals: %+v after %+v", boot, before)
+	}
+	if lifetime := mcproto.LifetimeTotals(); lifetime.Items != boot.Items+100 || lifetime.Connections != boot.Connections+10 {
+		t.Errorf("lifetime totals: %+v, boot %+v", lifetime, boot)
+	}
+
+	if err = totals.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var saved mcproto.Totals
+	b, _ := ioutil.ReadFile(path)
+	if err = json.Unmarshal(b, &saved); err != nil || saved != mcproto.LifetimeTotals() {
+		t.Fatalf("saved %s, want %+v", b, mcproto.LifetimeTotals())
+	}
+	// a missing file starts from zero
+	fresh, err := mcproto.PersistTotals(filepath.Join(dir, "fresh.json"), 0)
+	if err != nil {
+		t.Fatalf("missing file: %v", err)
+	}
+	if lifetime := mcproto.LifetimeTotals(); lifetime != mcproto.BootTotals() {
+		t.Errorf("fresh lifetime totals: %+v", lifetime)
+	}
+	if err = fresh.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_Admin(t *testing.T) {
+	admin := mcproto.NewAdmin("secret", "maxkeys=5")
+	drained := false
+	admin.Drain = func() error { drained = true; return nil }
+	do := func(method, path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, req)
+		return w
+	}
+	if w := do("GET", "/stats", ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("no token: %d", w.Code)
+	}
+	if w := do("GET", "/stats", "wrong"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("wrong token: %d", w.Code)
+	}
+	bare := httptest.NewRequest("GET", "/stats", nil)
+	bare.Header.Set("Authorization", "secret")
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, bare)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("bare token: %d", w.Code)
+	}
+	var stats mcproto.AdminStats
+	if w := do("GET", "/stats", "secret"); w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &stats) != nil {
+		t.Fatalf("stats: %d %s", w.Code, w.Body)
+	}
+	var config map[string]string
+	if w := do("GET", "/config", "secret"); json.Unmarshal(w.Body.Bytes(), &config) != nil || config["maxkeys"] != "5" || config["deadline"] != "1000" {
+		t.Fatalf("config: %s", w.Body)
+	}
+	if w := do("GET", "/conns", "secret"); w.Code != http.StatusOK || !strings.HasPrefix(w.Body.String(), "[") {
+		t.Fatalf("conns: %d %s", w.Code, w.Body)
+	}
+	if w := do("GET", "/drain", "secret"); w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("drain by GET: %d", w.Code)
+	}
+	if w := do("POST", "/drain", "secret"); w.Code != http.StatusNoContent || !drained {
+		t.Fatalf("drain: %d", w.Code)
+	}
+	if w := do("POST", "/shutdown", "secret"); w.Code != http.StatusNotImplemented {
+		t.Fatalf("shutdown: %d", w.Code)
+	}
+	if w := do("POST", "/debug?connerr=0", "secret"); w.Code != http.StatusNoContent {
+		t.Fatalf("debug: %d", w.Code)
+	}
+}
+
+func Test_AdminProfiling(t *testing.T) {
+	admin := mcproto.NewAdmin("secret", "")
+	get := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, req)
+		return w
+	}
+	if w := get("/debug/pprof/goroutine"); w.Code != http.StatusNotFound {
+		t.Fatalf("profiles served while off: %d", w.Code)
+	}
+	admin.Profiling = true
+	var rs mcproto.RuntimeStats
+	if w := get("/runtime"); json.Unmarshal(w.Body.Bytes(), &rs) != nil || rs.Goroutines == 0 {
+		t.Fatalf("runtime: %s", w.Body)
+	}
+	if w := get("/debug/pprof/"); !strings.Contains(w.Body.String(), "goroutine") {
+		t.Fatalf("index: %s", w.Body)
+	}
+	if w := get("/debug/pprof/goroutine?debug=1"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "goroutine profile") {
+		t.Fatalf("goroutine: %d", w.Code)
+	}
+	if w := get("/debug/pprof/nope"); w.Code != http.StatusNotFound {
+		t.Fatalf("unknown profile: %d", w.Code)
+	}
+}
+
+func Test_MemoryPressure(t *testing.T) {
+	levels := make(chan mcproto.Pressure, 100)
+	remove := mcproto.OnMemoryPressure(func(level mcproto.Pressure, heap, limit uint64) {
+		select {
+		case levels <- level:
+		default:
+		}
+	})
+	defer remove()
+	defer mcproto.SetMemoryBudget(mcproto.MemoryBudget{})
+
+	// any heap is over a 1 byte budget
+	mcproto.SetMemoryBudget(mcproto.MemoryBudget{Limit: 1, Interval: 5 * time.Millisecond})
+	select {
+	case level := <-levels:
+		if level != mcproto.PressureCritical {
+			t.Fatalf("level %v", level)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no pressure callback")
+	}
+	if s := mcproto.Memory(); s.Level != mcproto.PressureCritical || s.Critical == 0 || s.Heap == 0 {
+		t.Fatalf("stats %+v", s)
+	}
+
+	// back to none is reported once
+	mcproto.SetMemoryBudget(mcproto.MemoryBudget{Limit: 1 << 50, Interval: 5 * time.Millisecond})
+	time.Sleep(50 * time.Millisecond)
+	for len(levels) > 0 {
+		<-levels
+	}
+	time.Sleep(50 * time.Millisecond)
+	if len(levels) != 0 {
+		t.Fatalf("callbacks without pressure")
+	}
+	if s := mcproto.Memory(); s.Level != mcproto.PressureNone {
+		t.Fatalf("stats %+v", s)
+	}
+}
+
+// keyStore records the keys passed to Set
+type keyStore struct {
+	*mapStore
+	mu   sync.Mutex
+	keys [][]byte
+}
+
+func (s *keyStore) Set(key, value []byte, flags uint32, exp int32, size int, noreply bool, rw *bufio.ReadWriter) (bool, error) {
+	s.mu.Lock()
+	s.keys = append(s.keys, key)
+	s.mu.Unlock()
+	return s.mapStore.Set(key, value, flags, exp, size, noreply, rw)
+}
+
+func Test_Intern(t *testing.T) {
+	for _, tc := range []struct {
+		params string
+		shared bool
+	}{
+		{"", false},
+		{"intern=2", true},
+	} {
+		db := &keyStore{mapStore: newStore().(*mapStore)}
+		listener := serve(t, db, tc.params)
+		conn, r := dial(t, listener)
+		call(t, conn, r, "set hot 0 0 1\r\n1\r\nset cold 0 0 1\r\n1\r\nset hot 0 0 1\r\n2\r\n", 3)
+		conn.Close()
+		listener.Close()
+		if shared := &db.keys[0][0] == &db.keys[2][0]; shared != tc.shared {
+			t.Errorf("%q: key shared %v", tc.params, shared)
+		}
+		if string(db.keys[0]) != "hot" || string(db.keys[1]) != "cold" {
+			t.Errorf("%q: keys %q", tc.params, db.keys)
+		}
+	}
+}
+
+func Test_ShardedStats(t *testing.T) {
+	c := mcproto.NewCanaryEngine(newStore(), newStore(), 50)
+	var wg sync.WaitGroup
+	for g := 0; g < 50; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				c.Get([]byte(fmt.Sprintf("k%d-%d", g, i)), nil)
+			}
+		}(g)
+	}
+	wg.Wait()
+	old, new := c.Stats()
+	if n := old.Misses + new.Misses; n != 50*200 {
+		t.Fatalf("counted %d of %d gets", n, 50*200)
+	}
+	// 32 overlapping adds must not pile onto a few shards
+	if used := mcproto.CounterShardsUsed(32); used <= 16 {
+		t.Errorf("32 concurrent adds used %d shards", used)
+	}
+}
+
+func Test_FlushDelay(t *testing.T) {
+	db := newStore()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	var writes int32
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			mcproto.ParseMc(countingConn{conn, &writes}, db, "flushdelay=100000")
+		}
+	}()
+	conn, r := dial(t, listener)
+	defer conn.Close()
+
+	started := time.Now()
+	for i := 0; i < 10; i++ {
+		conn.Write([]byte("get a\r\n"))
+		time.Sleep(time.Millisecond)
+	}
+	if got := call(t, conn, r, "", 10); got != strings.Repeat("END\r\n", 10) {
+		t.Fatalf("responses %q", got)
+	}
+	if n := atomic.LoadInt32(&writes); n > 2 {
+		t.Errorf("%d writes for 10 rapid-fire responses", n)
+	}
+	// a lone response waits at most the delay
+	if elapsed := time.Since(started); elapsed > 500*time.Millisecond {
+		t.Errorf("responses delayed %v", elapsed)
+	}
+}
+
+// fileStore keeps values in files of dir, after a 3 byte header
+type fileStore struct {
+	*mapStore
+	dir string
+}
+
+func (s fileStore) Set(key, value []byte, flags uint32, exp int32, size int, noreply bool, rw *bufio.ReadWriter) (bool, error) {
+	return false, ioutil.WriteFile(filepath.Join(s.dir, string(key)), append([]byte("hdr"), value...), 0600)
+}
+
+func (s fileStore) GetFile(key []byte) (*os.File, int64, int64, error) {
+	f, err := os.Open(filepath.Join(s.dir, string(key)))
+	if os.IsNotExist(err) {
+		return nil, 0, 0, mcproto.ErrCacheMiss
+	}
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, 0, err
+	}
+	return f, 3, st.Size() - 3, nil
+}
+
+func Test_SendFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mcproto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db := fileStore{newStore().(*mapStore), dir}
+	big := bytes.Repeat([]byte("0123456789abcdef"), 1<<16)
+	db.Set([]byte("big"), big, 0, 0, len(big), false, nil)
+	listener := serve(t, db, "")
+	defer listener.Close()
+	conn, r := dial(t, listener)
+	defer conn.Close()
+
+	if got := call(t, conn, r, "get big\r\n", 1); got != fmt.Sprintf("VALUE big 0 %d\r\n", len(big)) {
+		t.Fatalf("header %q", got)
+	}
+	body := make([]byte, len(big)+2)
+	if _, err := io.ReadFull(r, body); err != nil || !bytes.Equal(body[:len(big)], big) || string(body[len(big):]) != "\r\n" {
+		t.Fatalf("body: %v", err)
+	}
+	if got := call(t, conn, r, "get none\r\n", 2); got != "END\r\nEND\r\n" {
+		t.Fatalf("end of hit, miss: %q", got)
+	}
+}
+
+// arenaStore returns values from one reused buffer and scribbles over it on Release
+type arenaStore struct {
+	*mapStore
+	arena    []byte
+	released int32
+}
+
+func (s *arenaStore) Get(key []byte, rw *bufio.ReadWriter) ([]byte, bool, error) {
+	v, noreply, err := s.mapStore.Get(key, rw)
+	if v == nil {
+		return nil, noreply, err
+	}
+	s.arena = append(s.arena[:0], v...)
+	return s.arena, noreply, err
+}
+
+func (s *arenaStore) Release(value []byte) {
+	for i := range value {
+		value[i] = 'X'
+	}
+	atomic.AddInt32(&s.released, 1)
+}
+
+func Test_ValueRelease(t *testing.T) {
+	db := &arenaStore{mapStore: newStore().(*mapStore)}
+	db.Set([]byte("a"), []byte("alpha"), 0, 0, 5, false, nil)
+	db.Set([]byte("b"), []byte("bravo"), 0, 0, 5, false, nil)
+	// responses wait in the buffer, the arena is reused meanwhile
+	listener := serve(t, db, "flushdelay=50000")
+	defer listener.Close()
+	conn, r := dial(t, listener)
+	defer conn.Close()
+	if got := call(t, conn, r, "get a\r\nget b\r\nget none\r\n", 7); got != "VALUE a 0 5\r\nalpha\r\nEND\r\nVALUE b 0 5\r\nbravo\r\nEND\r\nEND\r\n" {
+		t.Fatalf("got %q", got)
+	}
+	if n := atomic.LoadInt32(&db.released); n != 2 {
+		t.Fatalf("released %d values", n)
+	}
+}
+
+func Test_ValueReleaseWrapped(t *testing.T) {
+	wrappers := map[string]func(db mcproto.McEngine) mcproto.McEngine{
+		"policy": func(db mcproto.McEngine) mcproto.McEngine {
+			return mcproto.NewPolicyEngine(db, mcproto.PrefixPolicy{Prefix: "b", Compress: true})
+		},
+		"migrate": func(db mcproto.McEngine) mcproto.McEngine {
+			return mcproto.NewMigrateEngine(newStore(), db)
+		},
+		"canary": func(db mcproto.McEngine) mcproto.McEngine {
+			return mcproto.NewCanaryEngine(db, db, 50)
+		},
+		"tombstone": func(db mcproto.McEngine) mcproto.McEngine {
+			return mcproto.NewTombstoneEngine(db, time.Second)
+		},
+	}
+	for name, wrap := range wrappers {
+		t.Run(name, func(t *testing.T) {
+			db := &arenaStore{mapStore: newStore().(*mapStore)}
+			e := wrap(db)
+			e.Set([]byte("a"), []byte("alpha"), 0, 0, 5, false, nil)
+			e.Set([]byte("b"), []byte("bravo"), 0, 0, 5, false, nil)
+			listener := serve(t, e, "flushdelay=50000")
+			defer listener.Close()
+			conn, r := dial(t, listener)
+			defer conn.Close()
+			if got := call(t, conn, r, "get a\r\nget b\r\nget none\r\n", 7); got != "VALUE a 0 5\r\nalpha\r\nEND\r\nVALUE b 0 5\r\nbravo\r\nEND\r\nEND\r\n" {
+				t.Fatalf("got %q", got)
+			}
+			if n := atomic.LoadInt32(&db.released); n != 2 {
+				t.Fatalf("released %d values", n)
+			}
+		})
+	}
+}
+
+func Test_OpaqueBudget(t *testing.T) {
+	h := mcproto.HandlerFunc(func(w mcproto.ResponseWriter, r *mcproto.Request) {
+		deadline, ok := r.Context().Deadline()
+		if !ok {
+			w.WriteString("NO\r\n")
+		} else {
+			fmt.Fprintf(w, "DL %d\r\n", time.Until(deadline).Round(100*time.Millisecond)/time.Millisecond)
+		}
+		w.Flush()
+	})
+	listener := serveHandler(t, h)
+	defer listener.Close()
+	conn, r := dial(t, listener)
+	defer conn.Close()
+	if got := call(t, conn, r, "mg key v "+mcproto.BudgetOpaque(2*time.Second)+"\r\n", 1); got != "DL 2000\r\n" {
+		t.Fatalf("budget: %q", got)
+	}
+	if got := call(t, conn, r, "mg Od100 v Oabc\r\n", 1); got != "NO\r\n" {
+		t.Fatalf("other opaque: %q", got)
+	}
+	// keys of text commands are never parsed as flags
+	if got := call(t, conn, r, "get Od100\r\n", 1); got != "NO\r\n" {
+		t.Fatalf("text command: %q", got)
+	}
+}
+
+func Test_Usage(t *testing.T) {
+	reports := make(chan mcproto.UsageReport, 100)
+	mcproto.SetUsageReporter(10*time.Millisecond, func(r mcproto.UsageReport) { reports <- r })
+	defer mcproto.SetUsageReporter(0, nil)
+
+	listener := serve(t, newStore(), "")
+	defer listener.Close()
+	conn, r := dial(t, listener)
+	call(t, conn, r, "set k 0 0 5\r\nvalue\r\n", 1)
+	call(t, conn, r, "get k\r\n", 3)
+	conn.Close()
+
+	var sum mcproto.Usage
+	deadline := time.After(time.Second)
+	for sum.Commands < 2 {
+		select {
+		case rep := <-reports:
+			for _, u := range rep.Records {
+				sum.Commands += u.Commands
+				sum.BytesIn += u.BytesIn
+				sum.BytesOut += u.BytesOut
+			}
+		case <-deadline:
+			t.Fatalf("usage %+v", sum)
+		}
+	}
+	want := mcproto.Usage{
+		Commands: 2,
+		BytesIn:  uint64(len("set k 0 0 5\r\nvalue\r\nget k\r\n")),
+		BytesOut: uint64(len("STORED\r\nVALUE k 0 5\r\nvalue\r\nEND\r\n")),
+	}
+	if sum != want {
+		t.Fatalf("usage %+v, want %+v", sum, want)
+	}
+}
+
+func Test_SessionTakeover(t *testing.T) {
+	h := mcproto.HandlerFunc(func(w mcproto.ResponseWriter, r *mcproto.Request) {
+		// auth <identity> <session> [takeover]
+		ctx := r.Context()
+		mcproto.SetIdentity(ctx, string(r.Args[0]))
+		err := mcproto.ClaimSession(ctx, string(r.Args[1]), len(r.Args) > 2)
+		if err != nil {
+			w.WriteString("CLIENT_ERROR " + err.Error() + "\r\n")
+		} else {
+			w.WriteString("OK\r\n")
+		}
+		w.Flush()
+	})
+	listener := serveHandler(t, h)
+	defer listener.Close()
+
+	stale, staleR := dial(t, listener)
+	defer stale.Close()
+	if got := call(t, stale, staleR, "auth app s1\r\n", 1); got != "OK\r\n" {
+		t.Fatalf("first claim: %q", got)
+	}
+	fresh, freshR := dial(t, listener)
+	defer fresh.Close()
+	if got := call(t, fresh, freshR, "auth app s1\r\n", 1); !strings.Contains(got, "session active") {
+		t.Fatalf("claim without takeover: %q", got)
+	}
+	if got := call(t, fresh, freshR, "auth other s1\r\n", 1); got != "OK\r\n" {
+		t.Fatalf("other identity: %q", got)
+	}
+	if got := call(t, fresh, freshR, "auth app s1 takeover\r\n", 1); got != "OK\r\n" {
+		t.Fatalf("takeover: %q", got)
+	}
+	stale.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := staleR.ReadString('\n'); err != io.EOF {
+		t.Fatalf("stale connection not closed: %v", err)
+	}
+}
+
+func Test_UnknownCommand(t *testing.T) {
+	listener := serve(t, newStore(), "unknown=close")
+	conn, r := dial(t, listener)
+	if got := call(t, conn, r, "bogus\r\n", 1); got != "ERROR\r\n" {
+		t.Fatalf("close mode: %q", got)
+	}
+	if _, err := r.ReadString('\n'); err != io.EOF {
+		t.Fatalf("connection left open: %v", err)
+	}
+	conn.Close()
+	listener.Close()
+
+	var unknown int32
+	mcproto.HandleUnknown(mcproto.HandlerFunc(func(w mcproto.ResponseWriter, r *mcproto.Request) {
+		atomic.AddInt32(&unknown, 1)
+		w.WriteString("CLIENT_ERROR unsupported " + string(bytes.Fields(r.Line)[0]) + "\r\n")
+		w.Flush()
+	}))
+	defer mcproto.HandleUnknown(nil)
+	listener = serve(t, newStore(), "")
+	defer listener.Close()
+	conn, r = dial(t, listener)
+	defer conn.Close()
+	if got := call(t, conn, r, "bogus 1\r\n", 1); got != "CLIENT_ERROR unsupported bogus\r\n" {
+		t.Fatalf("hook: %q", got)
+	}
+	if got := call(t, conn, r, "get a\r\n", 1); got != "END\r\n" || atomic.LoadInt32(&unknown) != 1 {
+		t.Fatalf("known command: %q", got)
+	}
+}
+
+func Test_StrictMode(t *testing.T) {
+	listener := serve(t, newStore(), "strict=true")
+	defer listener.Close()
+	conn, r := dial(t, listener)
+	defer conn.Close()
+	cases := []struct{ cmd, resp string }{
+		{"get a\n", "CLIENT_ERROR line must end with CRLF\r\n"},
+		{"get  a\r\n", "CLIENT_ERROR tokens must be separated by single spaces\r\n"},
+		{"get a \r\n", "CLIENT_ERROR tokens must be separated by single spaces\r\n"},
+		{"GET a\r\n", "CLIENT_ERROR commands must be lower case\r\n"},
+		{"get " + strings.Repeat("k", 251) + "\r\n", "CLIENT_ERROR key too long\r\n"},
+		{"get\r\n", "CLIENT_ERROR missing key\r\n"},
+		{"delete a 0\r\n", "CLIENT_ERROR usage: delete <key> [noreply]\r\n"},
+		{"incr a -1\r\n", "CLIENT_ERROR invalid numeric delta argument\r\n"},
+		{"set a 0 0 1 0\r\nx\r\n", "CLIENT_ERROR usage: set <key> <flags> <exptime> <bytes> [noreply]\r\n"},
+		{"set a -1 0 1\r\nx\r\n", "CLIENT_ERROR bad flags\r\n"},
+		{"set a 0 0 1\r\nx\r\n", "STORED\r\n"},
+		{"get a\r\n", "VALUE a 0 1\r\n"},
+	}
+	for _, c := range cases {
+		if got := call(t, conn, r, c.cmd, 1); got != c.resp {
+			t.Fatalf("%q: got %q, want %q", c.cmd, got, c.resp)
+		}
+	}
+}
+
+func Test_Violations(t *testing.T) {
+	count := func(kind mcproto.Violation) uint64 {
+		for _, v := range mcproto.Violations() {
+			if v.Addr == "127.0.0.1" {
+				return v.Counts[kind.String()]
+			}
+		}
+		return 0
+	}
+	syntax, number := count(mcproto.ViolationSyntax), count(mcproto.ViolationNumber)
+	mcproto.SetViolationBan(mcproto.ViolationBan{Threshold: 3, Duration: time.Minute})
+	defer mcproto.SetViolationBan(mcproto.ViolationBan{})
+	listener := serve(t, newStore(), "")
+	defer listener.Close()
+	conn, r := dial(t, listener)
+	defer conn.Close()
+	if got := call(t, conn, r, "get\r\n", 1); got != "ERROR\r\n" {
+		t.Fatalf("get: %q", got)
+	}
+	if got := call(t, conn, r, "set a 0 0 x\r\n", 1); got != "ERROR\r\n" {
+		t.Fatalf("set: %q", got)
+	}
+	if count(mcproto.ViolationSyntax) != syntax+1 || count(mcproto.ViolationNumber) != number+1 {
+		t.Fatalf("counts: %+v", mcproto.Violations())
+	}
+	call(t, conn, r, "get\r\n", 1)
+	if _, err := r.ReadString('\n'); err == nil {
+		t.Fatalf("banned connection left open: %v", err)
+	}
+	conn2, r2 := dial(t, listener)
+	defer conn2.Close()
+	conn2.Write([]byte("get a\r\n"))
+	if _, err := r2.ReadString('\n'); err == nil {
+		t.Fatalf("banned address served: %v", err)
+	}
+
+	mcproto.SetViolationBan(mcproto.ViolationBan{})
+	conn3, r3 := dial(t, listener)
+	defer conn3.Close()
+	if got := call(t, conn3, r3, "get a\r\n", 1); got != "END\r\n" {
+		t.Fatalf("after lifting the ban: %q", got)
+	}
+}
+
+func Test_Idempotency(t *testing.T) {
+	mcproto.SetIdempotencyWindow(time.Minute)
+	listener := serve(t, newStore(), "")
+	defer listener.Close()
+	conn, r := dial(t, listener)
+	if got := call(t, conn, r, "idem s1 set n 0 0 1\r\n1\r\nidem i1 incr n 5\r\n", 2); got != "STORED\r\n6\r\n" {
+		t.Fatalf("first: %q", got)
+	}
+	conn.Close()
+
+	// a retry on a new connection after an ambiguous failure
+	conn, r = dial(t, listener)
+	defer conn.Close()
+	if got := call(t, conn, r, "idem s1 set n 0 0 1\r\n1\r\nidem i1 incr n 5\r\n", 2); got != "STORED\r\n6\r\n" {
+		t.Fatalf("retry: %q", got)
+	}
+	if got := call(t, conn, r, "get n\r\n", 3); got != "VALUE n 0 1\r\n6\r\nEND\r\n" {
+		t.Fatalf("applied twice: %q", got)
+	}
+	// every mutation is applied once
+	for _, tc := range []struct{ req, want string }{
+		{"idem a1 append n 0 0 1\r\nx\r\n", "STORED\r\n"},
+		{"idem p1 rpush q 1\r\ny\r\n", "NOT_FOUND\r\n"},
+		{"set q 0 0 0\r\n\r\n", "STORED\r\n"},
+		{"idem p2 rpush q 1\r\ny\r\n", "1\r\n"},
+		{"idem l1 lpop q\r\n", "VALUE q 0 1\r\ny\r\nEND\r\n"},
+	} {
+		for retry := 0; retry < 2; retry++ {
+			if got := call(t, conn, r, tc.req, strings.Count(tc.want, "\n")); got != tc.want {
+				t.Fatalf("%q try %d: got %q, want %q", tc.req, retry, got, tc.want)
+			}
+		}
+	}
+	if got := call(t, conn, r, "get n\r\n", 3); got != "VALUE n 0 2\r\n6x\r\nEND\r\n" {
+		t.Fatalf("append applied twice: %q", got)
+	}
+	if got := call(t, conn, r, "lpop q\r\n", 1); got != "END\r\n" {
+		t.Fatalf("pushed or popped twice: %q", got)
+	}
+	if got := call(t, conn, r, "idem i2 get n\r\n", 1); got != "CLIENT_ERROR idem needs a command modifying items\r\n" {
+		t.Fatalf("retrieval: %q", got)
+	}
+	if got := call(t, conn, r, "idem i2\r\n", 1); got != "CLIENT_ERROR usage: idem <token> <command>\r\n" {
+		t.Fatalf("usage: %q", got)
+	}
+
+	mcproto.SetIdempotencyWindow(0)
+	if got := call(t, conn, r, "idem i1 incr n 5\r\n", 1); got != "ERROR\r\n" {
+		t.Fatalf("disabled: %q", got)
+	}
+}
+
+// stalledSetStore blocks sets until unblock is closed
+type stalledSetStore struct {
+	mcproto.McEngine
+	entered, unblock chan struct{}
+}
+
+func (s stalledSetStore) Set(key, value []byte, flags uint32, exp int32, size int, noreply bool, rw *bufio.ReadWriter) (bool, error) {
+	s.entered <- struct{}{}
+	<-s.unblock
+	return s.McEngine.Set(key, value, flags, exp, size, noreply, rw)
+}
+
+func Test_IdempotencyStalledOwner(t *testing.T) {
+	mcproto.SetIdempotencyWindow(time.Minute)
+	defer mcproto.SetIdempotencyWindow(0)
+	db := stalledSetStore{newStore(), make(chan struct{}, 1), make(chan struct{})}
+	listener := serve(t, db, "deadline=100")
+	defer listener.Close()
+
+	owner, ownerR := dial(t, listener)
+	defer owner.Close()
+	owner.Write([]byte("idem s1 set k 0 0 1\r\n1\r\n"))
+	<-db.entered
+
+	// the retry doesn't hang behind the stalled first execution
+	retry, retryR := dial(t, listener)
+	defer retry.Close()
+	if got := call(t, retry, retryR, "idem s1 set k 0 0 1\r\n1\r\n", 1); got != "SERVER_ERROR idempotent command still running\r\n" {
+		t.Fatalf("retry: %q", got)
+	}
+	close(db.unblock)
+	owner.SetDeadline(time.Now().Add(time.Second))
+	if got, err := ownerR.ReadString('\n'); got != "STORED\r\n" {
+		t.Fatalf("owner: %q %v", got, err)
+	}
+}
+
+// casStore versions the items of a mapStore
+type casStore struct {
+	mcproto.McEngine
+	mu  sync.Mutex
+	cas map[string]uint64
+	seq uint64
+}
+
+func newCASStore() *casStore {
+	return &casStore{McEngine: newStore(), cas: make(map[string]uint64)}
+}
+
+func (s *casStore) Set(key, value []byte, flags uint32, exp int32, size int, noreply bool, rw *bufio.ReadWriter) (bool, error) {
+	s.mu.Lock()
+	s.seq++
+	s.cas[string(key)] = s.seq
+	s.mu.Unlock()
+	return s.McEngine.Set(key, value, flags, exp, size, noreply, rw)
+}
+
+func (s *casStore) GetItem(key []byte) (mcproto.Item, error) {
+	value, _, err := s.McEngine.Get(key, nil)
+	if err != nil || value == nil {
+		return mcproto.Item{}, mcproto.ErrCacheMiss
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return mcproto.Item{Key: key, Value: value, CAS: s.cas[string(key)]}, nil
+}
+
+func (s *casStore) CompareAndSwap(key, value []byte, flags uint32, exp int32, cas uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current, ok := s.cas[string(key)]
+	if !ok {
+		return mcproto.ErrCacheMiss
+	}
+	if current != cas {
+		return mcproto.ErrCASConflict
+	}
+	s.seq++
+	s.cas[string(key)] = s.seq
+	_, err := s.McEngine.Set(key, value, flags, exp, len(value), false, nil)
+	return err
+}
+
+func Test_ConditionalGet(t *testing.T) {
+	listener := serve(t, newCASStore(), "")
+	defer listener.Close()
+	conn, r := dial(t, listener)
+	defer conn.Close()
+	call(t, conn, r, "set k 0 0 5\r\nhello\r\n", 1)
+	if got := call(t, conn, r, "mg k v c Oq1\r\n", 2); got != "VA 5 c1 Oq1\r\nhello\r\n" {
+		t.Fatalf("mg: %q", got)
+	}
+	if got := call(t, conn, r, "mg k v C1 c\r\n", 1); got != "NM c1\r\n" {
+		t.Fatalf("unchanged: %q", got)
+	}
+	call(t, conn, r, "set k 0 0 5\r\nworld\r\n", 1)
+	if got := call(t, conn, r, "mg k v C1 c\r\n", 2); got != "VA 5 c2\r\nworld\r\n" {
+		t.Fatalf("changed: %q", got)
+	}
+	if got := call(t, conn, r, "mg k s k\r\n", 1); got != "HD s5 kk\r\n" {
+		t.Fatalf("no value: %q", got)
+	}
+	if got := call(t, conn, r, "mg none v\r\n", 1); got != "EN\r\n" {
+		t.Fatalf("miss: %q", got)
+	}
+	if got := call(t, conn, r, "mg k x\r\n", 1); got != "CLIENT_ERROR invalid flag\r\n" {
+		t.Fatalf("bad flag: %q", got)
+	}
+
+	// engines without CAS always send the value
+	plain := serve(t, newStore(), "")
+	defer plain.Close()
+	conn2, r2 := dial(t, plain)
+	defer conn2.Close()
+	call(t, conn2, r2, "set k 0 0 5\r\nhello\r\n", 1)
+	if got := call(t, conn2, r2, "mg k v C0\r\n", 2); got != "VA 5\r\nhello\r\n" {
+		t.Fatalf("plain engine: %q", got)
+	}
+}
+
+func Test_Patch(t *testing.T) {
+	listener := serve(t, newStore(), "")
+	defer listener.Close()
+	conn, r := dial(t, listener)
+	defer conn.Close()
+	call(t, conn, r, "set k 0 0 5\r\nhello\r\n", 1)
+	cases := []struct {
+		cmd, resp string
+		lines     int
+	}{
+		{"setrange k 1 3\r\nipp\r\n", "STORED\r\n", 1},
+		{"get k\r\n", "VALUE k 0 5\r\nhippo\r\nEND\r\n", 3},
+		{"setrange k 7 1 noreply\r\n!\r\nget k\r\n", "VALUE k 0 8\r\nhippo\x00\x00!\r\nEND\r\n", 3},
+		{"setrange none 0 1\r\nx\r\n", "NOT_FOUND\r\n", 1},
+		{"setrange k 2000000 1\r\nx\r\n", "CLIENT_ERROR offset out of range\r\n", 1},
+		{"set b 0 0 1\r\n\x01\r\n", "STORED\r\n", 1},
+		{"setbit b 0 1\r\n", "0\r\n", 1},
+		{"setbit b 7 0\r\n", "1\r\n", 1},
+		{"setbit b 9 1\r\n", "0\r\n", 1},
+		{"get b\r\n", "VALUE b 0 2\r\n\x80\x40\r\nEND\r\n", 3},
+		{"setbit b 1 2\r\n", "ERROR\r\n", 1},
+	}
+	for _, c := range cases {
+		if got := call(t, conn, r, c.cmd, c.lines); got != c.resp {
+			t.Fatalf("%q: got %q, want %q", c.cmd, got, c.resp)
+		}
+	}
+}
+
+func Test_List(t *testing.T) {
+	listener := serve(t, newStore(), "")
+	defer listener.Close()
+	conn, r := dial(t, listener)
+	defer conn.Close()
+	cases := []struct {
+		cmd, resp string
+		lines     int
+	}{
+		{"lpush q 1\r\na\r\n", "NOT_FOUND\r\n", 1},
+		{"set q 0 0 0\r\n\r\n", "STORED\r\n", 1},
+		{"rpop q\r\n", "END\r\n", 1},
+		{"lpush q 1\r\nb\r\n", "1\r\n", 1},
+		{"lpush q 1\r\na\r\n", "2\r\n", 1},
+		{"rpush q 2\r\ncc\r\n", "3\r\n", 1},
+		{"rpop q\r\n", "VALUE q 0 2\r\ncc\r\nEND\r\n", 3},
+		{"lpop q\r\n", "VALUE q 0 1\r\na\r\nEND\r\n", 3},
+		{"rpop q\r\n", "VALUE q 0 1\r\nb\r\nEND\r\n", 3},
+		{"lpop q\r\n", "END\r\n", 1},
+		// an empty element is popped, not taken for an empty list
+		{"rpush q 0\r\n\r\n", "1\r\n", 1},
+		{"rpush q 1\r\nx\r\n", "2\r\n", 1},
+		{"lpop q\r\n", "VALUE q 0 0\r\n\r\nEND\r\n", 3},
+		{"lpop q\r\n", "VALUE q 0 1\r\nx\r\nEND\r\n", 3},
+		{"set s 0 0 3\r\n\xffab\r\n", "STORED\r\n", 1},
+		{"rpop s\r\n", "CLIENT_ERROR value is not a list\r\n", 1},
+	}
+	for _, c := range cases {
+		if got := call(t, conn, r, c.cmd, c.lines); got != c.resp {
+			t.Fatalf("%q: got %q, want %q", c.cmd, got, c.resp)
+		}
+	}
+
+	// concurrent producers and consumers never lose or duplicate elements
+	var wg sync.WaitGroup
+	var popped int32
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			conn, r := dial(t, listener)
+			defer conn.Close()
+			for j := 0; j < 50; j++ {
+				call(t, conn, r, "rpush q 1\r\nx\r\n", 1)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			conn, r := dial(t, listener)
+			defer conn.Close()
+			for j := 0; j < 50; j++ {
+				if call(t, conn, r, "lpop q\r\n", 1) != "END\r\n" {
+					atomic.AddInt32(&popped, 1)
+					r.ReadString('\n')
+					r.ReadString('\n')
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	rest := 0
+	for call(t, conn, r, "lpop q\r\n", 1) != "END\r\n" {
+		r.ReadString('\n')
+		r.ReadString('\n')
+		rest++
+	}
+	if int(popped)+rest != 200 {
+		t.Fatalf("popped %d + %d, want 200", popped, rest)
+	}
+}
+
+// updateCounter counts the values stored by Update
+type updateCounter struct {
+	*mapStore
+	stored int32
+}
+
+func (s *updateCounter) Update(key []byte, fn func(value []byte) ([]byte, error)) error {
+	err := s.mapStore.Update(key, fn)
+	if err == nil {
+		atomic.AddInt32(&s.stored, 1)
+	}
+	return err
+}
+
+func Test_ListNoops(t *testing.T) {
+	db := &updateCounter{mapStore: newStore().(*mapStore)}
+	db.Set([]byte("q"), nil, 0, 0, 0, false, nil)
+	db.Set([]byte("s"), []byte("\xffab"), 0, 0, 3, false, nil)
+	listener := serve(t, db, "")
+	defer listener.Close()
+	conn, r := dial(t, listener)
+	defer conn.Close()
+
+	// pops of an empty list or a non-list store nothing
+	if got := call(t, conn, r, "lpop q\r\nrpop s\r\n", 2); got != "END\r\nCLIENT_ERROR value is not a list\r\n" {
+		t.Fatalf("got %q", got)
+	}
+	if n := atomic.LoadInt32(&db.stored); n != 0 {
+		t.Fatalf("%d values stored by pops that found nothing", n)
+	}
+
+	big := strings.Repeat("x", 1<<20)
+	if got := call(t, conn, r, "rpush q 1\r\na\r\n", 1); got != "1\r\n" {
+		t.Fatalf("got %q", got)
+	}
+	if got := call(t, conn, r, fmt.Sprintf("rpush q %d\r\n%s\r\n", len(big), big), 1); got != "CLIENT_ERROR list too long\r\n" {
+		t.Fatalf("oversized push, got %q", got)
+	}
+	if got := call(t, conn, r, "rpop q\r\nlpop q\r\n", 4); got != "VALUE q 0 1\r\na\r\nEND\r\nEND\r\n" {
+		t.Fatalf("list after refused push, got %q", got)
+	}
+}
+
+// binPacket builds a binary protocol request
+func binPacket(op byte, opaque uint32, extras, key, value []byte) []byte {
+	h := make([]byte, 24, 24+len(extras)+len(key)+len(value))
+	h[0], h[1] = 0x80, op
+	binary.BigEndian.PutUint16(h[2:], uint16(len(key)))
+	h[4] = byte(len(extras))
+	binary.BigEndian.PutUint32(h[8:], uint32(len(extras)+len(key)+len(value)))
+	binary.BigEndian.PutUint32(h[12:], opaque)
+	return append(append(append(h, extras...), key...), value...)
+}
+
+// readBinPacket returns the opcode, status, opaque, extras, key and value of a response
+func readBinPacket(t *testing.T, r *bufio.Reader) (op byte, status uint16, opaque uint32, extras, key, value []byte) {
+	h := make([]byte, 24)
+	if _, err := io.ReadFull(r, h); err != nil {
+		t.Fatal(err)
+	}
+	if h[0] != 0x81 {
+		t.Fatalf("magic %x", h[0])
+	}
+	body := make([]byte, binary.BigEndian.Uint32(h[8:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		t.Fatal(err)
+	}
+	keyLen, extLen := int(binary.BigEndian.Uint16(h[2:])), int(h[4])
+	return h[1], binary.BigEndian.Uint16(h[6:]), binary.BigEndian.Uint32(h[12:]), body[:extLen], body[extLen : extLen+keyLen], body[extLen+keyLen:]
+}
+
+func Test_ProtocolSwitch(t *testing.T) {
+	listener := serve(t, newStore(), "")
+	defer listener.Close()
+	conn, r := dial(t, listener)
+	defer conn.Close()
+	if got := call(t, conn, r, "proto carrier-pigeon\r\n", 1); got != "CLIENT_ERROR unsupported protocol\r\n" {
+		t.Fatalf("unsupported: %q", got)
+	}
+	if got := call(t, conn, r, "proto binary\r\n", 1); got != "OK\r\n" {
+		t.Fatalf("switch: %q", got)
+	}
+	conn.SetDeadline(time.Now().Add(time.Second))
+
+	setExtras := []byte{0, 0, 0, 7, 0, 0, 0, 0}
+	incrExtras := make([]byte, 20)
+	binary.BigEndian.PutUint64(incrExtras, 5)
+	var req []byte
+	req = append(req, binPacket(0x01, 1, setExtras, []byte("k"), []byte("10"))...)
+	req = append(req, binPacket(0x0c, 2, nil, []byte("k"), nil)...)
+	req = append(req, binPacket(0x05, 3, incrExtras, []byte("k"), nil)...)
+	req = append(req, binPacket(0x09, 4, nil, []byte("none"), nil)...) // quiet miss, no response
+	req = append(req, binPacket(0x00, 5, nil, []byte("none"), nil)...)
+	req = append(req, binPacket(0x04, 6, nil, []byte("k"), nil)...)
+	req = append(req, binPacket(0x0a, 7, nil, nil, nil)...)
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	if op, status, opaque, _, _, _ := readBinPacket(t, r); op != 0x01 || status != 0 || opaque != 1 {
+		t.Fatalf("set: %x %x %d", op, status, opaque)
+	}
+	if _, status, _, extras, key, value := readBinPacket(t, r); status != 0 || string(key) != "k" || string(value) != "10" || len(extras) != 4 {
+		t.Fatalf("getk: %x %q %q %v", status, key, value, extras)
+	}
+	if _, status, _, _, _, value := readBinPacket(t, r); status != 0 || binary.BigEndian.Uint64(value) != 15 {
+		t.Fatalf("incr: %x %v", status, value)
+	}
+	if _, status, opaque, _, _, _ := readBinPacket(t, r); status != 1 || opaque != 5 {
+		t.Fatalf("get miss: %x %d", status, opaque)
+	}
+	if _, status, _, _, _, _ := readBinPacket(t, r); status != 0 {
+		t.Fatalf("delete: %x", status)
+	}
+	if op, _, _, _, _, _ := readBinPacket(t, r); op != 0x0a {
+		t.Fatalf("noop: %x", op)
+	}
+	conn.Write(binPacket(0x07, 8, nil, nil, nil))
+	if op, _, _, _, _, _ := readBinPacket(t, r); op != 0x07 {
+		t.Fatalf("quit: %x", op)
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Fatalf("quit left the connection open: %v", err)
+	}
+
+	// a huge body is refused before it is allocated, and the connection closed
+	conn2, r2 := dial(t, listener)
+	defer conn2.Close()
+	call(t, conn2, r2, "proto binary\r\n", 1)
+	conn2.SetDeadline(time.Now().Add(time.Second))
+	huge := binPacket(0x01, 9, setExtras, []byte("k"), nil)
+	binary.BigEndian.PutUint32(huge[8:], 1<<31)
+	conn2.Write(huge)
+	if _, status, opaque, _, _, _ := readBinPacket(t, r2); status != 0x03 || opaque != 9 {
+		t.Fatalf("huge body: %x %d", status, opaque)
+	}
+	if _, err := r2.ReadByte(); err != io.EOF {
+		t.Fatalf("huge body left the connection open: %v", err)
+	}
+}
+
+// selfSigned returns a TLS certificate for 127.0.0.1
+func selfSigned(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func Test_ALPN(t *testing.T) {
+	cfg := &tls.Config{Certificates: []tls.Certificate{selfSigned(t)}, NextProtos: mcproto.ALPNProtocols}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	db := newStore()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go mcproto.ParseMc(conn, db, "")
+		}
+	}()
+	dialTLS := func(protos ...string) (*tls.Conn, *bufio.Reader) {
+		conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{InsecureSkipVerify: true, NextProtos: protos})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn, bufio.NewReader(conn)
+	}
+
+	conn, r := dialTLS(mcproto.ALPNBinary)
+	defer conn.Close()
+	if p := conn.ConnectionState().NegotiatedProtocol; p != mcproto.ALPNBinary {
+		t.Fatalf("negotiated %q", p)
+	}
+	conn.SetDeadline(time.Now().Add(time.Second))
+	conn.Write(binPacket(0x0b, 1, nil, nil, nil))
+	if _, status, _, _, _, value := readBinPacket(t, r); status != 0 || string(value) != "mcproto" {
+		t.Fatalf("binary version: %x %q", status, value)
+	}
+
+	conn2, r2 := dialTLS()
+	defer conn2.Close()
+	if got := call(t, conn2, r2, "get a\r\n", 1); got != "END\r\n" {
+		t.Fatalf("without ALPN: %q", got)
+	}
+}
+
+func Test_ValidateParams(t *testing.T) {
+	for _, ok := range []string{"", "deadline=5000&linedeadline=50&maxline=64", "slide=60:sess:&slide=30", "minexp=10&maxexp=100&nilvalue=empty&strict=true"} {
+		if err := mcproto.ValidateParams(ok); err != nil {
+			t.Errorf("%q: %v", ok, err)
+		}
+	}
+	err := mcproto.ValidateParams("deadline=1s&buf=0&maxline=8&dedline=10&nilvalue=none&slide=x:sess:&minexp=100&maxexp=10")
+	perr, ok := err.(*mcproto.ParamsError)
+	if !ok {
+		t.Fatalf("got %v", err)
+	}
+	want := []string{
+		`buf=0 must be positive`,
+		`deadline="1s" is not an integer`,
+		`unknown param "dedline"`,
+		`nilvalue="none" must be miss or empty`,
+		`slide="x:sess:" needs a positive number of seconds, like slide=60:sess:`,
+		`maxline=8 is below the minimal buffer of 16 bytes`,
+		`minexp=100 is longer than maxexp=10`,
+	}
+	if !reflect.DeepEqual(perr.Problems, want) {
+		t.Fatalf("problems:\n%q\nwant\n%q", perr.Problems, want)
+	}
+	if _, err := mcproto.EngineHandler(newStore(), "buf=-1"); err == nil {
+		t.Fatal("EngineHandler accepted buf=-1")
+	}
+
+	// connections with invalid params are closed and reported, the process lives on
+	errs := make(chan error, 2)
+	unsubscribe := mcproto.Subscribe(func(e mcproto.Event) {
+		if _, ok := e.Err.(*mcproto.ParamsError); ok && e.Type == mcproto.EventError {
+			errs <- e.Err
+		}
+	})
+	defer unsubscribe()
+	h, _ := mcproto.EngineHandler(newStore(), "")
+	for name, serve := range map[string]func(net.Conn){
+		"ServeConn": func(c net.Conn) { mcproto.ServeConn(c, h, "bogus=1") },
+		"ParseMc":   func(c net.Conn) { mcproto.ParseMc(c, newStore(), "bogus=1") },
+	} {
+		client, server := net.Pipe()
+		go serve(server)
+		client.SetDeadline(time.Now().Add(time.Second))
+		if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("%s: connection with invalid params: %v", name, err)
+		}
+		client.Close()
+		select {
+		case <-errs:
+		case <-time.After(time.Second):
+			t.Errorf("%s: invalid params not reported", name)
+		}
+	}
+}
+
+func Test_AllowedCommands(t *testing.T) {
+	db := newStore()
+	listener := serve(t, db, "allow=get,set")
+	defer listener.Close()
+	conn, r := dial(t, listener)
+	defer conn.Close()
+
+	for _, tc := range []struct{ req, want string }{
+		{"set a 0 0 1\r\n1\r\n", "STORED\r\n"},
+		{"delete a\r\n", "ERROR\r\n"},
+		{"backup\r\n", "ERROR\r\n"},
+		// the data block of a denied command is skipped
+		{"setrange a 0 1\r\n2\r\n", "ERROR\r\n"},
+		{"get a\r\n", "VALUE a 0 1\r\n1\r\nEND\r\n"},
+		{"GET a\r\n", "VALUE a 0 1\r\n1\r\nEND\r\n"},
+		{"DELETE a\r\n", "ERROR\r\n"},
+		{"proto binary\r\n", "ERROR\r\n"},
+	} {
+		if got := call(t, conn, r, tc.req, strings.Count(tc.want, "\n")); got != tc.want {
+			t.Errorf("%q: got %q, want %q", tc.req, got, tc.want)
+		}
+	}
+	if err := mcproto.ValidateParams("allow=get,,SET"); err == nil {
+		t.Fatal("bad allow list accepted")
+	}
+}
+
+// closeStore records Close of its engine
+type closeStore struct {
+	*slowStore
+	closed int32
+}
+
+func (en *closeStore) Close() error {
+	atomic.StoreInt32(&en.closed, 1)
+	return en.slowStore.Close()
+}
+
+func Test_ShutdownSequence(t *testing.T) {
+	db := &closeStore{slowStore: &slowStore{McEngine: newStore(), unblock: make(chan struct{})}}
+	listener := serve(t, db, "")
+
+	idle, idleR := dial(t, listener)
+	defer idle.Close()
+	if got := call(t, idle, idleR, "set a 0 0 1\r\n1\r\n", 1); got != "STORED\r\n" {
+		t.Fatalf("set: %q", got)
+	}
+	busy, busyR := dial(t, listener)
+	defer busy.Close()
+	busy.Write([]byte("get a\r\n"))
+	for executing := false; !executing; time.Sleep(time.Millisecond) {
+		for _, c := range mcproto.Conns() {
+			executing = executing || c.State == mcproto.StateExecute
+		}
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- mcproto.ShutdownSequence{Listeners: []net.Listener{listener}, Engine: db}.Run()
+	}()
+	idle.SetDeadline(time.Now().Add(time.Second))
+	if _, err := idleR.ReadByte(); err != io.EOF {
+		t.Fatalf("idle connection: %v", err)
+	}
+	if atomic.LoadInt32(&db.closed) != 0 {
+		t.Fatal("engine closed during a get")
+	}
+	close(db.unblock)
+	busy.SetDeadline(time.Now().Add(time.Second))
+	resp, err := ioutil.ReadAll(busyR)
+	if err != nil || string(resp) != "VALUE a 0 1\r\n1\r\nEND\r\n" {
+		t.Fatalf("busy connection: %q %v", resp, err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&db.closed) != 1 {
+		t.Fatal("engine not closed")
+	}
+	if _, err := net.Dial("tcp", listener.Addr().String()); err == nil {
+		t.Fatal("listener accepts after shutdown")
+	}
+}
+
+func Test_Server(t *testing.T) {
+	if _, err := mcproto.NewServer(newStore(), mcproto.BufferSize(0), mcproto.MaxConns(-1)); err == nil {
+		t.Fatal("invalid options accepted")
+	} else if perr := err.(*mcproto.ParamsError); len(perr.Problems) != 2 {
+		t.Fatalf("problems: %q", perr.Problems)
+	}
+
+	s, err := mcproto.NewServer(newStore(), mcproto.Deadline(5*time.Second), mcproto.MaxConns(1),
+		mcproto.AllowedCommands("get", "set"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error)
+	go func() { served <- s.Serve(listener) }()
+
+	conn, r := dial(t, listener)
+	defer conn.Close()
+	if got := call(t, conn, r, "set a 0 0 1\r\n1\r\ndelete a\r\n", 2); got != "STORED\r\nERROR\r\n" {
+		t.Fatalf("got %q", got)
+	}
+	full, fullR := dial(t, listener)
+	defer full.Close()
+	full.SetDeadline(time.Now().Add(time.Second))
+	if resp, err := ioutil.ReadAll(fullR); err != nil || string(resp) != "SERVER_ERROR too many open connections\r\n" {
+		t.Fatalf("over MaxConns: %q %v", resp, err)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-served; err != mcproto.ErrServerClosed {
+		t.Fatalf("Serve returned %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := r.ReadByte(); err == nil {
+		t.Fatal("connection open after Close")
+	}
+}
+
+func Test_Drain(t *testing.T) {
+	db := &slowStore{McEngine: newStore(), unblock: make(chan struct{})}
+	s, err := mcproto.NewServer(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(listener)
+
+	idle, idleR := dial(t, listener)
+	defer idle.Close()
+	if got := call(t, idle, idleR, "set a 0 0 1\r\n1\r\n", 1); got != "STORED\r\n" {
+		t.Fatalf("set: %q", got)
+	}
+	busy, busyR := dial(t, listener)
+	defer busy.Close()
+	busy.Write([]byte("get a\r\nget a\r\n"))
+	for executing := false; !executing; time.Sleep(time.Millisecond) {
+		for _, c := range mcproto.Conns() {
+			executing = executing || c.State == mcproto.StateExecute
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.Drain(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("drain of a busy server: %v", err)
+	}
+	idle.SetDeadline(time.Now().Add(time.Second))
+	if _, err := idleR.ReadByte(); err != io.EOF {
+		t.Fatalf("idle connection: %v", err)
+	}
+	if _, err := net.Dial("tcp", listener.Addr().String()); err == nil {
+		t.Fatal("listener accepts while draining")
+	}
+
+	close(db.unblock)
+	busy.SetDeadline(time.Now().Add(time.Second))
+	resp, err := ioutil.ReadAll(busyR)
+	if err != nil || string(resp) != "VALUE a 0 1\r\n1\r\nEND\r\nSERVER_ERROR shutting down\r\n" {
+		t.Fatalf("busy connection: %q %v", resp, err)
+	}
+	if err := s.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_ServerShutdown(t *testing.T) {
+	db := &slowStore{McEngine: newStore(), unblock: make(chan struct{})}
+	defer close(db.unblock)
+	s, err := mcproto.NewServer(db, mcproto.WithParams("flushdelay=10000000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(listener)
+
+	waitState := func(state mcproto.ConnState) {
+		for found := false; !found; time.Sleep(time.Millisecond) {
+			for _, c := range mcproto.Conns() {
+				found = found || c.State == state
+			}
+		}
+	}
+	busy, busyR := dial(t, listener)
+	defer busy.Close()
+	busy.Write([]byte("get a\r\n"))
+	waitState(mcproto.StateExecute)
+	// the response waiting for flushdelay is flushed before the close
+	delayed, delayedR := dial(t, listener)
+	defer delayed.Close()
+	delayed.Write([]byte("set a 0 0 1\r\n1\r\n"))
+	waitState(mcproto.StateWriteResponse)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("shutdown: %v", err)
+	}
+	delayed.SetDeadline(time.Now().Add(time.Second))
+	if resp, err := ioutil.ReadAll(delayedR); err != nil || string(resp) != "STORED\r\n" {
+		t.Fatalf("delayed response: %q %v", resp, err)
+	}
+	// the stuck get is cut off at the deadline
+	busy.SetDeadline(time.Now().Add(time.Second))
+	if resp, _ := ioutil.ReadAll(busyR); len(resp) != 0 {
+		t.Fatalf("busy connection: %q", resp)
+	}
+}
+
+func Test_AddReplace(t *testing.T) {
+	db := mcproto.NewTombstoneEngine(newStore(), time.Minute)
+	listener := serve(t, db, "strict=true")
+	defer listener.Close()
+	conn, r := dial(t, listener)
+	defer conn.Close()
+
+	for _, tc := range []struct{ req, want string }{
+		{"replace a 0 0 1\r\n1\r\n", "NOT_STORED\r\n"},
+		{"add a 0 0 1\r\n1\r\n", "STORED\r\n"},
+		{"add a 0 0 1\r\n2\r\n", "NOT_STORED\r\n"},
+		{"replace a 0 0 1\r\n3\r\n", "STORED\r\n"},
+		{"add a 0 0 1 noreply\r\n4\r\nget a\r\n", "VALUE a 0 1\r\n3\r\nEND\r\n"},
+		{"add a 0 0 1 2 3\r\n1\r\n", "CLIENT_ERROR usage: add <key> <flags> <exptime> <bytes> [noreply]\r\n"},
+		// a tombstoned key can't be added until set
+		{"delete a\r\n", "DELETED\r\n"},
+		{"add a 0 0 1\r\n5\r\n", "NOT_STORED\r\n"},
+		{"set a 0 0 1\r\n6\r\n", "STORED\r\n"},
+		{"replace a 0 0 1\r\n7\r\nget a\r\n", "STORED\r\nVALUE a 0 1\r\n7\r\nEND\r\n"},
+	} {
+		if got := call(t, conn, r, tc.req, strings.Count(tc.want, "\n")); got != tc.want {
+			t.Errorf("%q: got %q, want %q", tc.req, got, tc.want)
+		}
+	}
+
+	// binary add of an existing key answers key exists
+	if got := call(t, conn, r, "proto binary\r\n", 1); got != "OK\r\n" {
+		t.Fatalf("proto: %q", got)
+	}
+	conn.Write(binPacket(0x02, 1, make([]byte, 8), []byte("a"), []byte("8")))
+	if _, status, _, _, _, _ := readBinPacket(t, r); status != 0x02 {
+		t.Fatalf("binary add: status %x", status)
+	}
+}
+
+func Test_AppendPrepend(t *testing.T) {
+	db := newStore()
+	listener := serve(t, db, "")
+	defer listener.Close()
+	conn, r := dial(t, listener)
+	defer conn.Close()
+
+	for _, tc := range []struct{ req, want string }{
+		{"append a 0 0 1\r\n1\r\n", "NOT_STORED\r\n"},
+		{"set a 0 0 1\r\n2\r\n", "STORED\r\n"},
+		{"append a 5 0 1\r\n3\r\n", "STORED\r\n"},
+		{"prepend a 0 0 1 noreply\r\n1\r\nget a\r\n", "VALUE a 0 3\r\n123\r\nEND\r\n"},
+	} {
+		if got := call(t, conn, r, tc.req, strings.Count(tc.want, "\n")); got != tc.want {
+			t.Errorf("%q: got %q, want %q", tc.req, got, tc.want)
+		}
+	}
+
+	if got := call(t, conn, r, "proto binary\r\n", 1); got != "OK\r\n" {
+		t.Fatalf("proto: %q", got)
+	}
+	conn.Write(binPacket(0x0e, 1, nil, []byte("a"), []byte("4")))
+	if _, status, _, _, _, _ := readBinPacket(t, r); status != 0 {
+		t.Fatalf("binary append: status %x", status)
+	}
+	conn.Write(binPacket(0x0f, 2, nil, []byte("b"), []byte("0")))
+	if _, status, _, _, _, _ := readBinPacket(t, r); status != 0x05 {
+		t.Fatalf("binary prepend of a missing key: status %x", status)
+	}
+	if v, _, _ := db.Get([]byte("a"), nil); string(v) != "1234" {
+		t.Fatalf("value %q", v)
+	}
+}
+
+func Test_CAS(t *testing.T) {
+	listener := serve(t, newCASStore(), "strict=true")
+	defer listener.Close()
+	conn, r := dial(t, listener)
+	defer conn.Close()
+
+	for _, tc := range []struct{ req, want string }{
+		{"cas k 0 0 1 1\r\na\r\n", "NOT_FOUND\r\n"},
+		{"set k 0 0 1\r\nb\r\n", "STORED\r\n"},
+		{"cas k 0 0 1 1\r\nc\r\n", "STORED\r\n"},
+		{"cas k 0 0 1 1\r\nd\r\n", "EXISTS\r\n"},
+		{"cas k 0 0 1 2 noreply\r\ne\r\nmg k v c\r\n", "VA 1 c3\r\ne\r\n"},
+		{"cas k 0 0 1 x\r\nf\r\n", "CLIENT_ERROR bad cas unique\r\n"},
+	} {
+		if got := call(t, conn, r, tc.req, strings.Count(tc.want, "\n")); got != tc.want {
+			t.Errorf("%q: got %q, want %q", tc.req, got, tc.want)
+		}
+	}
+
+	// a binary set with a CAS is a cas
+	if got := call(t, conn, r, "proto binary\r\n", 1); got != "OK\r\n" {
+		t.Fatalf("proto: %q", got)
+	}
+	set := binPacket(0x01, 1, make([]byte, 8), []byte("k"), []byte("g"))
+	binary.BigEndian.PutUint64(set[16:], 1)
+	conn.Write(set)
+	if _, status, _, _, _, _ := readBinPacket(t, r); status != 0x02 {
+		t.Fatalf("binary cas conflict: status %x", status)
+	}
+	binary.BigEndian.PutUint64(set[16:], 3)
+	conn.Write(set)
+	if _, status, _, _, _, _ := readBinPacket(t, r); status != 0 {
+		t.Fatalf("binary cas: status %x", status)
+	}
+
+	// engines without CAS don't know the command
+	plain := serve(t, newStore(), "")
+	defer plain.Close()
+	conn2, r2 := dial(t, plain)
+	defer conn2.Close()
+	if got := call(t, conn2, r2, "cas k 0 0 1 1\r\na\r\n", 1); got != "ERROR\r\n" {
+		t.Fatalf("plain engine: %q", got)
+	}
+}
+
+func Test_Touch(t *testing.T) {
+	ms := newStore().(*mapStore)
+	listener := serve(t, ms, "strict=true&maxexp=100")
+	defer listener.Close()
+	conn, r := dial(t, listener)
+	defer conn.Close()
+
+	for _, tc := range []struct{ req, want string }{
+		{"touch k 10\r\n", "NOT_FOUND\r\n"},
+		{"set k 0 0 1\r\na\r\n", "STORED\r\n"},
+		{"touch k 10\r\n", "TOUCHED\r\n"},
+		{"touch k 1000 noreply\r\nget k\r\n", "VALUE k 0 1\r\na\r\nEND\r\n"},
+		{"touch k x\r\n", "CLIENT_ERROR bad exptime\r\n"},
+		{"touch k\r\n", "CLIENT_ERROR usage: touch <key> <exptime> [noreply]\r\n"},
+	} {
+		if got := call(t, conn, r, tc.req, strings.Count(tc.want, "\n")); got != tc.want {
+			t.Errorf("%q: got %q, want %q", tc.req, got, tc.want)
+		}
+	}
+	ms.RLock()
+	exp := ms.touched["k"]
+	ms.RUnlock()
+	if exp != 100 {
+		t.Errorf("Expected k touched with maxexp 100, got:%d", exp)
+	}
+
+	// engines without Toucher don't know the command
+	plain := serve(t, newCASStore(), "")
+	defer plain.Close()
+	conn2, r2 := dial(t, plain)
+	defer conn2.Close()
+	if got := call(t, conn2, r2, "touch k 10\r\n", 1); got != "ERROR\r\n" {
+		t.Fatalf("plain engine: %q", got)
+	}
+}
+
+// gatStore touches the items of a casStore as it gets them
+type gatStore struct {
+	*casStore
+	exps sync.Map // key -> exptime
+}
+
+func (s *gatStore) GetAndTouch(key []byte, exp int32) (mcproto.Item, error) {
+	it, err := s.GetItem(key)
+	if err == nil {
+		s.exps.Store(string(key), exp)
+	}
+	return it, err
+}
+
+func Test_GetAndTouch(t *testing.T) {
+	gs := &gatStore{casStore: newCASStore()}
+	listener := serve(t, gs, "strict=true")
+	defer listener.Close()
+	conn, r := dial(t, listener)
+	defer conn.Close()
+
+	for _, tc := range []struct{ req, want string }{
+		{"gat 10 a\r\n", "END\r\n"},
+		{"set a 0 0 1\r\n1\r\nset b 0 0 2\r\n22\r\n", "STORED\r\nSTORED\r\n"},
+		{"gat 10 a c b\r\n", "VALUE a 0 1\r\n1\r\nVALUE b 0 2\r\n22\r\nEND\r\n"},
+		{"gat 10 b a b\r\n", "VALUE b 0 2\r\n22\r\nVALUE a 0 1\r\n1\r\nVALUE b 0 2\r\n22\r\nEND\r\n"},
+		{"gats 20 b\r\n", "VALUE b 0 2 2\r\n22\r\nEND\r\n"},
+		{"gat x a\r\n", "CLIENT_ERROR bad exptime\r\n"},
+		{"gat 10\r\n", "CLIENT_ERROR usage: gat <exptime> <key>+\r\n"},
+	} {
+		if got := call(t, conn, r, tc.req, strings.Count(tc.want, "\n")); got != tc.want {
+			t.Errorf("%q: got %q, want %q", tc.req, got, tc.want)
+		}
+	}
+	for key, want := range map[string]int32{"a": 10, "b": 20} {
+		if exp, _ := gs.exps.Load(key); exp != want {
+			t.Errorf("Expected %s touched with %d, got:%v", key, want, exp)
+		}
+	}
+
+	// engines without GetToucher don't know the commands
+	plain := serve(t, newStore(), "")
+	defer plain.Close()
+	conn2, r2 := dial(t, plain)
+	defer conn2.Close()
+	if got := call(t, conn2, r2, "gat 10 a\r\n", 1); got != "ERROR\r\n" {
+		t.Fatalf("plain engine: %q", got)
+	}
+}
+
+// flushStore records the delays of flushes of a mapStore, clearing it at once for 0
+type flushStore struct {
+	*mapStore
+	delays []int32
+}
+
+func (s *flushStore) FlushAll(delay int32) error {
+	s.Lock()
+	defer s.Unlock()
+	s.delays = append(s.delays, delay)
+	if delay == 0 {
+		s.m = make(map[string]string)
+	}
+	return nil
+}
+
+func Test_FlushAll(t *testing.T) {
+	fs := &flushStore{mapStore: newStore().(*mapStore)}
+	listener := serve(t, fs, "strict=true")
+	defer listener.Close()
+	conn, r := dial(t, listener)
+	defer conn.Close()
+
+	for _, tc := range []struct{ req, want string }{
+		{"set k 0 0 1\r\na\r\n", "STORED\r\n"},
+		{"flush_all 60\r\n", "OK\r\n"},
+		{"get k\r\n", "VALUE k 0 1\r\na\r\nEND\r\n"},
+		{"flush_all noreply\r\nget k\r\n", "END\r\n"},
+		{"flush_all 10 noreply\r\nflush_all\r\n", "OK\r\n"},
+		{"flush_all -1\r\n", "CLIENT_ERROR bad delay\r\n"},
+		{"flush_all 1 2\r\n", "CLIENT_ERROR usage: flush_all [delay] [noreply]\r\n"},
+	} {
+		if got := call(t, conn, r, tc.req, strings.Count(tc.want, "\n")); got != tc.want {
+			t.Errorf("%q: got %q, want %q", tc.req, got, tc.want)
+		}
+	}
+	fs.RLock()
+	delays := fmt.Sprint(fs.delays)
+	fs.RUnlock()
+	if delays != "[60 0 10 0]" {
+		t.Errorf("Expected flushes [60 0 10 0], got:%s", delays)
+	}
+
+	// engines without Flusher don't know the command
+	plain := serve(t, newCASStore(), "")
+	defer plain.Close()
+	conn2, r2 := dial(t, plain)
+	defer conn2.Close()
+	if got := call(t, conn2, r2, "flush_all\r\n", 1); got != "ERROR\r\n" {
+		t.Fatalf("plain engine: %q", got)
+	}
+}
+
+// readStats sends a stats command and reads the STAT lines until END
+func readStats(t *testing.T, conn net.Conn, r *bufio.Reader, req string) map[string]string {
+	t.Helper()
+	conn.Write([]byte(req))
+	stats := map[string]string{}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line == "END\r\n" {
+			return stats
+		}
+		f := strings.Fields(line)
+		if len(f) != 3 || f[0] != "STAT" {
+			t.Fatalf("bad stat line %q", line)
+		}
+		stats[f[1]] = f[2]
+	}
+}
+
+// statsStore reports engine stats of a mapStore
+type statsStore struct {
+	*mapStore
+	fail   int32
+	resets int32
+}
+
+func (s *statsStore) ResetStats() error {
+	atomic.AddInt32(&s.resets, 1)
+	return nil
+}
+
+func (s *statsStore) Stats() (map[string]string, error) {
+	if atomic.LoadInt32(&s.fail) == 1 {
+		return nil, errors.New("stats unavailable")
+	}
+	s.RLock()
+	defer s.RUnlock()
+	return map[string]string{"curr_items": strconv.Itoa(len(s.m)), "total_items": "42"}, nil
+}
+
+func (s *statsStore) StatsGroup(group string) (map[string]string, error) {
+	switch group {
+	case "items":
+		return map[string]string{"items:1:number": "1", "items:1:age": "10"}, nil
+	case "settings":
+		return map[string]string{"item_size_max": "1048576"}, nil
+	}
+	return nil, mcproto.ErrUnsupported
+}
+
+func Test_StatsReset(t *testing.T) {
+	ss := &statsStore{mapStore: newStore().(*mapStore)}
+	listener := serve(t, ss, "")
+	defer listener.Close()
+	conn, r := dial(t, listener)
+	defer conn.Close()
+
+	call(t, conn, r, "set a 0 0 1\r\n1\r\nget a\r\n", 4)
+	if got := call(t, conn, r, "stats reset\r\n", 1); got != "RESET\r\n" {
+		t.Fatalf("reset: %q", got)
+	}
+	stats := readStats(t, conn, r, "stats\r\n")
+	if _, ok := stats["cmd_get"]; ok || stats["get_hits"] != "0" || stats["cmd_stats"] != "1" {
+		t.Errorf("stats after reset: %v", stats)
+	}
+	if stats["total_connections"] == "0" {
+		t.Errorf("total_connections reset")
+	}
+	if n := atomic.LoadInt32(&ss.resets); n != 1 {
+		t.Errorf("engine resets: %d", n)
+	}
+}
+
+func Test_StatsGroups(t *testing.T) {
+	listener := serve(t, &statsStore{mapStore: newStore().(*mapStore)}, "")
+	defer listener.Close()
+	conn, r := dial(t, listener)
+	defer conn.Close()
+
+	if got := call(t, conn, r, "stats items\r\n", 3); got != "STAT items:1:age 10\r\nSTAT items:1:number 1\r\nEND\r\n" {
+		t.Errorf("items: %q", got)
+	}
+	if settings := readStats(t, conn, r, "stats settings\r\n"); settings["item_size_max"] != "1048576" || settings["deadline"] != "1000" {
+		t.Errorf("settings: %v", settings)
+	}
+	// groups of memcached the engine lacks are empty, others unknown
+	for _, tc := range []struct{ req, want string }{
+		{"stats slabs\r\n", "END\r\n"},
+		{"stats sizes\r\n", "END\r\n"},
+		{"stats nonsense\r\n", "ERROR\r\n"},
+		{"stats items slabs\r\n", "ERROR\r\n"},
+	} {
+		if got := call(t, conn, r, tc.req, 1); got != tc.want {
+			t.Errorf("%q: got %q, want %q", tc.req, got, tc.want)
+		}
+	}
+
+	plain := serve(t, newStore(), "")
+	defer plain.Close()
+	conn2, r2 := dial(t, plain)
+	defer conn2.Close()
+	if got := call(t, conn2, r2, "stats items\r\n", 1); got != "END\r\n" {
+		t.Errorf("plain engine items: %q", got)
+	}
+}
+
+func Test_Stats(t *testing.T) {
+	ss := &statsStore{mapStore: newStore().(*mapStore)}
+	listener := serve(t, ss, "")
+	defer listener.Close()
+	conn, r := dial(t, listener)
+	defer conn.Close()
+
+	n := func(stats map[string]string, name string) int {
+		v, err := strconv.Atoi(stats[name])
+		if _, ok := stats[name]; ok && err != nil {
+			t.Fatalf("%s: %q", name, stats[name])
+		}
+		return v
+	}
+	before := readStats(t, conn, r, "stats\r\n")
+	call(t, conn, r, "set a 0 0 1\r\n1\r\nget a b\r\nget a\r\n", 7)
+	after := readStats(t, conn, r, "stats\r\n")
+	for name, want := range map[string]int{"cmd_get": 2, "cmd_set": 1, "cmd_stats": 1, "get_hits": 2, "get_misses": 1} {
+		if got := n(after, name) - n(before, name); got != want {
+			t.Errorf("%s: got %d more, want %d", name, got, want)
+		}
+	}
+	if n(after, "bytes_read") <= n(before, "bytes_read") || n(after, "bytes_written") <= n(before, "bytes_written") {
+		t.Errorf("bytes not counted: %v", after)
+	}
+	if n(after, "curr_connections") < 1 || after["curr_items"] != "1" || after["total_items"] != "42" {
+		t.Errorf("stats: %v", after)
+	}
+
+	atomic.StoreInt32(&ss.fail, 1)
+	if got := call(t, conn, r, "stats\r\n", 1); got != "SERVER_ERROR stats unavailable\r\n" {
+		t.Errorf("engine failure: %q", got)
+	}
+}
+
+func Test_StatsSettings(t *testing.T) {
+	listener := serve(t, newCASStore(), "maxkeys=5&allow=get,gets,set,cas,ttl,stats")
+	defer listener.Close()
+	conn, r := dial(t, listener)
+	defer conn.Close()
+
+	stats := readStats(t, conn, r, "stats settings\r\n")
+	// ttl needs TTLer, which casStore hides
+	for name, want := range map[string]string{
+		"maxkeys":   "5",
+		"protocols": "text,meta,binary",
+		"commands":  "cas,get,gets,set,stats",
+	} {
+		if stats[name] != want {
+			t.Errorf("%s: got %q, want %q", name, stats[name], want)
+		}
+	}
+	if got := call(t, conn, r, "stats nonsense\r\n", 1); got != "ERROR\r\n" {
+		t.Errorf("unknown stats: %q", got)
+	}
+}
+
+// refusingStore refuses the keys "unsupported" and "bad" of a mapStore
+type refusingStore struct {
+	*mapStore
+}
+
+func refusal(key []byte) error {
+	switch string(key) {
+	case "unsupported":
+		return mcproto.ErrUnsupported
+	case "bad":
+		return mcproto.ErrBadRequest
+	}
+	return nil
+}
+
+func (s refusingStore) Get(key []byte, rw *bufio.ReadWriter) ([]byte, bool, error) {
+	if err := refusal(key); err != nil {
+		return nil, false, err
+	}
+	return s.mapStore.Get(key, rw)
+}
+
+func (s refusingStore) Set(key, value []byte, flags uint32, exp int32, size int, noreply bool, rw *bufio.ReadWriter) (bool, error) {
+	if err := refusal(key); err != nil {
+		return false, err
+	}
+	return s.mapStore.Set(key, value, flags, exp, size, noreply, rw)
+}
+
+func (s refusingStore) Delete(key []byte, rw *bufio.ReadWriter) (bool, bool, error) {
+	if err := refusal(key); err != nil {
+		return false, false, err
+	}
+	return s.mapStore.Delete(key, rw)
+}
+
+func Test_EngineRefusals(t *testing.T) {
+	listener := serve(t, refusingStore{newStore().(*mapStore)}, "")
+	defer listener.Close()
+	conn, r := dial(t, listener)
+	defer conn.Close()
+
+	for _, tc := range []struct{ req, want string }{
+		{"get unsupported\r\n", "ERROR\r\n"},
+		{"get bad\r\n", "CLIENT_ERROR bad request\r\n"},
+		{"set unsupported 0 0 1\r\na\r\n", "ERROR\r\n"},
+		{"set bad 0 0 1\r\na\r\n", "CLIENT_ERROR bad request\r\n"},
+		{"delete bad\r\n", "CLIENT_ERROR bad request\r\n"},
+		// the connection stays usable
+		{"set k 0 0 1\r\na\r\n", "STORED\r\n"},
+		{"delete k\r\n", "DELETED\r\n"},
+	} {
+		if got := call(t, conn, r, tc.req, strings.Count(tc.want, "\n")); got != tc.want {
+			t.Errorf("%q: got %q, want %q", tc.req, got, tc.want)
+		}
+	}
+
+	// a wrapper over an engine without Adder refuses add like an unknown command
+	partial := serve(t, mcproto.NewTombstoneEngine(struct{ mcproto.McEngine }{newStore()}, time.Minute), "")
+	defer partial.Close()
+	conn2, r2 := dial(t, partial)
+	defer conn2.Close()
+	for _, req := range []string{"add a 0 0 1\r\n1\r\n", "replace a 0 0 1\r\n1\r\n"} {
+		if got := call(t, conn2, r2, req, 1); got != "ERROR\r\n" {
+			t.Errorf("%q over a partial engine: got %q", req, got)
+		}
+	}
+}
+
+func Test_WriteTracing(t *testing.T) {
+	mcproto.SetWriteTracing(2)
+	defer mcproto.SetWriteTracing(0)
+	engine, err := mcproto.EngineHandler(newStore(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := serveHandler(t, mcproto.HandlerFunc(func(w mcproto.ResponseWriter, r *mcproto.Request) {
+		mcproto.SetIdentity(r.Context(), "billing")
+		engine.ServeMC(w, r)
+	}))
+	defer listener.Close()
+	conn, r := dial(t, listener)
+	defer conn.Close()
+
+	call(t, conn, r, "set a 0 0 1\r\n1\r\nincr a 1\r\n", 2)
+	want := fmt.Sprintf("ME a cmd=incr id=billing addr=%s at=", conn.LocalAddr())
+	if got := call(t, conn, r, "me a\r\n", 1); !strings.HasPrefix(got, want) {
+		t.Fatalf("me: got %q, want %q...", got, want)
+	}
+	if got := call(t, conn, r, "me b\r\n", 1); got != "EN\r\n" {
+		t.Fatalf("me of an untraced key: %q", got)
+	}
+	// the oldest traces are forgotten
+	call(t, conn, r, "set b 0 0 1\r\n1\r\nset c 0 0 1\r\n1\r\n", 2)
+	if _, ok := mcproto.Traced([]byte("a")); ok {
+		t.Fatal("a still traced")
+	}
+	if wt, ok := mcproto.Traced([]byte("c")); !ok || wt.Command != mcproto.CmdSet || wt.Identity != "billing" {
+		t.Fatalf("trace of c: %+v %v", wt, ok)
+	}
+
+	mcproto.SetWriteTracing(0)
+	if got := call(t, conn, r, "me c\r\n", 1); got != "ERROR\r\n" {
+		t.Fatalf("me without tracing: %q", got)
+	}
+}
+
+func Test_Sampling(t *testing.T) {
+	var mu sync.Mutex
+	var samples []mcproto.CommandSample
+	mcproto.SetSampling(mcproto.Sampling{Rate: 2, Keys: mcproto.KeysHashed, Salt: "s", Log: func(s mcproto.CommandSample) {
+		mu.Lock()
+		samples = append(samples, s)
+		mu.Unlock()
+	}})
+	defer mcproto.SetSampling(mcproto.Sampling{})
+	listener := serve(t, newStore(), "")
+	defer listener.Close()
+	conn, r := dial(t, listener)
+	defer conn.Close()
+
+	want := "STORED\r\nSTORED\r\nVALUE secret 0 1\r\n1\r\nEND\r\nNOT_FOUND\r\n"
+	got := call(t, conn, r, "set secret 0 0 1\r\n1\r\nset secret 0 0 1\r\n1\r\nget secret\r\ndelete none\r\n", 6)
+	if got != want {
+		t.Fatalf("responses changed by sampling: %q", got)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(samples) != 2 {
+		t.Fatalf("%d samples", len(samples))
+	}
+	set, del := samples[0], samples[1]
+	if set.Command != "set" || set.Result != "STORED" || set.BytesIn != 21 || set.BytesOut != 8 || set.Keys != 1 {
+		t.Errorf("set sample %+v", set)
+	}
+	if del.Command != "delete" || del.Result != "NOT_FOUND" || del.Addr != conn.LocalAddr().String() {
+		t.Errorf("delete sample %+v", del)
+	}
+	if set.Key == "secret" || len(set.Key) != 16 || set.Key == del.Key {
+		t.Errorf("hashed keys %q %q", set.Key, del.Key)
+	}
+}
+
+// itemsStore returns multi-get items with flags 7
+type itemsStore struct {
+	*casStore
+}
+
+func (s itemsStore) GetItems(keys [][]byte) (items []mcproto.Item, err error) {
+	for _, key := range keys {
+		it, err := s.GetItem(key)
+		if err == mcproto.ErrCacheMiss {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		it.Flags = 7
+		items = append(items, it)
+	}
+	return
+}
+
+func Test_GetsCAS(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		db   mcproto.McEngine
+		want string
+	}{
+		{"CASGetter", newCASStore(), "VALUE a 0 1 1\r\n1\r\nVALUE b 0 2 2\r\n22\r\nEND\r\n"},
+		{"ItemsGetter", itemsStore{newCASStore()}, "VALUE a 7 1 1\r\n1\r\nVALUE b 7 2 2\r\n22\r\nEND\r\n"},
+	} {
+		listener := serve(t, tc.db, "")
+		conn, r := dial(t, listener)
+		call(t, conn, r, "set a 0 0 1\r\n1\r\nset b 0 0 2\r\n22\r\n", 2)
+		if got := call(t, conn, r, "gets a none b\r\n", 5); got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+		// the CAS of gets is accepted by cas
+		if got := call(t, conn, r, "cas b 0 0 1 2\r\n3\r\ngets none\r\n", 2); got != "STORED\r\nEND\r\n" {
+			t.Errorf("%s: cas with the gets CAS: %q", tc.name, got)
+		}
+		conn.Close()
+		listener.Close()
+	}
+}
+
+// reversingStore returns the items of an itemsStore in reverse order
+// and records the keys asked for
+type reversingStore struct {
+	itemsStore
+	asked chan string
+}
+
+func (s reversingStore) GetItems(keys [][]byte) ([]mcproto.Item, error) {
+	s.asked <- string(bytes.Join(keys, []byte(" ")))
+	items, err := s.itemsStore.GetItems(keys)
+	for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
+		items[i], items[j] = items[j], items[i]
+	}
+	return items, err
+}
+
+func Test_GetsOrder(t *testing.T) {
+	db := reversingStore{itemsStore{newCASStore()}, make(chan string, 1)}
+	listener := serve(t, db, "")
+	defer listener.Close()
+	conn, r := dial(t, listener)
+	defer conn.Close()
+
+	call(t, conn, r, "set a 0 0 1\r\n1\r\nset b 0 0 2\r\n22\r\n", 2)
+	want := "VALUE b 7 2 2\r\n22\r\nVALUE a 7 1 1\r\n1\r\nVALUE b 7 2 2\r\n22\r\nEND\r\n"
+	if got := call(t, conn, r, "gets b a none b\r\n", 7); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if asked := <-db.asked; asked != "b a none" {
+		t.Errorf("engine asked for %q", asked)
+	}
+
+	gets := reversedGets{newStore().(*mapStore), make(chan string, 1)}
+	for name, db := range map[string]mcproto.McEngine{"Gets": gets, "GetsStream": reversedStream{gets}} {
+		listener := serve(t, db, "")
+		defer listener.Close()
+		conn, r := dial(t, listener)
+		defer conn.Close()
+		call(t, conn, r, "set a 0 0 1\r\n1\r\nset b 0 0 2\r\n22\r\n", 2)
+		want := "VALUE b 0 2\r\n22\r\nVALUE a 0 1\r\n1\r\nVALUE b 0 2\r\n22\r\nEND\r\n"
+		if got := call(t, conn, r, "get b a none b\r\n", 7); got != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+		if asked := <-gets.asked; asked != "b a none" {
+			t.Errorf("%s: engine asked for %q", name, asked)
+		}
+	}
+}
+
+// reversedGets answers the multi-gets of a mapStore in reverse order
+// and records the keys asked for
+type reversedGets struct {
+	*mapStore
+	asked chan string
+}
+
+func (s reversedGets) Gets(keys [][]byte, rw *bufio.ReadWriter) ([][]byte, error) {
+	s.asked <- string(bytes.Join(keys, []byte(" ")))
+	reversed := make([][]byte, len(keys))
+	for i, key := range keys {
+		reversed[len(keys)-1-i] = key
+	}
+	return s.mapStore.Gets(reversed, rw)
+}
+
+// reversedStream is a reversedGets streaming its multi-gets
+type reversedStream struct {
+	reversedGets
+}
+
+func (s reversedStream) GetsStream(keys [][]byte, emit func(key, value []byte) error) error {
+	s.asked <- string(bytes.Join(keys, []byte(" ")))
+	for i := len(keys) - 1; i >= 0; i-- {
+		if v, _, _ := s.Get(keys[i], nil); v != nil {
+			if err := emit(keys[i], v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func Test_Version(t *testing.T) {
+	if err := mcproto.ValidateParams("version=1.6 beta"); err == nil {
+		t.Fatal("version with a space accepted")
+	}
+	s, err := mcproto.NewServer(newStore(), mcproto.Version("1.6.21"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(listener)
+	defer s.Close()
+
+	conn, r := dial(t, listener)
+	defer conn.Close()
+	for _, tc := range []struct{ req, want string }{
+		{"version\r\n", "VERSION 1.6.21\r\n"},
+		{"version x\r\n", "ERROR\r\n"},
+		{"proto binary\r\n", "OK\r\n"},
+	} {
+		if got := call(t, conn, r, tc.req, 1); got != tc.want {
+			t.Errorf("%q: got %q, want %q", tc.req, got, tc.want)
+		}
+	}
+	conn.Write(binPacket(0x0b, 1, nil, nil, nil))
+	if _, status, _, _, _, value := readBinPacket(t, r); status != 0 || string(value) != "1.6.21" {
+		t.Errorf("binary version: %x %q", status, value)
+	}
+
+	plain := serve(t, newStore(), "")
+	defer plain.Close()
+	conn2, r2 := dial(t, plain)
+	defer conn2.Close()
+	if got := call(t, conn2, r2, "version\r\n", 1); got != "VERSION mcproto\r\n" {
+		t.Errorf("default version: %q", got)
+	}
+}
+
+func Test_MaxItem(t *testing.T) {
+	listener := serve(t, newStore(), "maxitem=4")
+	defer listener.Close()
+	for _, req := range []string{"set k 0 0 5\r\n", "set k 0 0 9223372036854775806\r\n", "lpush k 4294967296\r\n"} {
+		conn, r := dial(t, listener)
+		if got := call(t, conn, r, "set k 0 0 4\r\nabcd\r\n", 1); got != "STORED\r\n" {
+			t.Fatalf("item at the limit: %q", got)
+		}
+		// refused before the value is read, the connection is closed
+		if got := call(t, conn, r, req, 1); got != "CLIENT_ERROR object too large for cache\r\n" {
+			t.Errorf("%q: got %q", req, got)
+		}
+		if _, err := r.ReadByte(); err != io.EOF {
+			t.Errorf("%q left the connection open: %v", req, err)
+		}
+		conn.Close()
+	}
+
+	conn, r := dial(t, listener)
+	defer conn.Close()
+	call(t, conn, r, "proto binary\r\n", 1)
+	conn.SetDeadline(time.Now().Add(time.Second))
+	conn.Write(binPacket(0x01, 1, make([]byte, 8), []byte("key"), []byte("12345")))
+	if _, status, opaque, _, _, _ := readBinPacket(t, r); status != 0x03 || opaque != 1 {
+		t.Fatalf("binary value over maxitem: %x %d", status, opaque)
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Fatalf("binary value over maxitem left the connection open: %v", err)
+	}
+}
+
+func Test_Verbosity(t *testing.T) {
+	logs := &lockedBuffer{}
+	log.SetOutput(logs)
+	defer log.SetOutput(os.Stderr)
+	listener := serve(t, failingStore{newStore().(*mapStore)}, "")
+	defer listener.Close()
+	conn, r := dial(t, listener)
+	defer conn.Close()
+	defer call(t, conn, r, "verbosity 1\r\n", 1)
+
+	for level, want := range []struct{ errors, commands bool }{{false, false}, {true, false}, {true, true}} {
+		if got := call(t, conn, r, fmt.Sprintf("verbosity %d\r\n", level), 1); got != "OK\r\n" {
+			t.Fatalf("verbosity %d: %q", level, got)
+		}
+		logs.Reset()
+		call(t, conn, r, "get a\r\n", 1)
+		got := logs.String()
+		if strings.Contains(got, "disk gone\n") != want.errors || strings.Contains(got, ": get\n") != want.commands {
+			t.Errorf("verbosity %d logged %q", level, got)
+		}
+	}
+	// the admin endpoint doesn't lower the level, but stops logging
+	admin := mcproto.NewAdmin("secret", "")
+	for _, connerr := range []string{"1", "0"} {
+		req := httptest.NewRequest("POST", "/debug?connerr="+connerr, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		admin.ServeHTTP(httptest.NewRecorder(), req)
+		logs.Reset()
+		call(t, conn, r, "get a\r\n", 1)
+		if got := logs.String(); connerr == "1" && !strings.Contains(got, ": get\n") || connerr == "0" && got != "" {
+			t.Errorf("connerr=%s logged %q", connerr, got)
+		}
+	}
+
+	for _, tc := range []struct{ req, want string }{
+		{"verbosity 1\r\n", "OK\r\n"},
+		{"verbosity 0 noreply\r\nversion\r\n", "VERSION mcproto\r\n"},
+		{"verbosity\r\n", "ERROR\r\n"},
+		{"verbosity x\r\n", "ERROR\r\n"},
+		{"verbosity -1\r\n", "ERROR\r\n"},
+		{"verbosity 1 x\r\n", "ERROR\r\n"},
+		{"verbosity 2\r\n", "OK\r\n"},
+		{"version\r\n", "VERSION mcproto\r\n"},
+	} {
+		if got := call(t, conn, r, tc.req, 1); got != tc.want {
+			t.Errorf("%q: got %q, want %q", tc.req, got, tc.want)
+		}
+	}
+
+	strict := serve(t, newStore(), "strict=true")
+	defer strict.Close()
+	conn2, r2 := dial(t, strict)
+	defer conn2.Close()
+	for _, tc := range []struct{ req, want string }{
+		{"verbosity 1 2\r\n", "CLIENT_ERROR usage: verbosity <level> [noreply]\r\n"},
+		{"verbosity -1\r\n", "CLIENT_ERROR bad level\r\n"},
+		{"verbosity 0\r\n", "OK\r\n"},
+	} {
+		if got := call(t, conn2, r2, tc.req, 1); got != tc.want {
+			t.Errorf("strict %q: got %q, want %q", tc.req, got, tc.want)
+		}
+	}
+}
+
+// failingStore fails every get
+type failingStore struct {
+	*mapStore
+}
+
+func (s failingStore) Get(key []byte, rw *bufio.ReadWriter) ([]byte, bool, error) {
+	return nil, false, errors.New("disk gone")
+}
+
+// lockedBuffer is a bytes.Buffer written by server goroutines
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func (b *lockedBuffer) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buf.Reset()
+}
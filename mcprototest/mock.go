@@ -0,0 +1,235 @@
+// Package mcprototest provides utilities for testing code that programs
+// against mcproto.McEngine.
+package mcprototest
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/recoilme/mcproto"
+)
+
+// ErrUnexpectedCall is returned by MockEngine methods that don't match
+// the next expectation
+var ErrUnexpectedCall = errors.New("mcprototest: unexpected call")
+
+// MockEngine is an McEngine that checks calls against ordered expectations.
+// Every call must match the next expectation, otherwise the test fails and
+// the call returns ErrUnexpectedCall. It is safe for concurrent use.
+type MockEngine struct {
+	t testing.TB
+
+	mu       sync.Mutex
+	expected []*Call
+}
+
+// Call is an expected method call and its results
+type Call struct {
+	method string
+	args   [][]byte
+
+	value    []byte
+	keysvals [][]byte
+	result   uint64
+	found    bool
+	err      error
+}
+
+// NewMockEngine returns a mock reporting failures to t
+func NewMockEngine(t testing.TB) *MockEngine {
+	return &MockEngine{t: t}
+}
+
+func (m *MockEngine) expect(method string, args ...[]byte) *Call {
+	c := &Call{method: method, args: args}
+	m.mu.Lock()
+	m.expected = append(m.expected, c)
+	m.mu.Unlock()
+	return c
+}
+
+// ExpectGet expects Get of key, a miss unless Return sets a value
+func (m *MockEngine) ExpectGet(key string) *Call {
+	return m.expect("Get", []byte(key))
+}
+
+// ExpectGets expects Gets of keys, Return sets alternating keys and values
+func (m *MockEngine) ExpectGets(keys ...string) *Call {
+	args := make([][]byte, len(keys))
+	for i, key := range keys {
+		args[i] = []byte(key)
+	}
+	return m.expect("Gets", args...)
+}
+
+// ExpectSet expects Set of key to value
+func (m *MockEngine) ExpectSet(key, value string) *Call {
+	return m.expect("Set", []byte(key), []byte(value))
+}
+
+// ExpectIncr expects Incr of key by delta, Return sets the result and found
+func (m *MockEngine) ExpectIncr(key string, delta uint64) *Call {
+	return m.expect("Incr", []byte(key), []byte(fmt.Sprint(delta)))
+}
+
+// ExpectDecr expects Decr of key by delta, Return sets the result and found
+func (m *MockEngine) ExpectDecr(key string, delta uint64) *Call {
+	return m.expect("Decr", []byte(key), []byte(fmt.Sprint(delta)))
+}
+
+// ExpectDelete expects Delete of key, Return sets found
+func (m *MockEngine) ExpectDelete(key string) *Call {
+	return m.expect("Delete", []byte(key))
+}
+
+// ExpectClose expects Close
+func (m *MockEngine) ExpectClose() *Call {
+	return m.expect("Close")
+}
+
+// Return sets the results of the call by type: []byte is the Get value,
+// [][]byte the Gets keysvals, uint64 the Incr/Decr result, bool found
+// and error the returned error. It panics on other types.
+func (c *Call) Return(results ...interface{}) *Call {
+	for _, r := range results {
+		switch v := r.(type) {
+		case []byte:
+			c.value = v
+		case string:
+			c.value = []byte(v)
+		case [][]byte:
+			c.keysvals = v
+		case uint64:
+			c.result = v
+		case bool:
+			c.found = v
+		case error:
+			c.err = v
+		case nil:
+		default:
+			panic(fmt.Sprintf("mcprototest: unsupported result %T", r))
+		}
+	}
+	return c
+}
+
+func (c *Call) String() string {
+	args := make([]string, len(c.args))
+	for i, a := range c.args {
+		args[i] = fmt.Sprintf("%q", a)
+	}
+	return c.method + "(" + strings.Join(args, ", ") + ")"
+}
+
+// call pops the next expectation if it matches method and args
+func (m *MockEngine) call(method string, args ...[]byte) (*Call, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	got := &Call{method: method, args: args}
+	if len(m.expected) == 0 {
+		m.t.Errorf("mcprototest: unexpected call %s, no more expectations", got)
+		return nil, ErrUnexpectedCall
+	}
+	next := m.expected[0]
+	if next.method != method || !equalArgs(next.args, args) {
+		m.t.Errorf("mcprototest: unexpected call %s, expected %s", got, next)
+		return nil, ErrUnexpectedCall
+	}
+	m.expected = m.expected[1:]
+	return next, nil
+}
+
+func equalArgs(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Verify fails the test if some expectations were not called
+func (m *MockEngine) Verify() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, c := range m.expected {
+		m.t.Errorf("mcprototest: expected call %s was not made", c)
+	}
+}
+
+func (m *MockEngine) Get(key []byte, rw *bufio.ReadWriter) (value []byte, noreply bool, err error) {
+	c, err := m.call("Get", key)
+	if err != nil {
+		return
+	}
+	return c.value, false, c.err
+}
+
+// Gets writes the VALUE lines of the returned keysvals and END to rw, like engines do
+func (m *MockEngine) Gets(keys [][]byte, rw *bufio.ReadWriter) (keysvals [][]byte, err error) {
+	c, err := m.call("Gets", keys...)
+	if err != nil {
+		return
+	}
+	if c.err != nil {
+		return nil, c.err
+	}
+	if rw != nil {
+		for i := 0; i+1 < len(c.keysvals); i += 2 {
+			fmt.Fprintf(rw, "VALUE %s 0 %d\r\n%s\r\n", c.keysvals[i], len(c.keysvals[i+1]), c.keysvals[i+1])
+		}
+		rw.WriteString("END\r\n")
+		err = rw.Flush()
+	}
+	return c.keysvals, err
+}
+
+func (m *MockEngine) Set(key, value []byte, flags uint32, exp int32, size int, noreply bool, rw *bufio.ReadWriter) (noreplyresp bool, err error) {
+	c, err := m.call("Set", key, value)
+	if err != nil {
+		return
+	}
+	return false, c.err
+}
+
+func (m *MockEngine) Incr(key []byte, value uint64, rw *bufio.ReadWriter) (result uint64, isFound bool, noreply bool, err error) {
+	c, err := m.call("Incr", key, []byte(fmt.Sprint(value)))
+	if err != nil {
+		return
+	}
+	return c.result, c.found, false, c.err
+}
+
+func (m *MockEngine) Decr(key []byte, value uint64, rw *bufio.ReadWriter) (result uint64, isFound bool, noreply bool, err error) {
+	c, err := m.call("Decr", key, []byte(fmt.Sprint(value)))
+	if err != nil {
+		return
+	}
+	return c.result, c.found, false, c.err
+}
+
+func (m *MockEngine) Delete(key []byte, rw *bufio.ReadWriter) (isFound bool, noreply bool, err error) {
+	c, err := m.call("Delete", key)
+	if err != nil {
+		return
+	}
+	return c.found, false, c.err
+}
+
+func (m *MockEngine) Close() error {
+	c, err := m.call("Close")
+	if err != nil {
+		return err
+	}
+	return c.err
+}
+
+var _ mcproto.McEngine = (*MockEngine)(nil)
@@ -0,0 +1,86 @@
+package mcprototest_test
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/recoilme/mcproto"
+	"github.com/recoilme/mcproto/mcprototest"
+)
+
+// recorder collects failures instead of failing the test
+type recorder struct {
+	testing.TB
+	mu   sync.Mutex
+	errs []string
+}
+
+func (r *recorder) Errorf(format string, args ...interface{}) {
+	r.mu.Lock()
+	r.errs = append(r.errs, fmt.Sprintf(format, args...))
+	r.mu.Unlock()
+}
+
+func Test_MockEngine(t *testing.T) {
+	m := mcprototest.NewMockEngine(t)
+	m.ExpectSet("k", "v")
+	m.ExpectGet("k").Return("v")
+	m.ExpectGet("gone").Return(mcproto.ErrCacheMiss)
+	m.ExpectIncr("n", 2).Return(uint64(12), true)
+	m.ExpectDelete("k").Return(true)
+	m.ExpectClose()
+
+	var db mcproto.McEngine = m
+	if _, err := db.Set([]byte("k"), []byte("v"), 0, 0, 1, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if v, _, err := db.Get([]byte("k"), nil); string(v) != "v" || err != nil {
+		t.Fatalf("get: %q %v", v, err)
+	}
+	if _, _, err := db.Get([]byte("gone"), nil); err != mcproto.ErrCacheMiss {
+		t.Fatalf("miss: %v", err)
+	}
+	if n, found, _, _ := db.Incr([]byte("n"), 2, nil); n != 12 || !found {
+		t.Fatalf("incr: %d %v", n, found)
+	}
+	if found, _, _ := db.Delete([]byte("k"), nil); !found {
+		t.Fatal("delete")
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	m.Verify()
+}
+
+func Test_MockEngineFailures(t *testing.T) {
+	rec := &recorder{TB: t}
+	m := mcprototest.NewMockEngine(rec)
+	m.ExpectGet("a")
+	m.ExpectGet("b")
+	if _, _, err := m.Get([]byte("b"), nil); err != mcprototest.ErrUnexpectedCall {
+		t.Fatalf("out of order: %v", err)
+	}
+	m.Verify()
+	if len(rec.errs) != 3 || !strings.Contains(rec.errs[0], `Get("b"), expected Get("a")`) {
+		t.Fatalf("failures %q", rec.errs)
+	}
+}
+
+func Test_MockEngineConcurrent(t *testing.T) {
+	m := mcprototest.NewMockEngine(t)
+	for i := 0; i < 100; i++ {
+		m.ExpectDelete("k")
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.Delete([]byte("k"), nil)
+		}()
+	}
+	wg.Wait()
+	m.Verify()
+}
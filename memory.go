@@ -0,0 +1,174 @@
+package mcproto
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Pressure is a memory pressure level
+type Pressure int32
+
+// Memory pressure levels
+const (
+	PressureNone     Pressure = iota
+	PressureHigh              // heap reached MemoryBudget.High of the limit
+	PressureCritical          // heap reached MemoryBudget.Critical of the limit
+)
+
+var pressureNames = [...]string{"none", "high", "critical"}
+
+func (p Pressure) String() string {
+	if p < 0 || int(p) >= len(pressureNames) {
+		return fmt.Sprintf("pressure(%d)", int(p))
+	}
+	return pressureNames[p]
+}
+
+// MemoryBudget configures the memory pressure watcher. The heap is checked
+// every Interval against Limit, and OnMemoryPressure callbacks run while
+// it is above High of Limit, so engines can shrink before the OOM killer
+// steps in. Set GOMEMLIMIT somewhat above Limit to make the GC work harder first.
+type MemoryBudget struct {
+	Limit    uint64        // heap bytes, 0 disables the watcher
+	High     float64       // fraction of Limit, default 0.8
+	Critical float64       // fraction of Limit, default 0.95
+	Interval time.Duration // default 1s
+}
+
+// MemoryStats are memory pressure counters
+type MemoryStats struct {
+	Level    Pressure `json:"level"`
+	Heap     uint64   `json:"heap"` // at the last check
+	Limit    uint64   `json:"limit"`
+	High     uint64   `json:"high"`     // checks at high pressure
+	Critical uint64   `json:"critical"` // checks at critical pressure
+}
+
+// PressureFunc is called with the pressure level, the heap size and the limit
+type PressureFunc func(level Pressure, heap, limit uint64)
+
+type memoryWatcher struct {
+	budget MemoryBudget
+	stop   chan struct{}
+
+	level    int32
+	heap     uint64
+	high     uint64
+	critical uint64
+}
+
+var (
+	memoryMu      sync.Mutex
+	memory        atomic.Value // *memoryWatcher
+	pressureFuncs atomic.Value // []*PressureFunc, copy on write
+)
+
+func init() {
+	memory.Store(&memoryWatcher{})
+	pressureFuncs.Store([]*PressureFunc{})
+}
+
+// SetMemoryBudget starts watching the heap against b, replacing the previous budget
+func SetMemoryBudget(b MemoryBudget) {
+	if b.High <= 0 || b.High >= 1 {
+		b.High = 0.8
+	}
+	if b.Critical <= b.High || b.Critical > 1 {
+		b.Critical = 0.95
+	}
+	if b.Interval <= 0 {
+		b.Interval = time.Second
+	}
+	memoryMu.Lock()
+	defer memoryMu.Unlock()
+	old := memory.Load().(*memoryWatcher)
+	if old.stop != nil {
+		close(old.stop)
+	}
+	w := &memoryWatcher{budget: b}
+	if b.Limit > 0 {
+		// keep the level, so relief under the new budget is reported
+		w.level = atomic.LoadInt32(&old.level)
+		w.stop = make(chan struct{})
+		go w.run()
+	}
+	memory.Store(w)
+}
+
+// OnMemoryPressure registers fn, called after every check at high or critical
+// pressure and once when the pressure is back to none. It returns a func
+// removing fn.
+func OnMemoryPressure(fn PressureFunc) (remove func()) {
+	p := &fn
+	memoryMu.Lock()
+	old := pressureFuncs.Load().([]*PressureFunc)
+	pressureFuncs.Store(append(old[:len(old):len(old)], p))
+	memoryMu.Unlock()
+	return func() {
+		memoryMu.Lock()
+		defer memoryMu.Unlock()
+		old := pressureFuncs.Load().([]*PressureFunc)
+		list := make([]*PressureFunc, 0, len(old))
+		for _, f := range old {
+			if f != p {
+				list = append(list, f)
+			}
+		}
+		pressureFuncs.Store(list)
+	}
+}
+
+// Memory returns memory pressure counters
+func Memory() MemoryStats {
+	w := memory.Load().(*memoryWatcher)
+	return MemoryStats{
+		Level:    Pressure(atomic.LoadInt32(&w.level)),
+		Heap:     atomic.LoadUint64(&w.heap),
+		Limit:    w.budget.Limit,
+		High:     atomic.LoadUint64(&w.high),
+		Critical: atomic.LoadUint64(&w.critical),
+	}
+}
+
+func (w *memoryWatcher) run() {
+	t := time.NewTicker(w.budget.Interval)
+	defer t.Stop()
+	for {
+		w.check()
+		select {
+		case <-t.C:
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+func (w *memoryWatcher) check() {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	heap := m.HeapAlloc
+	atomic.StoreUint64(&w.heap, heap)
+
+	level := PressureNone
+	switch limit := float64(w.budget.Limit); {
+	case float64(heap) >= w.budget.Critical*limit:
+		level = PressureCritical
+		atomic.AddUint64(&w.critical, 1)
+	case float64(heap) >= w.budget.High*limit:
+		level = PressureHigh
+		atomic.AddUint64(&w.high, 1)
+	}
+	prev := Pressure(atomic.SwapInt32(&w.level, int32(level)))
+	if level != prev && hasSubscribers() {
+		Publish(Event{Type: EventMemoryPressure, Pressure: level})
+	}
+	if level == PressureNone && prev == PressureNone {
+		return
+	}
+	for _, fn := range pressureFuncs.Load().([]*PressureFunc) {
+		(*fn)(level, heap, w.budget.Limit)
+	}
+}
@@ -0,0 +1,187 @@
+package mcproto
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+)
+
+// CASGetter is an optional interface for engines versioning items with
+// CAS unique values, which change on every write of a key
+type CASGetter interface {
+	// GetItem returns the item of key with its CAS, ErrCacheMiss if there is none
+	GetItem(key []byte) (Item, error)
+}
+
+// ItemsGetter is an optional interface for engines returning the items of
+// a multi-get, so the server writes the responses. GetItems returns the
+// items of the keys found, with their keys, flags and CAS. It serves gets, which
+// answers CAS unique values: VALUE <key> <flags> <bytes> <cas>. Engines
+// with only CASGetter get a GetItem call per key instead.
+type ItemsGetter interface {
+	GetItems(keys [][]byte) ([]Item, error)
+}
+
+var (
+	resultMetaValue       = []byte("VA ")
+	resultMetaHit         = []byte("HD")
+	resultMetaMiss        = []byte("EN\r\n")
+	resultMetaNotModified = []byte("NM")
+)
+
+// getsItems serves "gets <key>*" with the items of ItemsGetter or CASGetter.
+// The engine is asked once per key, items are answered in the order of
+// the keys and repeated for repeated keys, whatever the engine returns.
+func (h *engineHandler) getsItems(w ResponseWriter, r *Request) (err error) {
+	keys := uniqueKeys(r.Args)
+	found := make(map[string]Item, len(keys))
+	if ig, ok := h.db.(ItemsGetter); ok {
+		var items []Item
+		items, err = ig.GetItems(keys)
+		for _, it := range items {
+			found[string(it.Key)] = it
+		}
+	} else {
+		cg := h.db.(CASGetter)
+		for _, key := range keys {
+			it, gerr := cg.GetItem(key)
+			if gerr == ErrCacheMiss || (gerr == nil && !h.cfg.hit(it.Value, nil)) {
+				continue
+			}
+			if err = gerr; err != nil {
+				break
+			}
+			found[string(key)] = it
+		}
+	}
+	if err != nil {
+		connError(r.RemoteAddr, err)
+		return engineError(w.ReadWriter(), err)
+	}
+	for _, key := range r.Args {
+		it, ok := found[string(key)]
+		if !ok {
+			continue
+		}
+		if _, err = fmt.Fprintf(w, "VALUE %s %d %d %d\r\n%s\r\n", key, it.Flags, len(it.Value), it.CAS, it.Value); err != nil {
+			return
+		}
+		h.hit(key)
+	}
+	if _, err = w.Write(resultEnd); err != nil {
+		return
+	}
+	return w.Flush()
+}
+
+// uniqueKeys returns keys without repeats, in the order of first occurrence
+func uniqueKeys(keys [][]byte) [][]byte {
+	if len(keys) < 2 {
+		return keys
+	}
+	seen := make(map[string]bool, len(keys))
+	unique := make([][]byte, 0, len(keys))
+	for _, key := range keys {
+		if !seen[string(key)] {
+			seen[string(key)] = true
+			unique = append(unique, key)
+		}
+	}
+	return unique
+}
+
+// metaGet serves "mg <key> <flags>*". Flags: v value, f client flags,
+// c CAS, k key, s size, q no miss response, O<token> opaque echoed back.
+// The extension flag C<cas> makes the get conditional: if the item still
+// has that CAS the response is NM with the requested flags but no value,
+// saving bandwidth for large frequently polled items.
+func (h *engineHandler) metaGet(w ResponseWriter, r *Request) (err error) {
+	if len(r.Args) == 0 || !bytes.HasSuffix(r.Line, crlf) {
+		return h.badLine(w, r)
+	}
+	getKeys.inc()
+	key, flags := r.Args[0], r.Args[1:]
+	var value, quiet, hasCAS bool
+	var cas uint64
+	for _, f := range flags {
+		switch {
+		case len(f) == 1 && bytes.IndexByte([]byte("vfcksq"), f[0]) >= 0:
+			value = value || f[0] == 'v'
+			quiet = quiet || f[0] == 'q'
+		case f[0] == 'O':
+		case f[0] == 'C':
+			if cas, err = strconv.ParseUint(string(f[1:]), 10, 64); err != nil {
+				return clientError(w.ReadWriter(), "bad CAS value")
+			}
+			hasCAS = true
+		default:
+			return clientError(w.ReadWriter(), "invalid flag")
+		}
+	}
+
+	var it Item
+	var hit, versioned bool
+	if cg, ok := h.db.(CASGetter); ok {
+		it, err = cg.GetItem(key)
+		hit, versioned = h.cfg.hit(it.Value, err), true
+	} else {
+		it.Value, _, err = h.db.Get(key, w.ReadWriter())
+		hit = h.cfg.hit(it.Value, err)
+		if rel, ok := h.db.(ValueReleaser); ok && it.Value != nil {
+			defer rel.Release(it.Value)
+		}
+	}
+	if refused(err) {
+		return engineError(w.ReadWriter(), err)
+	}
+	if err != nil && err != ErrCacheMiss {
+		connError(r.RemoteAddr, err)
+	}
+	if !hit {
+		if quiet {
+			return nil
+		}
+		if _, err = w.Write(resultMetaMiss); err != nil {
+			return
+		}
+		return w.Flush()
+	}
+	h.hit(key)
+
+	// without CAS support an item is never known to be unchanged
+	notModified := hasCAS && versioned && it.CAS == cas
+	var ret []byte
+	for _, f := range flags {
+		switch f[0] {
+		case 'f':
+			ret = strconv.AppendUint(append(ret, " f"...), uint64(it.Flags), 10)
+		case 'c':
+			ret = strconv.AppendUint(append(ret, " c"...), it.CAS, 10)
+		case 'k':
+			ret = append(append(ret, " k"...), key...)
+		case 's':
+			ret = strconv.AppendInt(append(ret, " s"...), int64(len(it.Value)), 10)
+		case 'O':
+			ret = append(append(ret, ' '), f...)
+		}
+	}
+	rw := w.ReadWriter()
+	switch {
+	case notModified:
+		rw.Write(resultMetaNotModified)
+		rw.Write(ret)
+		rw.Write(crlf)
+	case value:
+		rw.Write(resultMetaValue)
+		rw.WriteString(strconv.Itoa(len(it.Value)))
+		rw.Write(ret)
+		rw.Write(crlf)
+		rw.Write(it.Value)
+		rw.Write(crlf)
+	default:
+		rw.Write(resultMetaHit)
+		rw.Write(ret)
+		rw.Write(crlf)
+	}
+	return w.Flush()
+}
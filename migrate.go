@@ -0,0 +1,142 @@
+package mcproto
+
+import (
+	"bufio"
+	"sync/atomic"
+)
+
+// MigrateEngine moves a cache tier from Old to New engine without downtime.
+// Reads try New and fall back to Old on a miss, writes go to both.
+// After Cutover all commands are served by New only.
+// Optional interfaces of the wrapped engines are not exposed.
+type MigrateEngine struct {
+	reads     counter
+	fallbacks counter
+	oldHits   counter
+	writes    counter
+	cutover   int32
+
+	Old McEngine
+	New McEngine
+}
+
+// MigrateStats is a snapshot of migration progress counters
+type MigrateStats struct {
+	Reads     uint64 // keys read
+	Fallbacks uint64 // keys missed in New and looked up in Old
+	OldHits   uint64 // keys found in Old only
+	Writes    uint64 // mutations applied
+	Cutover   bool
+}
+
+// NewMigrateEngine returns engine migrating from old to new
+func NewMigrateEngine(old, new McEngine) *MigrateEngine {
+	return &MigrateEngine{Old: old, New: new}
+}
+
+// Cutover switches all traffic to New engine
+func (m *MigrateEngine) Cutover() {
+	atomic.StoreInt32(&m.cutover, 1)
+}
+
+func (m *MigrateEngine) isCutover() bool {
+	return atomic.LoadInt32(&m.cutover) == 1
+}
+
+// Stats returns migration progress counters
+func (m *MigrateEngine) Stats() MigrateStats {
+	return MigrateStats{
+		Reads:     m.reads.load(),
+		Fallbacks: m.fallbacks.load(),
+		OldHits:   m.oldHits.load(),
+		Writes:    m.writes.load(),
+		Cutover:   m.isCutover(),
+	}
+}
+
+// Get reads from New, then from Old on a miss.
+// Values of a ValueReleaser engine are copied and released.
+func (m *MigrateEngine) Get(key []byte, rw *bufio.ReadWriter) (value []byte, noreply bool, err error) {
+	m.reads.inc()
+	value, noreply, err = m.New.Get(key, rw)
+	if !isMiss(value, err) || m.isCutover() {
+		return detach(m.New, value), noreply, err
+	}
+	m.fallbacks.inc()
+	value, noreply, err = m.Old.Get(key, rw)
+	if err == nil && value != nil {
+		m.oldHits.inc()
+	}
+	return detach(m.Old, value), noreply, err
+}
+
+// isMiss reports whether a Get missed, engines answer ErrCacheMiss or no value
+func isMiss(value []byte, err error) bool {
+	return err == ErrCacheMiss || (err == nil && value == nil)
+}
+
+// Gets reads every key with fallback
+func (m *MigrateEngine) Gets(keys [][]byte, rw *bufio.ReadWriter) (keysvals [][]byte, err error) {
+	return getsByGet(m.Get, keys, rw)
+}
+
+// Set writes to both engines
+func (m *MigrateEngine) Set(key, value []byte, flags uint32, exp int32, size int, noreply bool, rw *bufio.ReadWriter) (noreplyresp bool, err error) {
+	m.writes.inc()
+	noreplyresp, err = m.New.Set(key, value, flags, exp, size, noreply, rw)
+	if err != nil || m.isCutover() {
+		return
+	}
+	_, err = m.Old.Set(key, value, flags, exp, size, noreply, rw)
+	return
+}
+
+// Incr applies to both engines, result of New wins if key was found there
+func (m *MigrateEngine) Incr(key []byte, value uint64, rw *bufio.ReadWriter) (result uint64, isFound bool, noreply bool, err error) {
+	m.writes.inc()
+	result, isFound, noreply, err = m.New.Incr(key, value, rw)
+	if err != nil || m.isCutover() {
+		return
+	}
+	oldResult, oldFound, _, err := m.Old.Incr(key, value, rw)
+	if err == nil && !isFound && oldFound {
+		result, isFound = oldResult, true
+	}
+	return
+}
+
+// Decr applies to both engines, result of New wins if key was found there
+func (m *MigrateEngine) Decr(key []byte, value uint64, rw *bufio.ReadWriter) (result uint64, isFound bool, noreply bool, err error) {
+	m.writes.inc()
+	result, isFound, noreply, err = m.New.Decr(key, value, rw)
+	if err != nil || m.isCutover() {
+		return
+	}
+	oldResult, oldFound, _, err := m.Old.Decr(key, value, rw)
+	if err == nil && !isFound && oldFound {
+		result, isFound = oldResult, true
+	}
+	return
+}
+
+// Delete removes key from both engines
+func (m *MigrateEngine) Delete(key []byte, rw *bufio.ReadWriter) (isFound bool, noreply bool, err error) {
+	m.writes.inc()
+	isFound, noreply, err = m.New.Delete(key, rw)
+	if err != nil || m.isCutover() {
+		return
+	}
+	oldFound, _, err := m.Old.Delete(key, rw)
+	isFound = isFound || oldFound
+	return
+}
+
+// Close closes both engines
+func (m *MigrateEngine) Close() error {
+	errNew := m.New.Close()
+	errOld := m.Old.Close()
+	if errNew != nil {
+		return errNew
+	}
+	return errOld
+}
@@ -0,0 +1,116 @@
+package mcproto
+
+import (
+	"errors"
+	"strconv"
+)
+
+// Updater is an optional interface for engines that can modify an item atomically.
+// Update calls fn with the value of key while no other write of key can run,
+// and stores the value fn returns, keeping the flags and lifetime of the item.
+// It returns ErrCacheMiss if there is no item and the error of fn if it fails.
+type Updater interface {
+	Update(key []byte, fn func(value []byte) ([]byte, error)) error
+}
+
+// maxPatchSize bounds how far a patch or a push may grow a value, the default
+// item size limit of memcached
+const maxPatchSize = 1 << 20
+
+var errPatchRange = errors.New("offset out of range")
+
+// patch returns value with b written at off, padded with zeros if it grows.
+// value is not modified, engines may share it with readers.
+func patch(value []byte, off int, b []byte) ([]byte, error) {
+	end := off + len(b)
+	if off < 0 || end < off || (end > len(value) && end > maxPatchSize) {
+		return nil, errPatchRange
+	}
+	size := len(value)
+	if end > size {
+		size = end
+	}
+	v := make([]byte, size)
+	copy(v, value)
+	copy(v[off:], b)
+	return v, nil
+}
+
+// setRange serves "setrange <key> <offset> <bytes> [noreply]" with a data block,
+// it overwrites the bytes of the value at offset
+func (h *engineHandler) setRange(w ResponseWriter, r *Request) (err error) {
+	u, ok := h.db.(Updater)
+	if !ok {
+		return protocolError(w.ReadWriter())
+	}
+	noreply := len(r.Args) == 4 && isNoreply(r.Args[3])
+	off, err := strconv.Atoi(string(r.Args[1]))
+	if (len(r.Args) != 3 && !noreply) || err != nil {
+		return h.badLine(w, r)
+	}
+	err = u.Update(h.key(r.Args[0]), func(value []byte) ([]byte, error) {
+		return patch(value, off, r.Data)
+	})
+	return h.patchResult(w, r, err, noreply, resultStored)
+}
+
+// setBit serves "setbit <key> <bit> <0|1> [noreply]" and answers the previous
+// value of the bit. Bit 0 is the most significant bit of the first byte.
+func (h *engineHandler) setBit(w ResponseWriter, r *Request) (err error) {
+	u, ok := h.db.(Updater)
+	if !ok {
+		return protocolError(w.ReadWriter())
+	}
+	noreply := len(r.Args) == 4 && isNoreply(r.Args[3])
+	if len(r.Args) != 3 && !noreply {
+		return h.badLine(w, r)
+	}
+	bit, err := strconv.Atoi(string(r.Args[1]))
+	on := string(r.Args[2]) == "1"
+	if err != nil || bit < 0 || (!on && string(r.Args[2]) != "0") {
+		return h.badLine(w, r)
+	}
+	var old byte
+	err = u.Update(h.key(r.Args[0]), func(value []byte) ([]byte, error) {
+		i, mask := bit/8, byte(0x80)>>uint(bit%8)
+		var b byte
+		if i < len(value) {
+			b = value[i]
+		}
+		if b&mask != 0 {
+			old = 1
+		}
+		if on {
+			b |= mask
+		} else {
+			b &^= mask
+		}
+		return patch(value, i, []byte{b})
+	})
+	return h.patchResult(w, r, err, noreply, []byte{'0' + old, '\r', '\n'})
+}
+
+// patchResult answers a patch command, ok is the response on success
+func (h *engineHandler) patchResult(w ResponseWriter, r *Request, err error, noreply bool, ok []byte) error {
+	if err == nil {
+		wrote(r)
+	}
+	if err != nil && err != ErrCacheMiss && err != errPatchRange && !refused(err) {
+		connError(r.RemoteAddr, err)
+	}
+	if noreply {
+		return nil
+	}
+	rw := w.ReadWriter()
+	switch err {
+	case nil:
+		rw.Write(ok)
+	case ErrCacheMiss:
+		rw.Write(resultNotFound)
+	case errPatchRange:
+		return clientError(rw, err.Error())
+	default:
+		return engineError(rw, err)
+	}
+	return w.Flush()
+}
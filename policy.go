@@ -0,0 +1,123 @@
+package mcproto
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"io/ioutil"
+	"time"
+)
+
+// PrefixPolicy are storage rules for keys starting with Prefix.
+// Zero values mean no limit.
+type PrefixPolicy struct {
+	Prefix       string
+	MinTTL       int32 // shorter lifetimes are raised to MinTTL
+	MaxTTL       int32 // longer lifetimes, including never expiring, are clamped to MaxTTL
+	MaxValueSize int   // larger values are rejected with ErrTooLarge
+	Compress     bool  // values are stored deflated
+}
+
+// compressedMagic marks deflated values stored by PolicyEngine
+var compressedMagic = []byte("\x00mcz1")
+
+// maxRelativeExp is the largest exptime memcached treats as relative,
+// larger values are unix timestamps
+const maxRelativeExp = 60 * 60 * 24 * 30
+
+// PolicyEngine wraps an engine and applies the policy with the longest
+// matching prefix to every stored value, so one server can enforce different
+// rules for sessions, page fragments or configs.
+// Optional interfaces of the wrapped engine are not exposed.
+type PolicyEngine struct {
+	McEngine
+	policies []PrefixPolicy
+}
+
+// NewPolicyEngine returns db with policies applied
+func NewPolicyEngine(db McEngine, policies ...PrefixPolicy) *PolicyEngine {
+	return &PolicyEngine{McEngine: db, policies: policies}
+}
+
+func (p *PolicyEngine) policy(key []byte) (pol *PrefixPolicy) {
+	for i := range p.policies {
+		if bytes.HasPrefix(key, []byte(p.policies[i].Prefix)) && (pol == nil || len(p.policies[i].Prefix) > len(pol.Prefix)) {
+			pol = &p.policies[i]
+		}
+	}
+	return
+}
+
+// relativeExp converts an exptime to seconds from now, 0 means never expires
+func relativeExp(exp int32, now time.Time) int32 {
+	if exp <= maxRelativeExp {
+		return exp
+	}
+	rel := int64(exp) - now.Unix()
+	if rel <= 0 {
+		return -1
+	}
+	return int32(rel)
+}
+
+// clampExp normalizes exp to seconds from now and applies min and max,
+// zero limits are not applied
+func clampExp(exp, min, max int32) int32 {
+	if exp < 0 {
+		return exp
+	}
+	exp = relativeExp(exp, time.Now())
+	if max > 0 && (exp == 0 || exp > max) {
+		exp = max
+	}
+	if min > 0 && exp > 0 && exp < min {
+		exp = min
+	}
+	return exp
+}
+
+// Set applies the policy of key and stores value
+func (p *PolicyEngine) Set(key, value []byte, flags uint32, exp int32, size int, noreply bool, rw *bufio.ReadWriter) (noreplyresp bool, err error) {
+	pol := p.policy(key)
+	if pol == nil {
+		return p.McEngine.Set(key, value, flags, exp, size, noreply, rw)
+	}
+	if pol.MaxValueSize > 0 && len(value) > pol.MaxValueSize {
+		return noreply, ErrTooLarge
+	}
+	exp = clampExp(exp, pol.MinTTL, pol.MaxTTL)
+	if pol.Compress {
+		var buf bytes.Buffer
+		buf.Write(compressedMagic)
+		zw, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+		zw.Write(value)
+		zw.Close()
+		value = buf.Bytes()
+		size = len(value)
+	}
+	return p.McEngine.Set(key, value, flags, exp, size, noreply, rw)
+}
+
+// Get returns the value of key, inflated if its policy compresses values.
+// Values of other keys are returned as stored, whatever their bytes.
+// Values of a ValueReleaser engine are copied and released.
+func (p *PolicyEngine) Get(key []byte, rw *bufio.ReadWriter) (value []byte, noreply bool, err error) {
+	value, noreply, err = p.McEngine.Get(key, rw)
+	if err != nil || !bytes.HasPrefix(value, compressedMagic) {
+		return detach(p.McEngine, value), noreply, err
+	}
+	if pol := p.policy(key); pol == nil || !pol.Compress {
+		return detach(p.McEngine, value), noreply, err
+	}
+	raw := value
+	value, err = ioutil.ReadAll(flate.NewReader(bytes.NewReader(raw[len(compressedMagic):])))
+	if rel, ok := p.McEngine.(ValueReleaser); ok {
+		rel.Release(raw)
+	}
+	return
+}
+
+// Gets serves every key with Get, so compressed values are inflated
+func (p *PolicyEngine) Gets(keys [][]byte, rw *bufio.ReadWriter) (keysvals [][]byte, err error) {
+	return getsByGet(p.Get, keys, rw)
+}
@@ -0,0 +1,77 @@
+package mcproto
+
+import (
+	"log"
+	"os"
+	"time"
+)
+
+// preloadProgress is how many items are loaded between progress logs
+const preloadProgress = 100000
+
+// Preload warms an engine from a backup file before the listener accepts
+// connections, so restarted nodes don't start cold. The file holds the
+// output of the backup command, lifetimes are shortened by the file age.
+type Preload struct {
+	Path string
+
+	// Partial keeps the items loaded before a corrupt or truncated tail
+	// and skips items the engine fails to store, instead of failing Load
+	Partial bool
+
+	// Logf logs progress, default log.Printf
+	Logf func(format string, args ...interface{})
+}
+
+// PreloadStats describe a finished preload
+type PreloadStats struct {
+	Items    int // stored items
+	Skipped  int // items the engine failed to store
+	Duration time.Duration
+	Err      error // the error that ended a partial load early
+}
+
+// Load stores the items of the file in db. A missing file is not an error,
+// a node starting for the first time has nothing to load.
+func (p Preload) Load(db McEngine) (stats PreloadStats, err error) {
+	logf := p.Logf
+	if logf == nil {
+		logf = log.Printf
+	}
+	started := time.Now()
+	f, err := os.Open(p.Path)
+	if os.IsNotExist(err) {
+		logf("mcproto: preload: no %s, starting cold", p.Path)
+		return stats, nil
+	}
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	var age int32
+	if fi, err := f.Stat(); err == nil {
+		age = int32(time.Since(fi.ModTime()) / time.Second)
+	}
+	logf("mcproto: preload: loading %s", p.Path)
+	stats.Items, err = restore(f, db, restoreOptions{
+		age:        age,
+		skipErrors: p.Partial,
+		progress: func(n int, err error) {
+			if err != nil {
+				stats.Skipped++
+			} else if n%preloadProgress == 0 {
+				logf("mcproto: preload: %d items in %v", n, time.Since(started))
+			}
+		},
+	})
+	stats.Duration = time.Since(started)
+	if err != nil && p.Partial {
+		stats.Err, err = err, nil
+		logf("mcproto: preload: stopped after %d items: %v", stats.Items, stats.Err)
+	}
+	if err != nil {
+		return
+	}
+	logf("mcproto: preload: %d items, %d skipped in %v", stats.Items, stats.Skipped, stats.Duration)
+	return
+}
@@ -0,0 +1,141 @@
+package mcproto
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// CommandSample describes a sampled command, see SetSampling
+type CommandSample struct {
+	Time     time.Time     `json:"time"`
+	Addr     string        `json:"addr"`
+	Identity string        `json:"identity,omitempty"`
+	Command  string        `json:"command"`
+	Key      string        `json:"key,omitempty"` // the first key, see KeyPrivacy
+	Keys     int           `json:"keys"`
+	BytesIn  uint64        `json:"bytes_in"`  // command line and data block
+	BytesOut uint64        `json:"bytes_out"` // response
+	Duration time.Duration `json:"duration_ns"`
+	Result   string        `json:"result"` // first word of the response, like STORED, VALUE or END
+
+	// heap allocations during the command, see SetAllocStats
+	Allocs     uint64 `json:"allocs,omitempty"`
+	AllocBytes uint64 `json:"alloc_bytes,omitempty"`
+}
+
+// KeyPrivacy is how keys appear in command samples
+type KeyPrivacy int
+
+// Key privacy modes
+const (
+	KeysPlain    KeyPrivacy = iota // the key as sent
+	KeysHashed                     // hex of the salted SHA-256 of the key, same keys match
+	KeysRedacted                   // no key
+)
+
+// Sampling logs one in Rate commands, giving visibility into the traffic
+// without the volume of a full audit log
+type Sampling struct {
+	Rate int // log 1 in Rate commands, 0 is off
+	Keys KeyPrivacy
+	Salt string // of hashed keys
+
+	// Log is called with every sample from the connection goroutine,
+	// default a JSON line with log.Print
+	Log func(CommandSample)
+}
+
+var sampling atomic.Value // *sampler, nil if off
+
+type sampler struct {
+	Sampling
+	n uint64
+}
+
+func init() {
+	sampling.Store((*sampler)(nil))
+}
+
+// SetSampling starts logging sampled commands, a zero Rate stops it.
+// Responses of sampled commands are buffered whole to find their result.
+func SetSampling(s Sampling) {
+	if s.Rate <= 0 {
+		sampling.Store((*sampler)(nil))
+		return
+	}
+	if s.Log == nil {
+		s.Log = logSample
+	}
+	sampling.Store(&sampler{Sampling: s})
+}
+
+func logSample(s CommandSample) {
+	b, _ := json.Marshal(s)
+	log.Print(string(b))
+}
+
+// take reports whether the next command is sampled
+func (s *sampler) take() bool {
+	return atomic.AddUint64(&s.n, 1)%uint64(s.Rate) == 0
+}
+
+func (s *sampler) key(key []byte) string {
+	switch s.Keys {
+	case KeysHashed:
+		sum := sha256.Sum256(append([]byte(s.Salt), key...))
+		return hex.EncodeToString(sum[:8])
+	case KeysRedacted:
+		return ""
+	}
+	return string(key)
+}
+
+// serveSampled runs serve and logs the command
+func (mc *conn) serveSampled(s *sampler, r *Request, serve func()) {
+	allocs := startAllocs()
+	started := time.Now()
+	resp, _ := mc.capture(func() error {
+		serve()
+		return nil
+	})
+	elapsed := time.Since(started)
+	allocCount, allocBytes := allocs.stop()
+	mc.rw.Write(resp)
+	mc.flush()
+
+	sample := CommandSample{
+		Time:     started,
+		Identity: Identity(mc.ctx),
+		Command:  string(commandVerb(r.Line)),
+		BytesIn:  mc.reqBytes,
+		BytesOut: uint64(len(resp)),
+		Duration: elapsed,
+
+		Allocs:     allocCount,
+		AllocBytes: allocBytes,
+	}
+	if r.RemoteAddr != nil {
+		sample.Addr = r.RemoteAddr.String()
+	}
+	if len(r.Args) > 0 {
+		sample.Key, sample.Keys = s.key(r.Args[0]), 1
+	}
+	switch r.Command {
+	case CmdGet, CmdGets:
+		sample.Keys = len(r.Args)
+	case CmdGat, CmdGats:
+		sample.Key, sample.Keys = "", len(r.Args)-1
+		if len(r.Args) > 1 {
+			sample.Key = s.key(r.Args[1])
+		}
+	}
+	if i := bytes.IndexAny(resp, " \r\n"); i >= 0 {
+		sample.Result = string(resp[:i])
+	}
+	s.Log(sample)
+}
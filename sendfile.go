@@ -0,0 +1,63 @@
+package mcproto
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// FileGetter is an optional interface for engines storing values in files.
+// GetFile returns the file holding the value of key, the value is size bytes
+// at off. The server sends it with sendfile where the platform allows and
+// closes f. A nil f or ErrCacheMiss is a miss. It's used for single key gets.
+type FileGetter interface {
+	GetFile(key []byte) (f *os.File, off, size int64, err error)
+}
+
+func (h *engineHandler) getFile(fg FileGetter, w ResponseWriter, r *Request, key []byte) (err error) {
+	f, off, size, err := fg.GetFile(key)
+	if f != nil {
+		defer f.Close()
+	}
+	if refused(err) {
+		return engineError(w.ReadWriter(), err)
+	}
+	if err != nil && err != ErrCacheMiss {
+		connError(r.RemoteAddr, err)
+	}
+	if err == nil && f != nil {
+		if _, err = fmt.Fprintf(w, "VALUE %s 0 %d\r\n", key, size); err != nil {
+			return
+		}
+		if err = sendValue(w, f, off, size, h.cfg.writeDeadline+time.Duration(size)*time.Second/time.Duration(h.cfg.bodyRate)); err != nil {
+			return
+		}
+		if _, err = w.Write(crlf); err != nil {
+			return
+		}
+		h.hit(key)
+	}
+	if _, err = w.Write(resultEnd); err != nil {
+		return
+	}
+	return w.Flush()
+}
+
+// sendValue writes size bytes of f at off to w, the buffered response is
+// flushed first so the file can go straight to the connection, unless the
+// response is captured
+func sendValue(w ResponseWriter, f *os.File, off, size int64, timeout time.Duration) error {
+	if resp, ok := w.(*response); ok && resp.mc.capturing == 0 {
+		if err := resp.mc.rw.Flush(); err != nil {
+			return err
+		}
+		_, err := resp.mc.cw.sendFile(f, off, size, timeout)
+		return err
+	}
+	n, err := io.Copy(w, io.NewSectionReader(f, off, size))
+	if err == nil && n < size {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
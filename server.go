@@ -0,0 +1,340 @@
+package mcproto
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrServerClosed is returned by Serve and ListenAndServe after Close
+var ErrServerClosed = errors.New("mcproto: server closed")
+
+// resultTooManyConns is answered to connections over MaxConns, like memcached
+var resultTooManyConns = []byte("SERVER_ERROR too many open connections\r\n")
+
+// Server serves an engine on listeners, it owns the accept loops
+// and the goroutines of the connections.
+// Load shedding, sampling, write tracing, idempotency, inflight limits and
+// events are not Server settings: their Set functions and Subscribe are
+// process-wide and apply to every Server and ParseMc connection alike.
+type Server struct {
+	handler  Handler
+	cfg      *config
+	maxConns int
+	tls      *tls.Config
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[*conn]struct{}
+	closed    bool
+}
+
+// Option configures a Server
+type Option func(*serverOptions)
+
+type serverOptions struct {
+	params   url.Values
+	maxConns int
+	tls      *tls.Config
+	problems []string // of options that are not params
+}
+
+// WithParams sets connection settings from a params string, see README.
+// Options after it override its settings.
+func WithParams(params string) Option {
+	return func(o *serverOptions) {
+		p, err := url.ParseQuery(params)
+		if err != nil {
+			o.problems = append(o.problems, "WithParams: "+err.Error())
+			return
+		}
+		for name, values := range p {
+			o.params[name] = values
+		}
+	}
+}
+
+// Deadline sets the idle timeout of connections, like the deadline param
+func Deadline(d time.Duration) Option {
+	return func(o *serverOptions) {
+		o.params.Set("deadline", strconv.FormatInt(int64(d/time.Millisecond), 10))
+	}
+}
+
+// BufferSize sets the read and write buffer size of connections, like the buf param
+func BufferSize(n int) Option {
+	return func(o *serverOptions) {
+		o.params.Set("buf", strconv.Itoa(n))
+	}
+}
+
+// MaxItemSize limits the size of values, like the maxitem param
+func MaxItemSize(n int) Option {
+	return func(o *serverOptions) {
+		o.params.Set("maxitem", strconv.Itoa(n))
+	}
+}
+
+// MaxConns limits open connections, more are answered
+// SERVER_ERROR and closed. Zero is unlimited.
+func MaxConns(n int) Option {
+	return func(o *serverOptions) {
+		if n < 0 {
+			o.problems = append(o.problems, "MaxConns("+strconv.Itoa(n)+") must not be negative")
+		}
+		o.maxConns = n
+	}
+}
+
+// Version sets the version answered to the version command, like the version param
+func Version(v string) Option {
+	return func(o *serverOptions) {
+		o.params.Set("version", v)
+	}
+}
+
+// AllowedCommands serves only the verbs given, like the allow param
+func AllowedCommands(verbs ...string) Option {
+	return func(o *serverOptions) {
+		o.params.Set("allow", strings.Join(verbs, ","))
+	}
+}
+
+// TLSConfig serves TLS, with ALPNProtocols unless cfg sets NextProtos
+func TLSConfig(cfg *tls.Config) Option {
+	return func(o *serverOptions) {
+		o.tls = cfg
+	}
+}
+
+// NewServer returns a Server of db configured by opts.
+// Invalid settings are reported at once as a *ParamsError.
+func NewServer(db McEngine, opts ...Option) (*Server, error) {
+	o := &serverOptions{params: url.Values{}}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if err := validate(o.params); err != nil || len(o.problems) > 0 {
+		perr, _ := err.(*ParamsError)
+		if perr == nil {
+			perr = &ParamsError{}
+		}
+		perr.Problems = append(o.problems, perr.Problems...)
+		return nil, perr
+	}
+	params := o.params.Encode()
+	cfg, err := parseParams(params)
+	if err != nil {
+		return nil, err
+	}
+	h, err := EngineHandler(db, params)
+	if err != nil {
+		return nil, err
+	}
+	if o.tls != nil && len(o.tls.NextProtos) == 0 {
+		o.tls = o.tls.Clone()
+		o.tls.NextProtos = ALPNProtocols
+	}
+	return &Server{
+		handler:   h,
+		cfg:       cfg,
+		maxConns:  o.maxConns,
+		tls:       o.tls,
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[*conn]struct{}),
+	}, nil
+}
+
+// ListenAndServe serves db on the TCP address addr until an accept fails
+func ListenAndServe(addr string, db McEngine, opts ...Option) error {
+	s, err := NewServer(db, opts...)
+	if err != nil {
+		return err
+	}
+	return s.ListenAndServe(addr)
+}
+
+// ListenAndServe listens on the TCP address addr and calls Serve
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l and serves each in its own goroutine.
+// It returns when an accept fails, ErrServerClosed after Close.
+// Temporary accept errors, like running out of file descriptors, are retried.
+func (s *Server) Serve(l net.Listener) error {
+	if s.tls != nil {
+		l = tls.NewListener(l, s.tls)
+	}
+	if !s.addListener(l) {
+		l.Close()
+		return ErrServerClosed
+	}
+	defer s.removeListener(l)
+	var delay time.Duration
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+		go s.serveConn(c)
+	}
+}
+
+// errServerFull refuses connections over MaxConns
+var errServerFull = errors.New("mcproto: too many open connections")
+
+func (s *Server) serveConn(c net.Conn) {
+	mc := newConn(c, s.handler, s.cfg)
+	if err := s.addConn(mc); err != nil {
+		if err == errServerFull {
+			c.SetWriteDeadline(time.Now().Add(s.cfg.writeDeadline))
+			c.Write(resultTooManyConns)
+		}
+		c.Close()
+		return
+	}
+	defer s.removeConn(mc)
+	mc.serve()
+}
+
+// Close closes the listeners and the connections of s at once,
+// see Drain and ShutdownSequence for an orderly stop
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.closeListeners()
+	for mc := range s.conns {
+		mc.c.Close()
+	}
+	return err
+}
+
+// Drain takes s out of service for maintenance: it stops accepting,
+// closes idle connections at once and busy ones after their command.
+// A command pipelined behind it is answered SERVER_ERROR shutting down,
+// so clients fail over instead of waiting. Drain returns when all
+// connections are closed, or ctx.Err() with the remaining ones still open.
+func (s *Server) Drain(ctx context.Context) error {
+	s.mu.Lock()
+	err := s.closeListeners()
+	s.mu.Unlock()
+	tick := time.NewTicker(shutdownPoll)
+	defer tick.Stop()
+	for {
+		s.mu.Lock()
+		open := len(s.conns)
+		for mc := range s.conns {
+			mc.drain()
+		}
+		s.mu.Unlock()
+		if open == 0 {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-tick.C:
+		}
+	}
+}
+
+// Shutdown stops s gracefully: like Drain it stops accepting and lets
+// running commands complete, their responses are flushed before the
+// connections close. When ctx is done first the remaining connections
+// are closed at once and ctx.Err() is returned. The engine is not closed,
+// see ShutdownSequence.
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.Drain(ctx)
+	if err != nil && err == ctx.Err() {
+		s.Close()
+	}
+	return err
+}
+
+// closeListeners closes s for new connections, s.mu is held
+func (s *Server) closeListeners() (err error) {
+	s.closed = true
+	for l := range s.listeners {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return
+}
+
+// Addrs returns the addresses s listens on
+func (s *Server) Addrs() (addrs []net.Addr) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for l := range s.listeners {
+		addrs = append(addrs, l.Addr())
+	}
+	return
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// addListener reports false if s is closed
+func (s *Server) addListener(l net.Listener) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.listeners[l] = struct{}{}
+	return true
+}
+
+func (s *Server) removeListener(l net.Listener) {
+	s.mu.Lock()
+	delete(s.listeners, l)
+	s.mu.Unlock()
+}
+
+// addConn returns ErrServerClosed or errServerFull if mc must not be served
+func (s *Server) addConn(mc *conn) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrServerClosed
+	}
+	if s.maxConns > 0 && len(s.conns) >= s.maxConns {
+		return errServerFull
+	}
+	s.conns[mc] = struct{}{}
+	return nil
+}
+
+func (s *Server) removeConn(mc *conn) {
+	s.mu.Lock()
+	delete(s.conns, mc)
+	s.mu.Unlock()
+}
@@ -0,0 +1,64 @@
+package mcproto
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var (
+	// ErrSessionActive means that the session is held by another open connection
+	ErrSessionActive = errors.New("mcproto: session active on another connection")
+	// ErrNotAuthenticated means that the connection has no identity, see SetIdentity
+	ErrNotAuthenticated = errors.New("mcproto: connection not authenticated")
+)
+
+type sessionKey struct {
+	identity, session string
+}
+
+var (
+	sessionsMu sync.Mutex
+	sessions   = map[sessionKey]*connMeta{}
+)
+
+// ClaimSession binds session of the authenticated identity to the connection
+// serving ctx. If another open connection holds it, ClaimSession fails with
+// ErrSessionActive, or with takeover closes that stale connection, so clients
+// reconnecting through flaky NATs don't wait for the old one to time out.
+func ClaimSession(ctx context.Context, session string, takeover bool) error {
+	m := metaFrom(ctx)
+	if m == nil {
+		return ErrNotAuthenticated
+	}
+	identity, _ := m.identity.Load().(string)
+	if identity == "" {
+		return ErrNotAuthenticated
+	}
+	key := sessionKey{identity, session}
+	sessionsMu.Lock()
+	old := sessions[key]
+	if old != nil && old != m && !takeover {
+		sessionsMu.Unlock()
+		return ErrSessionActive
+	}
+	sessions[key] = m
+	m.sessions = append(m.sessions, key)
+	sessionsMu.Unlock()
+	if old != nil && old != m {
+		old.c.Close()
+	}
+	return nil
+}
+
+// releaseSessions forgets the sessions held by a closed connection
+func releaseSessions(m *connMeta) {
+	sessionsMu.Lock()
+	for _, key := range m.sessions {
+		if sessions[key] == m {
+			delete(sessions, key)
+		}
+	}
+	m.sessions = nil
+	sessionsMu.Unlock()
+}
@@ -0,0 +1,181 @@
+package mcproto
+
+import (
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ShedPolicy configures load shedding. Zero thresholds are not checked.
+// When any measure reaches its threshold the server answers
+// SERVER_ERROR busy to retrieval commands, which are the cheapest to reject:
+// the client treats it as a miss. At twice the threshold storage and other
+// data commands are rejected too. Admin and health commands are never shed.
+// Shedding stops when all measures fall below Resume of the threshold.
+type ShedPolicy struct {
+	MaxQueue      int           // data commands waiting for an in-flight slot
+	MaxLatency    time.Duration // p99 latency of recent data commands
+	MaxGoroutines int           // runtime.NumGoroutine()
+	Resume        float64       // hysteresis fraction, default 0.8
+}
+
+// ShedStats are load shedding counters
+type ShedStats struct {
+	Level     int    // 0 - normal, 1 - shedding retrievals, 2 - shedding all data commands
+	Retrieval uint64 // rejected retrieval commands
+	Other     uint64 // rejected storage and other data commands
+}
+
+const (
+	shedSamples  = 1024
+	shedInterval = 100 * time.Millisecond
+)
+
+// isRetrieval reports whether cmd only reads items, those are shed first
+func isRetrieval(cmd Command) bool {
+	switch cmd {
+	case CmdGet, CmdGets, CmdGat, CmdGats, CmdMetaGet, CmdScan:
+		return true
+	}
+	return false
+}
+
+type shedder struct {
+	policy ShedPolicy
+
+	level     int32
+	retrieval counter
+	other     counter
+
+	mu      sync.Mutex
+	samples [shedSamples]time.Duration
+	n       int
+	checked time.Time
+}
+
+var defaultShedder atomic.Value // *shedder
+
+func init() {
+	defaultShedder.Store(&shedder{})
+}
+
+// SetShedPolicy enables load shedding, zero policy disables it
+func SetShedPolicy(p ShedPolicy) {
+	if p.Resume <= 0 || p.Resume >= 1 {
+		p.Resume = 0.8
+	}
+	defaultShedder.Store(&shedder{policy: p})
+}
+
+// Shed returns load shedding counters
+func Shed() ShedStats {
+	sh := defaultShedder.Load().(*shedder)
+	return ShedStats{
+		Level:     int(atomic.LoadInt32(&sh.level)),
+		Retrieval: sh.retrieval.load(),
+		Other:     sh.other.load(),
+	}
+}
+
+func (sh *shedder) enabled() bool {
+	return sh.policy.MaxQueue > 0 || sh.policy.MaxLatency > 0 || sh.policy.MaxGoroutines > 0
+}
+
+// reject reports whether the command must be answered SERVER_ERROR busy.
+// Storage commands are checked with rejectStorage after their data block is read.
+func (sh *shedder) reject(e commandEntry, l *lanes) bool {
+	if !sh.enabled() || isAdminCommand(e.cmd) {
+		return false
+	}
+	level := sh.evaluate(l)
+	switch {
+	case isRetrieval(e.cmd):
+		if level >= 1 {
+			sh.retrieval.inc()
+			return true
+		}
+	case e.data > 0:
+		return false
+	case level >= 2:
+		sh.other.inc()
+		return true
+	}
+	return false
+}
+
+// rejectStorage reports whether a storage command must be rejected
+func (sh *shedder) rejectStorage() bool {
+	if atomic.LoadInt32(&sh.level) >= 2 {
+		sh.other.inc()
+		return true
+	}
+	return false
+}
+
+// observe records the latency of a data command
+func (sh *shedder) observe(d time.Duration) {
+	if sh.policy.MaxLatency == 0 {
+		return
+	}
+	sh.mu.Lock()
+	sh.samples[sh.n%shedSamples] = d
+	sh.n++
+	sh.mu.Unlock()
+}
+
+// evaluate recomputes the shedding level at most every shedInterval
+func (sh *shedder) evaluate(l *lanes) int32 {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	level := atomic.LoadInt32(&sh.level)
+	now := time.Now()
+	if now.Sub(sh.checked) < shedInterval {
+		return level
+	}
+	sh.checked = now
+
+	// load is the worst measure relative to its threshold
+	load := 0.0
+	ratio := func(v, max float64) {
+		if max > 0 && v/max > load {
+			load = v / max
+		}
+	}
+	ratio(float64(atomic.LoadInt64(&l.waiting)), float64(sh.policy.MaxQueue))
+	ratio(float64(sh.p99()), float64(sh.policy.MaxLatency))
+	ratio(float64(runtime.NumGoroutine()), float64(sh.policy.MaxGoroutines))
+
+	switch {
+	case load >= 2:
+		level = 2
+	case load >= 1:
+		if level < 1 {
+			level = 1
+		}
+	case load < sh.policy.Resume:
+		level = 0
+	}
+	// storage is served again below twice Resume, whatever the load
+	if level == 2 && load < 2*sh.policy.Resume {
+		level = 1
+	}
+	atomic.StoreInt32(&sh.level, level)
+	return level
+}
+
+// p99 of recorded samples, sh.mu must be held
+func (sh *shedder) p99() time.Duration {
+	n := sh.n
+	if n > shedSamples {
+		n = shedSamples
+	}
+	if n == 0 {
+		return 0
+	}
+	s := make([]time.Duration, n)
+	copy(s, sh.samples[:n])
+	sort.Slice(s, func(i, j int) bool { return s[i] < s[j] })
+	return s[n*99/100]
+}
@@ -0,0 +1,135 @@
+package mcproto
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// errDrained ends connections stopped between commands by a shutdown
+var errDrained = errors.New("mcproto: connection drained")
+
+// engineCalls counts handler calls running, so engines are closed
+// only when none uses them
+var engineCalls int64
+
+// ShutdownSequence stops serving in a fixed order, see Run
+type ShutdownSequence struct {
+	Listeners []net.Listener // closed first
+	Engine    McEngine       // closed last, nil if the caller closes it
+
+	ConnTimeout   time.Duration // for connections to finish their command, default 5s
+	EngineTimeout time.Duration // for the remaining engine calls, default 5s
+}
+
+// ShutdownError lists the failures of all stages of a shutdown
+type ShutdownError struct {
+	Errs []error
+}
+
+func (e *ShutdownError) Error() string {
+	msgs := make([]string, len(e.Errs))
+	for i, err := range e.Errs {
+		msgs[i] = err.Error()
+	}
+	return "mcproto: shutdown: " + strings.Join(msgs, "; ")
+}
+
+// Run stops serving in three stages:
+//
+//  1. the listeners are closed, so no connection is accepted
+//  2. idle connections are closed, busy ones after their command completes.
+//     Connections still open after ConnTimeout are closed forcibly
+//  3. Engine.Close is called once no handler call runs. If calls are still
+//     running after EngineTimeout the engine is left open
+//
+// Stage 2 stops every connection of the process, whatever its listener.
+// All stages run, their failures are returned as a *ShutdownError.
+func (s ShutdownSequence) Run() error {
+	var errs []error
+	for _, l := range s.Listeners {
+		if err := l.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("listener %s: %v", l.Addr(), err))
+		}
+	}
+	if n := drainConns(orDefault(s.ConnTimeout)); n > 0 {
+		errs = append(errs, fmt.Errorf("%d connections closed forcibly after %v", n, orDefault(s.ConnTimeout)))
+	}
+	if s.Engine != nil {
+		if waitEngineCalls(orDefault(s.EngineTimeout)) {
+			if err := s.Engine.Close(); err != nil {
+				errs = append(errs, fmt.Errorf("engine: %v", err))
+			}
+		} else {
+			errs = append(errs, fmt.Errorf("engine left open, calls still running after %v", orDefault(s.EngineTimeout)))
+		}
+	}
+	if len(errs) > 0 {
+		return &ShutdownError{Errs: errs}
+	}
+	return nil
+}
+
+func orDefault(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 5 * time.Second
+	}
+	return d
+}
+
+// shutdownPoll is how often stages check for completion
+const shutdownPoll = 10 * time.Millisecond
+
+// drainConns stops all connections within timeout and returns
+// how many had to be closed forcibly
+func drainConns(timeout time.Duration) (forced int) {
+	deadline := time.Now().Add(timeout)
+	for {
+		open := 0
+		openConns.Range(func(_, v interface{}) bool {
+			v.(*conn).drain()
+			open++
+			return true
+		})
+		if open == 0 {
+			return 0
+		}
+		if time.Now().After(deadline) {
+			openConns.Range(func(_, v interface{}) bool {
+				v.(*conn).c.Close()
+				forced++
+				return true
+			})
+			return
+		}
+		time.Sleep(shutdownPoll)
+	}
+}
+
+// waitEngineCalls reports whether all handler calls completed within timeout
+func waitEngineCalls(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for atomic.LoadInt64(&engineCalls) > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(shutdownPoll)
+	}
+	return true
+}
+
+// drain makes the connection stop before its next command, an idle one
+// stops waiting now and one holding responses for flushdelay sends them
+func (mc *conn) drain() {
+	atomic.StoreInt32(&mc.draining, 1)
+	if s := ConnState(atomic.LoadInt32(&mc.state)); s == StateIdle || s == StateWriteResponse {
+		mc.c.SetReadDeadline(time.Now())
+	}
+}
+
+func (mc *conn) drained() bool {
+	return atomic.LoadInt32(&mc.draining) == 1
+}
@@ -0,0 +1,207 @@
+package mcproto
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mutations counts storage commands served by engine handlers, for Snapshots
+var mutations counter
+
+// snapshotCheck is how often the mutation trigger is checked
+const snapshotCheck = time.Second
+
+// SnapshotPolicy configures Snapshots. At least one trigger should be set,
+// without triggers snapshots are only taken on Snapshot and Close.
+type SnapshotPolicy struct {
+	Dir       string
+	Interval  time.Duration // snapshot this often, 0 is off
+	Mutations uint64        // snapshot after this many mutations, 0 is off
+	Keep      int           // snapshots retained, default 3
+
+	// Logf logs snapshots and failures, default log.Printf
+	Logf func(format string, args ...interface{})
+}
+
+// Snapshots writes backup files of an engine to a directory in the background.
+// Files are written under a temporary name and renamed, so a crash never
+// leaves a torn snapshot, and can be loaded with Preload, see LatestSnapshot.
+type Snapshots struct {
+	db     Dumper
+	policy SnapshotPolicy
+
+	mu   sync.Mutex // serializes snapshots
+	last uint64     // mutations at the last snapshot
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// StartSnapshots starts taking snapshots of db as configured by p
+func StartSnapshots(db McEngine, p SnapshotPolicy) (*Snapshots, error) {
+	d, ok := db.(Dumper)
+	if !ok {
+		return nil, ErrNotDumper
+	}
+	if p.Keep <= 0 {
+		p.Keep = 3
+	}
+	if p.Logf == nil {
+		p.Logf = log.Printf
+	}
+	if err := os.MkdirAll(p.Dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &Snapshots{db: d, policy: p, last: mutations.load(), stop: make(chan struct{}), done: make(chan struct{})}
+	go s.run()
+	return s, nil
+}
+
+func (s *Snapshots) run() {
+	defer close(s.done)
+	tick := snapshotCheck
+	if s.policy.Interval > 0 && s.policy.Interval < tick {
+		tick = s.policy.Interval
+	}
+	t := time.NewTicker(tick)
+	defer t.Stop()
+	lastAt := time.Now()
+	for {
+		select {
+		case now := <-t.C:
+			due := s.policy.Interval > 0 && now.Sub(lastAt) >= s.policy.Interval
+			if s.policy.Mutations > 0 && mutations.load()-s.lastMutations() >= s.policy.Mutations {
+				due = true
+			}
+			if !due {
+				continue
+			}
+			lastAt = now
+			if _, err := s.Snapshot(); err != nil {
+				s.policy.Logf("mcproto: snapshot: %v", err)
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+func (s *Snapshots) lastMutations() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.last
+}
+
+// Snapshot writes a snapshot now and removes snapshots beyond Keep.
+// It returns the path of the new file.
+func (s *Snapshots) Snapshot() (path string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	started := time.Now()
+	count := mutations.load()
+	f, err := ioutil.TempFile(s.policy.Dir, ".snapshot-*")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	w := bufio.NewWriter(f)
+	n, err := dumpItems(w, s.db, nil)
+	if err != nil {
+		return
+	}
+	if err = w.Flush(); err != nil {
+		return
+	}
+	if err = f.Sync(); err != nil {
+		return
+	}
+	if err = f.Close(); err != nil {
+		return
+	}
+	path = filepath.Join(s.policy.Dir, fmt.Sprintf("snapshot-%d.dump", started.UnixNano()))
+	if err = os.Rename(f.Name(), path); err != nil {
+		return
+	}
+	s.last = count
+	s.policy.Logf("mcproto: snapshot: %d items to %s in %v", n, path, time.Since(started))
+	s.prune()
+	return path, nil
+}
+
+// prune removes the oldest snapshots beyond Keep
+func (s *Snapshots) prune() {
+	paths, err := snapshotFiles(s.policy.Dir)
+	if err != nil {
+		return
+	}
+	for len(paths) > s.policy.Keep {
+		if err := os.Remove(paths[0]); err != nil {
+			s.policy.Logf("mcproto: snapshot: %v", err)
+		}
+		paths = paths[1:]
+	}
+}
+
+// Close stops the triggers and takes the final snapshot,
+// call it on graceful shutdown after connections are drained
+func (s *Snapshots) Close() error {
+	close(s.stop)
+	<-s.done
+	_, err := s.Snapshot()
+	return err
+}
+
+// LatestSnapshot returns the newest snapshot in dir, "" if there is none
+func LatestSnapshot(dir string) (string, error) {
+	paths, err := snapshotFiles(dir)
+	if err != nil || len(paths) == 0 {
+		return "", err
+	}
+	return paths[len(paths)-1], nil
+}
+
+// snapshotFiles lists the snapshots in dir, oldest first
+func snapshotFiles(dir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	type snapshot struct {
+		path string
+		at   int64
+	}
+	var list []snapshot
+	for _, fi := range infos {
+		name := fi.Name()
+		if !strings.HasPrefix(name, "snapshot-") || !strings.HasSuffix(name, ".dump") {
+			continue
+		}
+		var at int64
+		if _, err := fmt.Sscanf(name, "snapshot-%d.dump", &at); err != nil {
+			continue
+		}
+		list = append(list, snapshot{filepath.Join(dir, name), at})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].at < list[j].at })
+	paths := make([]string, len(list))
+	for i, sn := range list {
+		paths[i] = sn.path
+	}
+	return paths, nil
+}
@@ -0,0 +1,272 @@
+package mcproto
+
+import (
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Statser is an optional interface for engines reporting their own
+// statistics, like curr_items or bytes, answered to stats with those
+// of the server. Engine stats replace server stats of the same name.
+type Statser interface {
+	Stats() (map[string]string, error)
+}
+
+// server statistics, answered to stats
+var (
+	started       = time.Now()
+	commandCounts [len(commandNames)]counter // by Command
+	getKeys       counter                    // keys requested by retrieval commands
+	getHits       counter                    // keys found by retrieval commands
+	bytesRead     counter                    // command lines and data blocks
+	bytesWritten  counter                    // responses
+)
+
+// engineSupports tells whether db implements the optional interface
+// a command needs, commands not listed are served with any engine
+var engineSupports = map[Command]func(db McEngine) bool{
+	CmdScan: func(db McEngine) bool {
+		_, sc := db.(Scanner)
+		_, ss := db.(ScanStreamer)
+		return sc || ss
+	},
+	CmdTTL:      func(db McEngine) bool { _, ok := db.(TTLer); return ok },
+	CmdBackup:   func(db McEngine) bool { _, ok := db.(Dumper); return ok },
+	CmdDigest:   func(db McEngine) bool { _, ok := db.(Dumper); return ok },
+	CmdSetRange: func(db McEngine) bool { _, ok := db.(Updater); return ok },
+	CmdSetBit:   func(db McEngine) bool { _, ok := db.(Updater); return ok },
+	CmdLPush:    func(db McEngine) bool { _, ok := db.(Updater); return ok },
+	CmdRPush:    func(db McEngine) bool { _, ok := db.(Updater); return ok },
+	CmdLPop:     func(db McEngine) bool { _, ok := db.(Updater); return ok },
+	CmdRPop:     func(db McEngine) bool { _, ok := db.(Updater); return ok },
+	CmdAdd:      func(db McEngine) bool { _, ok := db.(Adder); return ok },
+	CmdReplace:  func(db McEngine) bool { _, ok := db.(Adder); return ok },
+	CmdAppend:   func(db McEngine) bool { _, ok := db.(Appender); return ok },
+	CmdPrepend:  func(db McEngine) bool { _, ok := db.(Appender); return ok },
+	CmdCAS:      func(db McEngine) bool { _, ok := db.(CASSetter); return ok },
+	CmdTouch:    func(db McEngine) bool { _, ok := db.(Toucher); return ok },
+	CmdGat:      func(db McEngine) bool { _, ok := db.(GetToucher); return ok },
+	CmdGats:     func(db McEngine) bool { _, ok := db.(GetToucher); return ok },
+	CmdFlushAll: func(db McEngine) bool { _, ok := db.(Flusher); return ok },
+	CmdMetaDebug: func(McEngine) bool {
+		return tracing.Load().(*traceStore) != nil
+	},
+}
+
+// commandsServed lists the verbs served with db and cfg, sorted
+func commandsServed(db McEngine, cfg *config) []string {
+	commandsMu.RLock()
+	defer commandsMu.RUnlock()
+	var verbs []string
+	for verb, e := range commands {
+		if verb != strings.ToLower(verb) || !cfg.allows([]byte(verb)) {
+			continue
+		}
+		if supports, ok := engineSupports[e.cmd]; ok && !supports(db) {
+			continue
+		}
+		verbs = append(verbs, verb)
+	}
+	sort.Strings(verbs)
+	return verbs
+}
+
+// GroupStatser is an optional interface for engines answering the stats
+// groups of memcached, like "stats items", "stats slabs" or "stats sizes".
+// StatsGroup returns the stats of group, ErrUnsupported if it has none.
+// Settings are merged into those of the server, like for Statser.
+type GroupStatser interface {
+	StatsGroup(group string) (map[string]string, error)
+}
+
+// StatsResetter is an optional interface for engines zeroing their
+// statistics on "stats reset"
+type StatsResetter interface {
+	ResetStats() error
+}
+
+var resultReset = []byte("RESET\r\n")
+
+// emptyStatsGroups are the stats groups of memcached answered with no
+// stats when the engine has none, so monitoring tools probing them don't
+// wait for END
+var emptyStatsGroups = map[string]bool{"items": true, "slabs": true, "sizes": true}
+
+// stats serves "stats [group]" as lines
+//
+//	STAT <name> <value>
+//	...
+//	END
+//
+// "stats" answers the server statistics merged with those of a Statser
+// engine and "stats reset" zeroes them, see resetStats. "stats settings"
+// answers the effective settings and capabilities of the connection, so
+// clients can probe them: besides the params it reports the protocols and
+// the commands served. Other groups are answered by a GroupStatser engine.
+func (h *engineHandler) stats(w ResponseWriter, r *Request) (err error) {
+	if len(r.Args) > 1 {
+		return h.badLine(w, r)
+	}
+	if len(r.Args) == 1 && string(r.Args[0]) == "reset" {
+		return h.resetStats(w, r)
+	}
+	var stats []setting
+	var engine map[string]string
+	switch {
+	case len(r.Args) == 0:
+		stats = h.serverStats()
+		if st, ok := h.db.(Statser); ok {
+			engine, err = st.Stats()
+		}
+	default:
+		group := string(r.Args[0])
+		if group == "settings" {
+			stats = append(h.cfg.settings(),
+				setting{"protocols", strings.Join([]string{ProtocolText.String(), ProtocolMeta.String(), ProtocolBinary.String()}, ",")},
+				setting{"commands", strings.Join(commandsServed(h.db, h.cfg), ",")})
+		}
+		err = ErrUnsupported
+		if gs, ok := h.db.(GroupStatser); ok {
+			engine, err = gs.StatsGroup(group)
+		}
+		if err == ErrUnsupported && (stats != nil || emptyStatsGroups[group]) {
+			err = nil
+		}
+	}
+	if err != nil {
+		if !refused(err) {
+			connError(r.RemoteAddr, err)
+		}
+		return engineError(w.ReadWriter(), err)
+	}
+	return writeStats(w, mergeStats(stats, engine))
+}
+
+// resetStats serves "stats reset": it zeroes the command counts, hits,
+// misses and bytes, and the stats of a StatsResetter engine. Totals are
+// kept, they may be persisted across restarts.
+func (h *engineHandler) resetStats(w ResponseWriter, r *Request) error {
+	for i := range commandCounts {
+		commandCounts[i].reset()
+	}
+	for _, c := range []*counter{&getKeys, &getHits, &bytesRead, &bytesWritten} {
+		c.reset()
+	}
+	if sr, ok := h.db.(StatsResetter); ok {
+		if err := sr.ResetStats(); err != nil {
+			if !refused(err) {
+				connError(r.RemoteAddr, err)
+			}
+			return engineError(w.ReadWriter(), err)
+		}
+	}
+	if _, err := w.Write(resultReset); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// serverStats lists the server statistics, then the cmd_<verb> counts
+// of the commands received
+func (h *engineHandler) serverStats() []setting {
+	u := func(n uint64) string { return strconv.FormatUint(n, 10) }
+	now := time.Now()
+	boot := BootTotals()
+	hits := getHits.load()
+	keys := getKeys.load()
+	if keys < hits {
+		keys = hits // loaded while a command runs
+	}
+	stats := []setting{
+		{"pid", strconv.Itoa(os.Getpid())},
+		{"uptime", strconv.FormatInt(int64(now.Sub(started)/time.Second), 10)},
+		{"time", strconv.FormatInt(now.Unix(), 10)},
+		{"curr_connections", strconv.Itoa(len(Conns()))},
+		{"total_connections", u(boot.Connections)},
+		{"total_items", u(boot.Items)},
+		{"get_hits", u(hits)},
+		{"get_misses", u(keys - hits)},
+		{"bytes_read", u(bytesRead.load())},
+		{"bytes_written", u(bytesWritten.load())},
+	}
+	for cmd := CmdGet; cmd < CmdCustom; cmd++ {
+		if n := commandCounts[cmd].load(); n > 0 {
+			stats = append(stats, setting{"cmd_" + cmd.String(), u(n)})
+		}
+	}
+	return stats
+}
+
+// mergeStats replaces server stats by the engine stats of the same name
+// and appends the other engine stats sorted by name
+func mergeStats(stats []setting, engine map[string]string) []setting {
+	served := make(map[string]bool, len(stats))
+	for i, s := range stats {
+		served[s.name] = true
+		if v, ok := engine[s.name]; ok {
+			stats[i].value = v
+		}
+	}
+	names := make([]string, 0, len(engine))
+	for name := range engine {
+		if !served[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		stats = append(stats, setting{name, engine[name]})
+	}
+	return stats
+}
+
+// version serves "version" with the version param: VERSION <version>
+func (h *engineHandler) version(w ResponseWriter, r *Request) error {
+	if len(r.Args) != 0 {
+		return h.badLine(w, r)
+	}
+	if _, err := w.WriteString("VERSION " + h.cfg.version + "\r\n"); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// setVerbosity serves "verbosity <level> [noreply]", it sets the log
+// level of the server at runtime, see verbosity
+func (h *engineHandler) setVerbosity(w ResponseWriter, r *Request) error {
+	noreply := len(r.Args) == 2 && isNoreply(r.Args[1])
+	if len(r.Args) != 1 && !noreply {
+		return h.badLine(w, r)
+	}
+	level, err := strconv.ParseUint(string(r.Args[0]), 10, 31)
+	if err != nil {
+		return h.badLine(w, r)
+	}
+	setLogLevel(int32(level))
+	if noreply {
+		return nil
+	}
+	if _, err = w.Write(resultOK); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// writeStats answers STAT lines of the settings with a value, then END
+func writeStats(w ResponseWriter, stats []setting) (err error) {
+	for _, s := range stats {
+		if s.value == "" {
+			continue
+		}
+		if _, err = w.WriteString("STAT " + s.name + " " + s.value + "\r\n"); err != nil {
+			return
+		}
+	}
+	if _, err = w.Write(resultEnd); err != nil {
+		return
+	}
+	return w.Flush()
+}
@@ -0,0 +1,107 @@
+package mcproto
+
+import "strconv"
+
+// Adder is an optional interface for engines supporting the conditional
+// storage commands. Add stores the item only if key has none, Replace only
+// if it has one, otherwise they return ErrNotStored. Keys and values are
+// owned by the engine, like those passed to Set.
+type Adder interface {
+	Add(key, value []byte, flags uint32, exp int32) error
+	Replace(key, value []byte, flags uint32, exp int32) error
+}
+
+// Appender is an optional interface for engines that can extend values.
+// Append adds value after the value of key, Prepend before it, keeping
+// the flags and lifetime of the item. Both return ErrNotStored if key has
+// no item. value is owned by the engine.
+type Appender interface {
+	Append(key, value []byte) error
+	Prepend(key, value []byte) error
+}
+
+// CASSetter is an optional interface for engines versioning items with
+// CAS unique values, see CASGetter. CompareAndSwap stores the item only if
+// key still has the CAS cas, it returns ErrCASConflict if the item was
+// modified since and ErrCacheMiss if there is none. Keys and values are
+// owned by the engine, like those passed to Set.
+type CASSetter interface {
+	CompareAndSwap(key, value []byte, flags uint32, exp int32, cas uint64) error
+}
+
+// addReplace serves "add|replace <key> <flags> <exptime> <bytes> [noreply]"
+// with a data block
+func (h *engineHandler) addReplace(w ResponseWriter, r *Request, add bool) (err error) {
+	a, ok := h.db.(Adder)
+	if !ok {
+		return protocolError(w.ReadWriter())
+	}
+	if add {
+		return h.storeWith(w, r, a.Add)
+	}
+	return h.storeWith(w, r, a.Replace)
+}
+
+// appendPrepend serves "append|prepend <key> <flags> <exptime> <bytes> [noreply]"
+// with a data block, flags and exptime are ignored like in memcached
+func (h *engineHandler) appendPrepend(w ResponseWriter, r *Request, after bool) (err error) {
+	a, ok := h.db.(Appender)
+	if !ok {
+		return protocolError(w.ReadWriter())
+	}
+	extend := a.Prepend
+	if after {
+		extend = a.Append
+	}
+	return h.storeWith(w, r, func(key, value []byte, _ uint32, _ int32) error { return extend(key, value) })
+}
+
+// compareAndSwap serves "cas <key> <flags> <exptime> <bytes> <cas unique> [noreply]"
+// with a data block
+func (h *engineHandler) compareAndSwap(w ResponseWriter, r *Request) (err error) {
+	cs, ok := h.db.(CASSetter)
+	if !ok {
+		return protocolError(w.ReadWriter())
+	}
+	noreply := len(r.Args) == 6 && isNoreply(r.Args[5])
+	if len(r.Args) != 5 && !noreply {
+		return h.badLine(w, r)
+	}
+	flags, errFlags := strconv.ParseUint(string(r.Args[1]), 10, 32)
+	exp, errExp := strconv.ParseInt(string(r.Args[2]), 10, 32)
+	cas, errCAS := strconv.ParseUint(string(r.Args[4]), 10, 64)
+	if errFlags != nil || errExp != nil || errCAS != nil || string(r.Args[3]) != strconv.Itoa(len(r.Data)) {
+		return h.badLine(w, r)
+	}
+	err = cs.CompareAndSwap(h.key(r.Args[0]), r.Data, uint32(flags), h.cfg.exp(int32(exp)), cas)
+	if err == nil {
+		wrote(r)
+	}
+	if noreply {
+		if !resumableError(err) {
+			connError(r.RemoteAddr, err)
+		}
+		return nil
+	}
+	return storeResult(w, r, err)
+}
+
+// storeWith serves a conditional storage command with the arguments of set,
+// the item is stored by store
+func (h *engineHandler) storeWith(w ResponseWriter, r *Request, store func(key, value []byte, flags uint32, exp int32) error) error {
+	_, flags, exp, size, noreply, err := scanSetLine(r.Line, r.Command, isUpper(r.Line))
+	if err != nil || size != len(r.Data) {
+		return h.badLine(w, r)
+	}
+	err = store(h.key(r.Args[0]), r.Data, flags, h.cfg.exp(exp))
+	if err == nil {
+		wrote(r)
+	}
+	if noreply {
+		if err != ErrNotStored {
+			connError(r.RemoteAddr, err)
+		}
+		return nil
+	}
+	return storeResult(w, r, err)
+}
@@ -0,0 +1,160 @@
+package mcproto
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// streamFlushEvery is how many entries are buffered before a streamed
+// response is flushed, so clients see progress on huge result sets
+const streamFlushEvery = 64
+
+// errStreamBroken closes the connection when an engine fails mid-stream,
+// after part of the response is already sent
+var errStreamBroken = errors.New("stream broken")
+
+// GetsStreamer is an optional interface for engines that produce multi-get
+// results incrementally. GetsStream calls emit for every hit and must return
+// the first error emit returns. The server writes the VALUE lines and END,
+// so results don't need to be materialized. It's used instead of Gets.
+type GetsStreamer interface {
+	GetsStream(keys [][]byte, emit func(key, value []byte) error) error
+}
+
+// ScanStreamer is an optional interface for engines that produce scan
+// results incrementally, like GetsStreamer. It's used instead of Scan.
+type ScanStreamer interface {
+	ScanStream(cursor uint64, match []byte, count int, emit func(key []byte) error) (next uint64, err error)
+}
+
+// streamWriter frames streamed entries and flushes them in batches
+type streamWriter struct {
+	rw *bufio.ReadWriter
+	n  int
+}
+
+func (sw *streamWriter) entry(format string, args ...interface{}) (err error) {
+	if _, err = fmt.Fprintf(sw.rw, format, args...); err != nil {
+		return
+	}
+	if sw.n++; sw.n%streamFlushEvery == 0 {
+		err = sw.rw.Flush()
+	}
+	return
+}
+
+// fail ends a stream broken by err. If nothing is sent yet the error
+// is reported as a normal response, otherwise the connection is closed
+// because the client can't tell where the response ends.
+func (sw *streamWriter) fail(err error) error {
+	if sw.n == 0 {
+		return engineError(sw.rw, err)
+	}
+	if serr := serverError(sw.rw, err.Error()); serr != nil {
+		return serr
+	}
+	return errStreamBroken
+}
+
+// keyOrder answers the values of a multi-get in the order of its keys,
+// repeating repeated keys, whatever order the engine finds them in.
+// Values found in order are written at once, others are held until their turn.
+type keyOrder struct {
+	keys   [][]byte          // of the request
+	next   int               // index of the first key not answered
+	wanted map[string]int    // answers left per key
+	held   map[string][]byte // values found before their turn
+	write  func(key, value []byte) error
+}
+
+func newKeyOrder(keys [][]byte, write func(key, value []byte) error) *keyOrder {
+	o := &keyOrder{keys: keys, wanted: make(map[string]int, len(keys)), held: make(map[string][]byte), write: write}
+	for _, key := range keys {
+		o.wanted[string(key)]++
+	}
+	return o
+}
+
+// found accounts the value of key, keys not asked or found twice are ignored
+func (o *keyOrder) found(key, value []byte) error {
+	left := o.wanted[string(key)]
+	if _, ok := o.held[string(key)]; ok || left == 0 {
+		return nil
+	}
+	if left == 1 && bytes.Equal(key, o.keys[o.next]) {
+		o.wanted[string(key)] = 0
+		o.next++
+		if err := o.write(key, value); err != nil {
+			return err
+		}
+	} else {
+		o.held[string(key)] = append(make([]byte, 0, len(value)), value...)
+	}
+	return o.flush(false)
+}
+
+// flush writes the held values whose turn came, with all the rest
+// skipping missing keys once the engine is done
+func (o *keyOrder) flush(done bool) error {
+	for ; o.next < len(o.keys); o.next++ {
+		key := o.keys[o.next]
+		value, ok := o.held[string(key)]
+		if !ok {
+			if !done {
+				return nil
+			}
+			continue
+		}
+		if o.wanted[string(key)]--; o.wanted[string(key)] == 0 {
+			delete(o.held, string(key))
+		}
+		if err := o.write(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// streamGets serves a multi-get with GetsStreamer in the order of keys,
+// the engine is asked once per key. onHit is called for every answered key.
+func streamGets(gs GetsStreamer, keys [][]byte, rw *bufio.ReadWriter, onHit func(key []byte)) error {
+	sw := &streamWriter{rw: rw}
+	order := newKeyOrder(keys, func(key, value []byte) error {
+		if err := sw.entry("VALUE %s 0 %d\r\n%s\r\n", key, len(value), value); err != nil {
+			return err
+		}
+		onHit(key)
+		return nil
+	})
+	err := gs.GetsStream(uniqueKeys(keys), order.found)
+	if err == nil {
+		err = order.flush(true)
+	}
+	if err != nil {
+		return sw.fail(err)
+	}
+	if _, err = rw.Write(resultEnd); err != nil {
+		return err
+	}
+	return rw.Flush()
+}
+
+// streamScan serves scan with ScanStreamer
+func streamScan(ss ScanStreamer, cursor uint64, match []byte, count int, rw *bufio.ReadWriter) error {
+	sw := &streamWriter{rw: rw}
+	next, err := ss.ScanStream(cursor, match, count, func(key []byte) error {
+		return sw.entry("KEY %s\r\n", key)
+	})
+	if err != nil {
+		return sw.fail(err)
+	}
+	if _, err = fmt.Fprintf(rw, "CURSOR %d\r\n", next); err != nil {
+		return err
+	}
+	if _, err = rw.Write(resultEnd); err != nil {
+		return err
+	}
+	return rw.Flush()
+}
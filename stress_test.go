@@ -0,0 +1,151 @@
+package mcproto_test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/recoilme/mcproto"
+)
+
+// engines to stress, all backed by mapStore
+func stressEngines() map[string]func() mcproto.McEngine {
+	return map[string]func() mcproto.McEngine{
+		"map":       newStore,
+		"tombstone": func() mcproto.McEngine { return mcproto.NewTombstoneEngine(newStore(), time.Second) },
+		"migrate":   func() mcproto.McEngine { return mcproto.NewMigrateEngine(newStore(), newStore()) },
+		"canary":    func() mcproto.McEngine { return mcproto.NewCanaryEngine(newStore(), newStore(), 50) },
+		"policy": func() mcproto.McEngine {
+			return mcproto.NewPolicyEngine(newStore(), mcproto.PrefixPolicy{Prefix: "c1", Compress: true})
+		},
+	}
+}
+
+// Test_Concurrent runs hundreds of connections with mixed pipelines,
+// run it with -race
+func Test_Concurrent(t *testing.T) {
+	if testing.Short() {
+		t.Skip("stress test")
+	}
+	const conns, rounds = 200, 10
+	for name, newEngine := range stressEngines() {
+		t.Run(name, func(t *testing.T) {
+			listener := serve(t, newEngine(), "deadline=5000")
+			defer listener.Close()
+
+			var wg sync.WaitGroup
+			errs := make(chan error, conns)
+			for i := 0; i < conns; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					errs <- pipeline(listener.Addr().String(), i, rounds)
+				}(i)
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				if err != nil {
+					t.Error(err)
+				}
+			}
+		})
+	}
+}
+
+// pipeline sends rounds of mixed commands in one write and checks the responses
+func pipeline(addr string, id, rounds int) error {
+	conn, r, err := dialAddr(addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var req, want strings.Builder
+	for j := 0; j < rounds; j++ {
+		key := fmt.Sprintf("c%dk%d", id, j)
+		val := fmt.Sprintf("v%d", j)
+		fmt.Fprintf(&req, "set %s 0 0 %d\r\n%s\r\n", key, len(val), val)
+		fmt.Fprintf(&want, "STORED\r\n")
+		fmt.Fprintf(&req, "get %s\r\n", key)
+		fmt.Fprintf(&want, "VALUE %s 0 %d\r\n%s\r\nEND\r\n", key, len(val), val)
+		fmt.Fprintf(&req, "get %s missing %s\r\n", key, key)
+		fmt.Fprintf(&want, "VALUE %s 0 %d\r\n%s\r\nVALUE %s 0 %d\r\n%s\r\nEND\r\n", key, len(val), val, key, len(val), val)
+		fmt.Fprintf(&req, "delete %s\r\n", key)
+		fmt.Fprintf(&want, "DELETED\r\n")
+		fmt.Fprintf(&req, "get %s\r\n", key)
+		fmt.Fprintf(&want, "END\r\n")
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err = conn.Write([]byte(req.String())); err != nil {
+		return err
+	}
+	got := make([]byte, want.Len())
+	if _, err = io.ReadFull(r, got); err != nil {
+		return fmt.Errorf("conn %d: %v, got %q", id, err, got)
+	}
+	if string(got) != want.String() {
+		return fmt.Errorf("conn %d: unexpected responses %q", id, got)
+	}
+	return nil
+}
+
+// Test_DropDuringTraffic closes the listener and all clients mid-pipeline
+// and checks that every server connection goroutine exits
+func Test_DropDuringTraffic(t *testing.T) {
+	if testing.Short() {
+		t.Skip("stress test")
+	}
+	listener := serve(t, newStore(), "deadline=5000")
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			conn, r, err := dialAddr(listener.Addr().String())
+			if err != nil {
+				return
+			}
+			go func() {
+				<-stop
+				conn.Close()
+			}()
+			for j := 0; ; j++ {
+				key := fmt.Sprintf("d%dk%d", i, j)
+				if _, err = fmt.Fprintf(conn, "set %s 0 0 1\r\n1\r\nget %s\r\n", key, key); err != nil {
+					return
+				}
+				for k := 0; k < 4; k++ {
+					if _, err = r.ReadString('\n'); err != nil {
+						return
+					}
+				}
+			}
+		}(i)
+	}
+	time.Sleep(50 * time.Millisecond)
+	listener.Close()
+	close(stop)
+	wg.Wait()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(mcproto.Conns()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := len(mcproto.Conns()); n > 0 {
+		t.Errorf("Expected all connections closed, %d open", n)
+	}
+}
+
+func dialAddr(addr string) (conn net.Conn, r *bufio.Reader, err error) {
+	conn, err = net.Dial("tcp", addr)
+	if err != nil {
+		return
+	}
+	return conn, bufio.NewReader(conn), nil
+}
@@ -0,0 +1,158 @@
+package mcproto
+
+import (
+	"bytes"
+	"strconv"
+)
+
+// maxKeyLength is the longest key allowed by the protocol
+const maxKeyLength = 250
+
+// strictCheck enforces the MUSTs of protocol.txt on a command line for the
+// strict param, so third-party clients can be validated. It returns the
+// class and CLIENT_ERROR message of the first violation, msg is "" if none.
+func strictCheck(line []byte, cmd Command, args [][]byte) (kind Violation, msg string) {
+	if !bytes.HasSuffix(line, crlf) {
+		return ViolationCRLF, "line must end with CRLF"
+	}
+	if isUpper(line) {
+		return ViolationSyntax, "commands must be lower case"
+	}
+	body := line[:len(line)-2]
+	if len(body) == 0 || body[0] == ' ' || body[len(body)-1] == ' ' ||
+		bytes.Contains(body, []byte("  ")) || bytes.ContainsAny(body, "\t\r\n") {
+		return ViolationSyntax, "tokens must be separated by single spaces"
+	}
+	return checkArgs(cmd, args)
+}
+
+// lineViolation classifies a command line a handler failed to parse
+func lineViolation(line []byte, cmd Command, args [][]byte) Violation {
+	if !bytes.HasSuffix(line, crlf) {
+		return ViolationCRLF
+	}
+	if kind, msg := checkArgs(cmd, args); msg != "" {
+		return kind
+	}
+	return ViolationSyntax
+}
+
+// checkArgs checks the argument count, keys and numbers of a command
+func checkArgs(cmd Command, args [][]byte) (kind Violation, msg string) {
+	switch cmd {
+	case CmdGet, CmdGets:
+		if len(args) == 0 {
+			return ViolationSyntax, "missing key"
+		}
+		for _, key := range args {
+			if msg := strictKey(key); msg != "" {
+				return ViolationKey, msg
+			}
+		}
+	case CmdSet, CmdAdd, CmdReplace, CmdAppend, CmdPrepend:
+		if len(args) != 4 && !(len(args) == 5 && isNoreply(args[4])) {
+			return ViolationSyntax, "usage: " + cmd.String() + " <key> <flags> <exptime> <bytes> [noreply]"
+		}
+		if msg := strictKey(args[0]); msg != "" {
+			return ViolationKey, msg
+		}
+		if _, err := strconv.ParseUint(string(args[1]), 10, 32); err != nil {
+			return ViolationNumber, "bad flags"
+		}
+		if _, err := strconv.ParseInt(string(args[2]), 10, 32); err != nil {
+			return ViolationNumber, "bad exptime"
+		}
+	case CmdCAS:
+		if len(args) != 5 && !(len(args) == 6 && isNoreply(args[5])) {
+			return ViolationSyntax, "usage: cas <key> <flags> <exptime> <bytes> <cas unique> [noreply]"
+		}
+		if msg := strictKey(args[0]); msg != "" {
+			return ViolationKey, msg
+		}
+		if _, err := strconv.ParseUint(string(args[1]), 10, 32); err != nil {
+			return ViolationNumber, "bad flags"
+		}
+		if _, err := strconv.ParseInt(string(args[2]), 10, 32); err != nil {
+			return ViolationNumber, "bad exptime"
+		}
+		if _, err := strconv.ParseUint(string(args[4]), 10, 64); err != nil {
+			return ViolationNumber, "bad cas unique"
+		}
+	case CmdDelete:
+		if len(args) != 1 && !(len(args) == 2 && isNoreply(args[1])) {
+			return ViolationSyntax, "usage: delete <key> [noreply]"
+		}
+		if msg := strictKey(args[0]); msg != "" {
+			return ViolationKey, msg
+		}
+	case CmdTouch:
+		if len(args) != 2 && !(len(args) == 3 && isNoreply(args[2])) {
+			return ViolationSyntax, "usage: touch <key> <exptime> [noreply]"
+		}
+		if msg := strictKey(args[0]); msg != "" {
+			return ViolationKey, msg
+		}
+		if _, err := strconv.ParseInt(string(args[1]), 10, 32); err != nil {
+			return ViolationNumber, "bad exptime"
+		}
+	case CmdGat, CmdGats:
+		if len(args) < 2 {
+			return ViolationSyntax, "usage: " + cmd.String() + " <exptime> <key>+"
+		}
+		if _, err := strconv.ParseInt(string(args[0]), 10, 32); err != nil {
+			return ViolationNumber, "bad exptime"
+		}
+		for _, key := range args[1:] {
+			if msg := strictKey(key); msg != "" {
+				return ViolationKey, msg
+			}
+		}
+	case CmdFlushAll:
+		if len(args) > 0 && isNoreply(args[len(args)-1]) {
+			args = args[:len(args)-1]
+		}
+		if len(args) > 1 {
+			return ViolationSyntax, "usage: flush_all [delay] [noreply]"
+		}
+		if len(args) == 1 {
+			if _, err := strconv.ParseUint(string(args[0]), 10, 31); err != nil {
+				return ViolationNumber, "bad delay"
+			}
+		}
+	case CmdVerbosity:
+		if len(args) != 1 && !(len(args) == 2 && isNoreply(args[1])) {
+			return ViolationSyntax, "usage: verbosity <level> [noreply]"
+		}
+		if _, err := strconv.ParseUint(string(args[0]), 10, 31); err != nil {
+			return ViolationNumber, "bad level"
+		}
+	case CmdIncr, CmdDecr:
+		if len(args) != 2 && !(len(args) == 3 && isNoreply(args[2])) {
+			return ViolationSyntax, "usage: incr|decr <key> <value> [noreply]"
+		}
+		if msg := strictKey(args[0]); msg != "" {
+			return ViolationKey, msg
+		}
+		if _, err := strconv.ParseUint(string(args[1]), 10, 64); err != nil {
+			return ViolationNumber, "invalid numeric delta argument"
+		}
+	}
+	return
+}
+
+// strictKey checks a key: at most 250 bytes without control characters
+func strictKey(key []byte) string {
+	if len(key) > maxKeyLength {
+		return "key too long"
+	}
+	for _, b := range key {
+		if b <= ' ' || b == 0x7f {
+			return "key contains control characters"
+		}
+	}
+	return ""
+}
+
+func isNoreply(arg []byte) bool {
+	return string(arg) == "noreply"
+}
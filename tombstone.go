@@ -0,0 +1,114 @@
+package mcproto
+
+import (
+	"bufio"
+	"sync"
+	"time"
+)
+
+// TombstoneEngine wraps an engine so that deleted keys leave a tombstone
+// for a resurrection window, like the old memcached "delete <key> <time>":
+// while the tombstone is alive the key reads as missing and add/replace fail,
+// set succeeds and removes the tombstone.
+// Optional interfaces of the wrapped engine are not exposed, except Adder.
+type TombstoneEngine struct {
+	McEngine
+	window time.Duration
+
+	mu    sync.Mutex
+	tombs map[string]time.Time // key -> tombstone deadline
+}
+
+// NewTombstoneEngine returns db with tombstones living for window after delete
+func NewTombstoneEngine(db McEngine, window time.Duration) *TombstoneEngine {
+	return &TombstoneEngine{
+		McEngine: db,
+		window:   window,
+		tombs:    make(map[string]time.Time),
+	}
+}
+
+// Tombstoned reports whether key was deleted less than window ago
+func (t *TombstoneEngine) Tombstoned(key []byte) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	deadline, ok := t.tombs[string(key)]
+	if ok && time.Now().After(deadline) {
+		delete(t.tombs, string(key))
+		return false
+	}
+	return ok
+}
+
+// Get misses while key is tombstoned
+func (t *TombstoneEngine) Get(key []byte, rw *bufio.ReadWriter) (value []byte, noreply bool, err error) {
+	if t.Tombstoned(key) {
+		return
+	}
+	return t.McEngine.Get(key, rw)
+}
+
+// Release passes value back to the wrapped engine if it is a ValueReleaser
+func (t *TombstoneEngine) Release(value []byte) {
+	if rel, ok := t.McEngine.(ValueReleaser); ok {
+		rel.Release(value)
+	}
+}
+
+// Set stores value and removes the tombstone of key
+func (t *TombstoneEngine) Set(key, value []byte, flags uint32, exp int32, size int, noreply bool, rw *bufio.ReadWriter) (noreplyresp bool, err error) {
+	noreplyresp, err = t.McEngine.Set(key, value, flags, exp, size, noreply, rw)
+	if err == nil {
+		t.mu.Lock()
+		delete(t.tombs, string(key))
+		t.mu.Unlock()
+	}
+	return
+}
+
+// Add stores the item unless key has an item or a tombstone.
+// It returns ErrUnsupported if the wrapped engine is not an Adder.
+func (t *TombstoneEngine) Add(key, value []byte, flags uint32, exp int32) error {
+	a, ok := t.McEngine.(Adder)
+	if !ok {
+		return ErrUnsupported
+	}
+	if t.Tombstoned(key) {
+		return ErrNotStored
+	}
+	return a.Add(key, value, flags, exp)
+}
+
+// Replace stores the item if key has an item and no tombstone.
+// It returns ErrUnsupported if the wrapped engine is not an Adder.
+func (t *TombstoneEngine) Replace(key, value []byte, flags uint32, exp int32) error {
+	a, ok := t.McEngine.(Adder)
+	if !ok {
+		return ErrUnsupported
+	}
+	if t.Tombstoned(key) {
+		return ErrNotStored
+	}
+	return a.Replace(key, value, flags, exp)
+}
+
+// Delete removes key from the engine and leaves a tombstone
+func (t *TombstoneEngine) Delete(key []byte, rw *bufio.ReadWriter) (isFound bool, noreply bool, err error) {
+	isFound, noreply, err = t.McEngine.Delete(key, rw)
+	if err != nil || !isFound {
+		return
+	}
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.tombs[string(key)] = now.Add(t.window)
+	if len(t.tombs)%1024 == 0 {
+		// sweep expired tombstones from time to time
+		for k, deadline := range t.tombs {
+			if now.After(deadline) {
+				delete(t.tombs, k)
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,127 @@
+package mcproto
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// itemsStored counts items stored by engine handlers since boot
+var itemsStored counter
+
+// Totals are cumulative counters, see BootTotals and LifetimeTotals
+type Totals struct {
+	Items       uint64 `json:"total_items"`       // stored by set, add, replace, append, prepend and cas
+	Connections uint64 `json:"total_connections"` // accepted
+}
+
+// lifetimeBase holds the Totals of previous runs loaded by PersistTotals
+var lifetimeBase atomic.Value // Totals
+
+// BootTotals returns the counters since the process started
+func BootTotals() Totals {
+	return Totals{Items: itemsStored.load(), Connections: atomic.LoadUint64(&lastConnID)}
+}
+
+// LifetimeTotals returns the counters since the state file of PersistTotals
+// was created, BootTotals without one
+func LifetimeTotals() Totals {
+	base, _ := lifetimeBase.Load().(Totals)
+	boot := BootTotals()
+	return Totals{Items: base.Items + boot.Items, Connections: base.Connections + boot.Connections}
+}
+
+// TotalsFile keeps LifetimeTotals in a state file across restarts
+type TotalsFile struct {
+	path string
+
+	mu   sync.Mutex // serializes saves
+	stop chan struct{}
+	done chan struct{}
+}
+
+// PersistTotals loads the totals saved at path by a previous run, so
+// LifetimeTotals continue from them, and saves them every interval and on
+// Close. A missing file starts from zero. Counts after the last save are
+// lost on a crash, a short interval loses fewer.
+func PersistTotals(path string, interval time.Duration) (*TotalsFile, error) {
+	var base Totals
+	b, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	default:
+		if err = json.Unmarshal(b, &base); err != nil {
+			return nil, err
+		}
+	}
+	lifetimeBase.Store(base)
+	f := &TotalsFile{path: path, stop: make(chan struct{}), done: make(chan struct{})}
+	go f.run(interval)
+	return f, nil
+}
+
+func (f *TotalsFile) run(interval time.Duration) {
+	defer close(f.done)
+	if interval <= 0 {
+		<-f.stop
+		return
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := f.Save(); err != nil {
+				log.Printf("mcproto: totals: %v", err)
+			}
+		case <-f.stop:
+			return
+		}
+	}
+}
+
+// Save writes LifetimeTotals now, under a temporary name renamed
+// over the file, so a crash never leaves a torn file
+func (f *TotalsFile) Save() (err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	b, err := json.Marshal(LifetimeTotals())
+	if err != nil {
+		return
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(f.path), ".totals-*")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+	if _, err = tmp.Write(b); err != nil {
+		return
+	}
+	if err = tmp.Sync(); err != nil {
+		return
+	}
+	if err = tmp.Close(); err != nil {
+		return
+	}
+	return os.Rename(tmp.Name(), f.path)
+}
+
+// Close stops the periodic saves and saves the totals,
+// call it on graceful shutdown after connections are drained
+func (f *TotalsFile) Close() error {
+	close(f.stop)
+	<-f.done
+	return f.Save()
+}
@@ -0,0 +1,110 @@
+package mcproto
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// WriteTrace tells who last wrote a key, for debugging surprising values
+type WriteTrace struct {
+	Identity string    // of the connection, see SetIdentity
+	Addr     string    // client address
+	Command  Command   // set, delete, incr, ...
+	Time     time.Time // when the command was served
+}
+
+// traceStore remembers the last writer of up to size keys,
+// the keys traced first are forgotten first
+type traceStore struct {
+	size int
+
+	mu     sync.Mutex
+	traces map[string]WriteTrace
+	order  []string // by first trace
+}
+
+var tracing atomic.Value // *traceStore, nil if disabled
+
+func init() {
+	tracing.Store((*traceStore)(nil))
+}
+
+// SetWriteTracing records the writer of keys modified by engine handlers,
+// for up to keys keys. The trace of a key is returned by Traced and answered
+// to "me <key>". Zero disables tracing and forgets the traces.
+func SetWriteTracing(keys int) {
+	if keys <= 0 {
+		tracing.Store((*traceStore)(nil))
+		return
+	}
+	tracing.Store(&traceStore{size: keys, traces: make(map[string]WriteTrace)})
+}
+
+// Traced returns the trace of the last write of key
+func Traced(key []byte) (WriteTrace, bool) {
+	t := tracing.Load().(*traceStore)
+	if t == nil {
+		return WriteTrace{}, false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	wt, ok := t.traces[string(key)]
+	return wt, ok
+}
+
+func (t *traceStore) record(key string, wt WriteTrace) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.traces[key]; !ok {
+		for len(t.order) >= t.size {
+			delete(t.traces, t.order[0])
+			t.order = t.order[1:]
+		}
+		t.order = append(t.order, key)
+	}
+	t.traces[key] = wt
+}
+
+// wrote accounts a successful write of the key of r, for Snapshots, Totals and tracing
+func wrote(r *Request) {
+	mutations.inc()
+	switch r.Command {
+	case CmdSet, CmdAdd, CmdReplace, CmdAppend, CmdPrepend, CmdCAS:
+		itemsStored.inc()
+	}
+	t := tracing.Load().(*traceStore)
+	if t == nil || len(r.Args) == 0 {
+		return
+	}
+	wt := WriteTrace{Identity: Identity(r.Context()), Command: r.Command, Time: time.Now()}
+	if r.RemoteAddr != nil {
+		wt.Addr = r.RemoteAddr.String()
+	}
+	t.record(string(r.Args[0]), wt)
+}
+
+// metaDebug serves "me <key>" with the write trace of key:
+//
+//	ME <key> cmd=<command> id=<identity> addr=<address> at=<unix nano>
+//
+// EN if key has none, ERROR if tracing is off
+func (h *engineHandler) metaDebug(w ResponseWriter, r *Request) error {
+	if tracing.Load().(*traceStore) == nil {
+		return protocolError(w.ReadWriter())
+	}
+	if len(r.Args) != 1 {
+		return h.badLine(w, r)
+	}
+	wt, ok := Traced(r.Args[0])
+	if !ok {
+		w.Write(resultMetaMiss)
+		return w.Flush()
+	}
+	if _, err := fmt.Fprintf(w, "ME %s cmd=%s id=%s addr=%s at=%d\r\n",
+		r.Args[0], wt.Command, wt.Identity, wt.Addr, wt.Time.UnixNano()); err != nil {
+		return err
+	}
+	return w.Flush()
+}
@@ -0,0 +1,154 @@
+package mcproto
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Usage is the protocol traffic of one identity, see Identity
+type Usage struct {
+	Identity string `json:"identity"` // empty for unauthenticated connections
+	Commands uint64 `json:"commands"`
+	BytesIn  uint64 `json:"bytes_in"`  // command lines and data blocks
+	BytesOut uint64 `json:"bytes_out"` // responses
+}
+
+// UsageReport is the usage of all identities between Start and End
+type UsageReport struct {
+	Start   time.Time
+	End     time.Time
+	Records []Usage // ordered by identity
+}
+
+// connUsage accumulates the usage of a connection until it's collected
+type connUsage struct {
+	mu sync.Mutex
+	Usage
+}
+
+type usageReporter struct {
+	interval time.Duration
+	fn       func(UsageReport)
+	stop     chan struct{}
+}
+
+var (
+	usageMu      sync.Mutex
+	usageOn      int32                 // a reporter is running
+	usageStop    chan struct{}         // stops the running reporter
+	usagePending = map[string]*Usage{} // usage of closed connections and previous identities
+)
+
+// SetUsageReporter calls fn every interval with the byte-accurate traffic of
+// every identity since the previous report, for chargeback of shared caches.
+// A nil fn stops reporting.
+func SetUsageReporter(interval time.Duration, fn func(UsageReport)) {
+	usageMu.Lock()
+	defer usageMu.Unlock()
+	if usageStop != nil {
+		close(usageStop)
+		usageStop = nil
+	}
+	if fn == nil || interval <= 0 {
+		atomic.StoreInt32(&usageOn, 0)
+		return
+	}
+	atomic.StoreInt32(&usageOn, 1)
+	usageStop = make(chan struct{})
+	r := &usageReporter{interval: interval, fn: fn, stop: usageStop}
+	go r.run()
+}
+
+func (r *usageReporter) run() {
+	t := time.NewTicker(r.interval)
+	defer t.Stop()
+	start := time.Now()
+	for {
+		select {
+		case end := <-t.C:
+			r.fn(UsageReport{Start: start, End: end, Records: collectUsage()})
+			start = end
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// meter adds a served command to the usage of the connection
+func (mc *conn) meter(in, out uint64) {
+	if atomic.LoadInt32(&usageOn) == 0 {
+		return
+	}
+	identity := Identity(mc.ctx)
+	u := &mc.usage
+	u.mu.Lock()
+	if identity != u.Identity {
+		// authenticated mid-connection, earlier traffic stays with the old identity
+		movePending(&u.Usage)
+		u.Identity = identity
+	}
+	u.Commands++
+	u.BytesIn += in
+	u.BytesOut += out
+	u.mu.Unlock()
+}
+
+// closeUsage keeps the uncollected usage of a closing connection
+func (mc *conn) closeUsage() {
+	u := &mc.usage
+	u.mu.Lock()
+	movePending(&u.Usage)
+	u.mu.Unlock()
+}
+
+// movePending moves u to usagePending and clears it
+func movePending(u *Usage) {
+	if u.Commands == 0 {
+		return
+	}
+	usageMu.Lock()
+	addUsage(usagePending, *u)
+	usageMu.Unlock()
+	*u = Usage{Identity: u.Identity}
+}
+
+func addUsage(m map[string]*Usage, u Usage) {
+	sum, ok := m[u.Identity]
+	if !ok {
+		sum = &Usage{Identity: u.Identity}
+		m[u.Identity] = sum
+	}
+	sum.Commands += u.Commands
+	sum.BytesIn += u.BytesIn
+	sum.BytesOut += u.BytesOut
+}
+
+// collectUsage takes the usage of open connections and usagePending
+func collectUsage() []Usage {
+	sums := make(map[string]*Usage)
+	openConns.Range(func(_, v interface{}) bool {
+		u := &v.(*conn).usage
+		u.mu.Lock()
+		if u.Commands > 0 {
+			addUsage(sums, u.Usage)
+			u.Usage = Usage{Identity: u.Identity}
+		}
+		u.mu.Unlock()
+		return true
+	})
+	usageMu.Lock()
+	for _, u := range usagePending {
+		addUsage(sums, *u)
+	}
+	usagePending = map[string]*Usage{}
+	usageMu.Unlock()
+
+	list := make([]Usage, 0, len(sums))
+	for _, u := range sums {
+		list = append(list, *u)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Identity < list[j].Identity })
+	return list
+}
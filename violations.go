@@ -0,0 +1,177 @@
+package mcproto
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Violation is a class of protocol violation by a client
+type Violation int
+
+// Violation classes
+const (
+	ViolationSyntax     Violation = iota // malformed command line, like a wrong argument count
+	ViolationCRLF                        // a line or data block not ending with CRLF
+	ViolationKey                         // a key too long or with control characters
+	ViolationNumber                      // a malformed flags, exptime, size or delta
+	ViolationLineLength                  // a command line longer than maxline
+	ViolationUnknown                     // an unknown command
+	violationClasses
+)
+
+var violationNames = [...]string{"syntax", "crlf", "key", "number", "line_length", "unknown"}
+
+func (v Violation) String() string {
+	if v < 0 || v >= violationClasses {
+		return fmt.Sprintf("violation(%d)", int(v))
+	}
+	return violationNames[v]
+}
+
+// ClientViolations are the protocol violations of one client address
+type ClientViolations struct {
+	Addr   string            `json:"addr"`   // host without port
+	Counts map[string]uint64 `json:"counts"` // by Violation name
+	Banned time.Time         `json:"banned"` // banned until, zero if not banned
+}
+
+// ViolationBan closes the connections of a client address with Threshold
+// violations within Window and refuses it for Duration, so misbehaving
+// or hostile clients don't waste server time.
+type ViolationBan struct {
+	Threshold int           // 0 disables banning
+	Window    time.Duration // default 1 minute
+	Duration  time.Duration // default 1 minute
+}
+
+// maxViolationClients bounds the tracked addresses, violations of
+// more addresses are not counted
+const maxViolationClients = 10000
+
+// errBanned closes the connections of banned addresses
+var errBanned = errors.New("mcproto: address banned for protocol violations")
+
+type clientViolations struct {
+	mu          sync.Mutex
+	counts      [violationClasses]uint64
+	strikes     int       // violations in the current ban window
+	windowStart time.Time // start of the ban window
+	bannedUntil time.Time
+}
+
+var (
+	violationClients sync.Map     // host -> *clientViolations
+	violationHosts   int64        // tracked addresses
+	violationBan     atomic.Value // ViolationBan
+)
+
+func init() {
+	violationBan.Store(ViolationBan{})
+}
+
+// SetViolationBan sets the ban policy, a zero Threshold disables it and lifts current bans
+func SetViolationBan(b ViolationBan) {
+	if b.Window <= 0 {
+		b.Window = time.Minute
+	}
+	if b.Duration <= 0 {
+		b.Duration = time.Minute
+	}
+	violationBan.Store(b)
+}
+
+// Violations returns the protocol violations of client addresses ordered by address
+func Violations() []ClientViolations {
+	var list []ClientViolations
+	banning := violationBan.Load().(ViolationBan).Threshold > 0
+	violationClients.Range(func(k, v interface{}) bool {
+		cv := v.(*clientViolations)
+		s := ClientViolations{Addr: k.(string), Counts: make(map[string]uint64)}
+		cv.mu.Lock()
+		for kind, n := range cv.counts {
+			if n > 0 {
+				s.Counts[Violation(kind).String()] = n
+			}
+		}
+		if banning && time.Now().Before(cv.bannedUntil) {
+			s.Banned = cv.bannedUntil
+		}
+		cv.mu.Unlock()
+		list = append(list, s)
+		return true
+	})
+	sort.Slice(list, func(i, j int) bool { return list[i].Addr < list[j].Addr })
+	return list
+}
+
+// recordViolation counts a violation of the client of ctx and applies the ban policy
+func recordViolation(ctx context.Context, kind Violation) {
+	m := metaFrom(ctx)
+	if m == nil {
+		return
+	}
+	host := addrHost(m.addr)
+	v, ok := violationClients.Load(host)
+	if !ok {
+		if atomic.LoadInt64(&violationHosts) >= maxViolationClients {
+			return
+		}
+		var loaded bool
+		if v, loaded = violationClients.LoadOrStore(host, &clientViolations{}); !loaded {
+			atomic.AddInt64(&violationHosts, 1)
+		}
+	}
+	cv := v.(*clientViolations)
+	ban := violationBan.Load().(ViolationBan)
+	now := time.Now()
+	cv.mu.Lock()
+	cv.counts[kind]++
+	if ban.Threshold > 0 {
+		if now.Sub(cv.windowStart) > ban.Window {
+			cv.windowStart, cv.strikes = now, 0
+		}
+		cv.strikes++
+		if cv.strikes >= ban.Threshold {
+			cv.bannedUntil = now.Add(ban.Duration)
+			cv.strikes = 0
+		}
+	}
+	cv.mu.Unlock()
+}
+
+// banned reports whether the client of ctx is banned
+func banned(ctx context.Context) bool {
+	if violationBan.Load().(ViolationBan).Threshold == 0 {
+		return false
+	}
+	m := metaFrom(ctx)
+	if m == nil {
+		return false
+	}
+	v, ok := violationClients.Load(addrHost(m.addr))
+	if !ok {
+		return false
+	}
+	cv := v.(*clientViolations)
+	cv.mu.Lock()
+	defer cv.mu.Unlock()
+	return time.Now().Before(cv.bannedUntil)
+}
+
+// addrHost returns the host of addr, client ports change between connections
+func addrHost(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
@@ -0,0 +1,71 @@
+package mcproto
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+var writeErrors uint64
+
+// WriteErrors returns the number of failed writes to client connections
+func WriteErrors() uint64 {
+	return atomic.LoadUint64(&writeErrors)
+}
+
+// connWriter writes to a client connection with a write deadline and
+// remembers the first error: after a failed or short write the response
+// stream is broken, so the connection must not be written again.
+type connWriter struct {
+	c       net.Conn
+	timeout time.Duration
+	err     error
+	written uint64 // bytes written to c
+}
+
+func (w *connWriter) Write(p []byte) (n int, err error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.timeout > 0 {
+		w.c.SetWriteDeadline(time.Now().Add(w.timeout))
+	}
+	for n < len(p) && err == nil {
+		var m int
+		m, err = w.c.Write(p[n:])
+		n += m
+		w.written += uint64(m)
+		if m == 0 && err == nil {
+			err = io.ErrShortWrite
+		}
+	}
+	if err != nil {
+		w.err = err
+		atomic.AddUint64(&writeErrors, 1)
+	}
+	return
+}
+
+// sendFile copies size bytes of f from off to the connection. io.Copy lets
+// TCP connections on Linux use sendfile, so the bytes don't pass through
+// user space. A short file breaks the response like a short write.
+func (w *connWriter) sendFile(f *os.File, off, size int64, timeout time.Duration) (n int64, err error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if _, err = f.Seek(off, io.SeekStart); err == nil {
+		w.c.SetWriteDeadline(time.Now().Add(timeout))
+		n, err = io.Copy(w.c, io.LimitReader(f, size))
+		w.written += uint64(n)
+		if err == nil && n < size {
+			err = io.ErrShortWrite
+		}
+	}
+	if err != nil {
+		w.err = err
+		atomic.AddUint64(&writeErrors, 1)
+	}
+	return
+}